@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// Carts are swept this often, taking this many idle carts at a time
+const cartSweepInterval = time.Minute
+const cartSweepBatch = 100
+
+// The keys of a cart expire this long after the cart is abandoned, so the
+// sweeper gets to record it before Redis drops it
+const cartExpiryGrace = time.Hour
+
+// Abandoned carts are kept this long for the follow-ups
+const abandonedCartRetention = 30 * 24 * time.Hour
+
+const defaultAbandonedLimit = 100
+const maxAbandonedLimit = 1000
+
+// abandonedCart is what was left in a cart which wasn't touched for the cart
+// TTL, LastActivity is when the cart was last changed
+type abandonedCart struct {
+	Id           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Items        []cartItem `json:"items"`
+	LastActivity int64      `json:"last_activity"`
+	AbandonedAt  int64      `json:"abandoned_at"`
+}
+
+// cartTTL reads how long a cart lives without any changes from CART_TTL
+func cartTTL() (time.Duration, error) {
+	ttl, err := time.ParseDuration(service.Env("CART_TTL", "72h"))
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("CART_TTL has to be a positive duration")
+	}
+
+	return ttl, nil
+}
+
+// sweepCarts periodically records the carts which weren't changed for ttl as
+// abandoned and empties them
+func sweepCarts(store CartStore, ttl time.Duration) {
+	for {
+		idleBefore := time.Now().Add(-ttl)
+		userIDs, err := store.IdleCarts(idleBefore, cartSweepBatch)
+		if err != nil {
+			log.Printf("ERROR: failed to list idle carts: %v\n", err)
+		}
+
+		for _, userID := range userIDs {
+			cart, err := store.AbandonCart(userID, idleBefore)
+			if err != nil {
+				log.Printf("ERROR: failed to abandon cart of '%s': %v\n", userID, err)
+				continue
+			}
+
+			if cart != nil {
+				log.Printf("cart of '%s' abandoned with %d items\n", userID, len(cart.Items))
+			}
+		}
+
+		// A full batch means there may be more idle carts waiting
+		if err != nil || len(userIDs) < cartSweepBatch {
+			time.Sleep(cartSweepInterval)
+		}
+	}
+}
+
+// abandonedCartsHandler lists the abandoned carts, the most recently abandoned
+// first
+func abandonedCartsHandler(store CartStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	limit := defaultAbandonedLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxAbandonedLimit {
+			service.WriteError(w, service.BadRequest(fmt.Sprintf("limit has to be between 1 and %d", maxAbandonedLimit)))
+			return
+		}
+	}
+
+	carts, err := store.AbandonedCarts(limit)
+	if err != nil {
+		log.Printf("ERROR: failed to list abandoned carts: %v\n", err)
+		service.WriteError(w, err)
+		return
+	}
+
+	if carts == nil {
+		carts = []abandonedCart{}
+	}
+
+	if err := service.WriteJSON(w, http.StatusOK, carts); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
+	}
+}
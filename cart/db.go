@@ -1,16 +1,25 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/client/products"
 )
 
 func dbCartGetItems(db redis.Conn, userID string) ([]cartItem, error) {
 	cartKey := fmt.Sprintf("cart:%s", userID)
 	itemQuantity := fmt.Sprintf("%s:*->quantity", cartKey)
+	itemPrice := fmt.Sprintf("%s:*->price", cartKey)
+	itemCurrency := fmt.Sprintf("%s:*->currency", cartKey)
 
-	res, err := db.Do("SORT", cartKey, "BY", "nosort", "GET", "#", "GET", itemQuantity)
+	res, err := db.Do("SORT", cartKey, "BY", "nosort", "GET", "#", "GET", itemQuantity, "GET", itemPrice, "GET", itemCurrency)
 	values, err := redis.Values(res, err)
 	if err != nil {
 		return nil, err
@@ -24,23 +33,71 @@ func dbCartGetItems(db redis.Conn, userID string) ([]cartItem, error) {
 	return items, nil
 }
 
-func dbCartAddItem(db redis.Conn, userID, productID string, quantity int) error {
+// dbCartAddItem adds to the item unless it would go over maxItemQuantity. The
+// item is watched so the check and the increment happen on the same quantity.
+func dbCartAddItem(db redis.Conn, userID string, product *products.Product, quantity int, ttl time.Duration) error {
 	cartKey := fmt.Sprintf("cart:%s", userID)
-	_, err := db.Do("SADD", cartKey, productID)
+	itemKey := fmt.Sprintf("%s:%s", cartKey, product.Id)
+	for {
+		if _, err := db.Do("WATCH", cartKey, itemKey); err != nil {
+			return err
+		}
+
+		current, err := redis.Int(db.Do("HGET", itemKey, "quantity"))
+		if err != nil && err != redis.ErrNil {
+			db.Do("UNWATCH")
+			return err
+		}
+		if current+quantity > maxItemQuantity {
+			db.Do("UNWATCH")
+			return ErrTooMany
+		}
+
+		productIDs, err := redis.Strings(db.Do("SMEMBERS", cartKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return err
+		}
+
+		db.Send("MULTI")
+		db.Send("SADD", cartKey, product.Id)
+		db.Send("HSETNX", itemKey, "price", product.Price)
+		db.Send("HSETNX", itemKey, "currency", product.Currency)
+		db.Send("HINCRBY", itemKey, "quantity", quantity)
+		sendTouchCart(db, userID, append(productIDs, product.Id), ttl)
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			return nil
+		}
+	}
+}
+
+func dbCartDeleteItem(db redis.Conn, userID, productID string, quantity int, ttl time.Duration) error {
+	cartKey := fmt.Sprintf("cart:%s", userID)
+	itemKey := fmt.Sprintf("%s:%s", cartKey, productID)
+
+	productIDs, err := redis.Strings(db.Do("SMEMBERS", cartKey))
 	if err != nil {
 		return err
 	}
+	if !contains(productIDs, productID) {
+		return redis.ErrNil
+	}
 
-	itemKey := fmt.Sprintf("%s:%s", cartKey, productID)
-	_, err = db.Do("HINCRBY", itemKey, "quantity", quantity)
-	return err
-}
+	db.Send("MULTI")
+	db.Send("HINCRBY", itemKey, "quantity", -quantity)
+	sendTouchCart(db, userID, productIDs, ttl)
 
-func dbCartDeleteItem(db redis.Conn, userID, productID string, quantity int) error {
-	cartKey := fmt.Sprintf("cart:%s", userID)
-	itemKey := fmt.Sprintf("%s:%s", productID)
+	values, err := redis.Values(db.Do("EXEC"))
+	if err != nil {
+		return err
+	}
 
-	newQuantity, err := redis.Int(db.Do("HINCRBY", itemKey, "quantity", -quantity))
+	newQuantity, err := redis.Int(values[0], nil)
 	if err != nil {
 		return err
 	}
@@ -59,23 +116,517 @@ func dbCartDeleteItem(db redis.Conn, userID, productID string, quantity int) err
 	return nil
 }
 
-func dbRemoveCartItems(db redis.Conn, userID string, cartItems []cartItem) error {
-	var productIds []string
-	for _, item := range cartItems {
-		productIds = append(productIds, item.ProductID)
+func dbCartSetItem(db redis.Conn, userID string, product *products.Product, quantity int, ttl time.Duration) error {
+	cartKey := fmt.Sprintf("cart:%s", userID)
+	productIDs, err := redis.Strings(db.Do("SMEMBERS", cartKey))
+	if err != nil {
+		return err
+	}
+
+	itemKey := fmt.Sprintf("%s:%s", cartKey, product.Id)
+	db.Send("MULTI")
+	if quantity == 0 {
+		db.Send("SREM", cartKey, product.Id)
+		db.Send("DEL", itemKey)
+	} else {
+		db.Send("SADD", cartKey, product.Id)
+		db.Send("HSETNX", itemKey, "price", product.Price)
+		db.Send("HSETNX", itemKey, "currency", product.Currency)
+		db.Send("HSET", itemKey, "quantity", quantity)
+		productIDs = append(productIDs, product.Id)
+	}
+	sendTouchCart(db, userID, productIDs, ttl)
+
+	_, err = db.Do("EXEC")
+	return err
+}
+
+// sendTouchCart queues the commands recording a change of the cart, it has to
+// be sent in the transaction of the change. The keys of the cart are kept for
+// the ttl and the grace after it, so the sweeper gets to record the cart as
+// abandoned before they expire.
+func sendTouchCart(db redis.Conn, userID string, productIDs []string, ttl time.Duration) {
+	expiry := (ttl + cartExpiryGrace).Milliseconds()
+
+	db.Send("ZADD", "carts:activity", time.Now().UnixNano(), userID)
+	db.Send("PEXPIRE", fmt.Sprintf("cart:%s", userID), expiry)
+	for _, productID := range productIDs {
+		db.Send("PEXPIRE", fmt.Sprintf("cart:%s:%s", userID, productID), expiry)
+	}
+}
+
+const trackBatch = 100
+
+// dbTrackCarts starts tracking the carts stored before carts expired, they have
+// no activity and their keys never expire. Their last activity is taken to be
+// now, so they are swept once they are left alone for the TTL from here on.
+// Carts which are tracked already are left alone, so it is safe to run at any
+// time.
+func dbTrackCarts(db redis.Conn, ttl time.Duration) (int, error) {
+	count := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(db.Do("SCAN", cursor, "MATCH", "cart:*", "COUNT", trackBatch))
+		if err != nil {
+			return count, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			// the items of the carts are matched as well
+			keyType, err := redis.String(db.Do("TYPE", key))
+			if err != nil {
+				return count, err
+			}
+			if keyType != "set" {
+				continue
+			}
+
+			tracked, err := dbTrackCart(db, strings.TrimPrefix(key, "cart:"), ttl)
+			if err != nil {
+				return count, err
+			}
+			if tracked {
+				count++
+			}
+		}
+
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// dbTrackCart records activity of the cart unless it has some, it reports
+// whether it did
+func dbTrackCart(db redis.Conn, userID string, ttl time.Duration) (bool, error) {
+	cartKey := fmt.Sprintf("cart:%s", userID)
+	for {
+		if _, err := db.Do("WATCH", cartKey); err != nil {
+			return false, err
+		}
+
+		_, err := redis.Int64(db.Do("ZSCORE", "carts:activity", userID))
+		if err != redis.ErrNil {
+			db.Do("UNWATCH")
+			return false, err
+		}
+
+		productIDs, err := redis.Strings(db.Do("SMEMBERS", cartKey))
+		if err != nil || len(productIDs) == 0 {
+			db.Do("UNWATCH")
+			return false, err
+		}
+
+		db.Send("MULTI")
+		sendTouchCart(db, userID, productIDs, ttl)
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return false, err
+		}
+		if val != nil {
+			return true, nil
+		}
 	}
+}
 
+func dbIdleCarts(db redis.Conn, idleBefore time.Time, limit int) ([]string, error) {
+	return redis.Strings(db.Do("ZRANGEBYSCORE", "carts:activity", "-inf", idleBefore.UnixNano(), "LIMIT", 0, limit))
+}
+
+// dbAbandonCart records the cart of the user as abandoned and empties it, if it
+// wasn't changed since idleBefore. It returns nil when the cart was changed or
+// was empty. Changes to the cart modify either the set of the cart or one of
+// its items, so watching them is enough to not lose a change made meanwhile.
+func dbAbandonCart(db redis.Conn, userID string, idleBefore time.Time) (*abandonedCart, error) {
 	cartKey := fmt.Sprintf("cart:%s", userID)
-	_, err := db.Do("SREM", redis.Args{}.Add(cartKey).AddFlat(&productIds))
+	for {
+		if _, err := db.Do("WATCH", cartKey); err != nil {
+			return nil, err
+		}
+
+		productIDs, err := redis.Strings(db.Do("SMEMBERS", cartKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		keys := []string{cartKey}
+		for _, productID := range productIDs {
+			keys = append(keys, fmt.Sprintf("%s:%s", cartKey, productID))
+		}
+		if len(keys) > 1 {
+			if _, err := db.Do("WATCH", redis.Args{}.AddFlat(keys[1:])...); err != nil {
+				db.Do("UNWATCH")
+				return nil, err
+			}
+		}
+
+		lastActivity, err := redis.Int64(db.Do("ZSCORE", "carts:activity", userID))
+		if err != nil || lastActivity > idleBefore.UnixNano() {
+			db.Do("UNWATCH")
+			return nil, notIdle(err)
+		}
+
+		items, err := dbCartGetItems(db, userID)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		var cart *abandonedCart
+		now := time.Now()
+		db.Send("MULTI")
+		db.Send("ZREM", "carts:activity", userID)
+		// nobody can be reached about the carts of guests
+		if len(items) > 0 && !isGuestCart(userID) {
+			cart = &abandonedCart{
+				Id:           fmt.Sprintf("%s:%d", userID, lastActivity),
+				UserID:       userID,
+				Items:        items,
+				LastActivity: lastActivity,
+				AbandonedAt:  now.UnixNano(),
+			}
+
+			cartBytes, err := json.Marshal(cart)
+			if err != nil {
+				db.Do("DISCARD")
+				return nil, err
+			}
+
+			db.Send("SET", fmt.Sprintf("carts:abandoned:%s", cart.Id), cartBytes, "PX", abandonedCartRetention.Milliseconds())
+			db.Send("ZADD", "carts:abandoned", cart.AbandonedAt, cart.Id)
+		}
+		db.Send("ZREMRANGEBYSCORE", "carts:abandoned", "-inf", now.Add(-abandonedCartRetention).UnixNano())
+		db.Send("DEL", redis.Args{}.AddFlat(keys)...)
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			return cart, nil
+		}
+	}
+}
+
+// dbMergeCart merges the cart of the guest into the cart of the user and drops
+// it. The price of a product which is in both carts is the one the user got.
+func dbMergeCart(db redis.Conn, userID, guestID string, policy mergePolicy, ttl time.Duration) ([]cartItem, error) {
+	userKey := fmt.Sprintf("cart:%s", userID)
+	guestKey := fmt.Sprintf("cart:%s", guestID)
+	for {
+		if _, err := db.Do("WATCH", userKey, guestKey); err != nil {
+			return nil, err
+		}
+
+		userProductIDs, err := redis.Strings(db.Do("SMEMBERS", userKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+		guestProductIDs, err := redis.Strings(db.Do("SMEMBERS", guestKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		var itemKeys []string
+		for _, productID := range userProductIDs {
+			itemKeys = append(itemKeys, fmt.Sprintf("%s:%s", userKey, productID))
+		}
+		for _, productID := range guestProductIDs {
+			itemKeys = append(itemKeys, fmt.Sprintf("%s:%s", guestKey, productID))
+		}
+		if len(itemKeys) > 0 {
+			if _, err := db.Do("WATCH", redis.Args{}.AddFlat(itemKeys)...); err != nil {
+				db.Do("UNWATCH")
+				return nil, err
+			}
+		}
+
+		userItems, err := dbCartGetItems(db, userID)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+		guestItems, err := dbCartGetItems(db, guestID)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		if len(guestItems) == 0 {
+			db.Do("UNWATCH")
+			return sortedItems(userItems), nil
+		}
+
+		merged := make(map[string]cartItem, len(userItems)+len(guestItems))
+		for _, item := range userItems {
+			merged[item.ProductID] = item
+		}
+
+		db.Send("MULTI")
+		for _, guestItem := range guestItems {
+			itemKey := fmt.Sprintf("%s:%s", userKey, guestItem.ProductID)
+			item, ok := merged[guestItem.ProductID]
+			if !ok {
+				item = guestItem
+				item.Quantity = capQuantity(item.Quantity)
+				db.Send("SADD", userKey, item.ProductID)
+				db.Send("HSET", itemKey, "price", item.UnitPrice, "currency", item.Currency, "quantity", item.Quantity)
+				merged[item.ProductID] = item
+				continue
+			}
+
+			item.Quantity = policy.quantity(item.Quantity, guestItem.Quantity)
+			db.Send("HSET", itemKey, "quantity", item.Quantity)
+			merged[item.ProductID] = item
+		}
+
+		var productIDs []string
+		var items []cartItem
+		for productID, item := range merged {
+			productIDs = append(productIDs, productID)
+			items = append(items, item)
+		}
+		sendTouchCart(db, userID, productIDs, ttl)
+
+		guestKeys := []string{guestKey}
+		for _, productID := range guestProductIDs {
+			guestKeys = append(guestKeys, fmt.Sprintf("%s:%s", guestKey, productID))
+		}
+		db.Send("DEL", redis.Args{}.AddFlat(guestKeys)...)
+		db.Send("ZREM", "carts:activity", guestID)
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			return sortedItems(items), nil
+		}
+	}
+}
+
+// notIdle returns the error of reading the last activity of a cart which
+// turned out not to be idle, a cart without activity was already swept
+func notIdle(err error) error {
+	if err == redis.ErrNil {
+		return nil
+	}
+
+	return err
+}
+
+func dbAbandonedCarts(db redis.Conn, limit int) ([]abandonedCart, error) {
+	ids, err := redis.Strings(db.Do("ZREVRANGE", "carts:abandoned", 0, limit-1))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	var keys []string
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("carts:abandoned:%s", id))
+	}
+
+	values, err := redis.ByteSlices(db.Do("MGET", redis.Args{}.AddFlat(keys)...))
+	if err != nil {
+		return nil, err
+	}
+
+	var carts []abandonedCart
+	for _, cartBytes := range values {
+		// expired ones are trimmed from the index by the sweeper
+		if cartBytes == nil {
+			continue
+		}
+
+		var cart abandonedCart
+		if err := json.Unmarshal(cartBytes, &cart); err != nil {
+			return nil, err
+		}
+		carts = append(carts, cart)
+	}
+
+	return carts, nil
+}
+
+func sortedItems(items []cartItem) []cartItem {
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+	return items
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dbCompleteCheckout takes the checked out quantities out of the cart and drops
+// the checkout from the log in one transaction. Lines are only dropped once
+// nothing is left of them, so quantities added during the checkout stay in the
+// cart. A checkout which isn't in the log anymore was completed before, it is
+// left alone so a retry doesn't take its quantities twice.
+func dbCompleteCheckout(db redis.Conn, c *checkout) error {
+	cartKey := fmt.Sprintf("cart:%s", c.UserID)
+	checkoutKey := fmt.Sprintf("checkouts:%s", c.Id)
+
+	keys := []string{checkoutKey}
+	for _, item := range c.Items {
+		keys = append(keys, fmt.Sprintf("%s:%s", cartKey, item.ProductID))
+	}
+
+	for {
+		if _, err := db.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+			return err
+		}
+
+		exists, err := redis.Bool(db.Do("EXISTS", checkoutKey))
+		if err != nil || !exists {
+			db.Do("UNWATCH")
+			return err
+		}
+
+		quantities := make([]int, len(c.Items))
+		for i, item := range c.Items {
+			quantities[i], err = redis.Int(db.Do("HGET", keys[i+1], "quantity"))
+			if err != nil && err != redis.ErrNil {
+				db.Do("UNWATCH")
+				return err
+			}
+			quantities[i] -= item.Quantity
+		}
+
+		db.Send("MULTI")
+		for i, item := range c.Items {
+			if quantities[i] <= 0 {
+				db.Send("SREM", cartKey, item.ProductID)
+				db.Send("DEL", keys[i+1])
+				continue
+			}
+
+			db.Send("HSET", keys[i+1], "quantity", quantities[i])
+		}
+		db.Send("ZREM", "checkouts", c.Id)
+		db.Send("DEL", checkoutKey)
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			return nil
+		}
+	}
+}
+
+// dbStartCheckout logs a new checkout unless the user has one in the log.
+// checkouts:user:<id> points to the last checkout of the user, it is left
+// behind when the checkout finishes and is taken over once the checkout it
+// points to is gone.
+func dbStartCheckout(db redis.Conn, userID string, cartItems []cartItem) (*checkout, error) {
+	userKey := fmt.Sprintf("checkouts:user:%s", userID)
+	for {
+		if _, err := db.Do("WATCH", userKey); err != nil {
+			return nil, err
+		}
+
+		lastID, err := redis.String(db.Do("GET", userKey))
+		if err != nil && err != redis.ErrNil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+		if lastID != "" {
+			inProgress, err := redis.Bool(db.Do("EXISTS", fmt.Sprintf("checkouts:%s", lastID)))
+			if err != nil || inProgress {
+				db.Do("UNWATCH")
+				if inProgress {
+					return nil, ErrCheckoutInProgress
+				}
+				return nil, err
+			}
+		}
+
+		now := time.Now().UnixNano()
+		c := checkout{
+			Id:        strconv.FormatInt(now+rand.Int63n(100), 10),
+			UserID:    userID,
+			Status:    checkoutOrdering,
+			Items:     cartItems,
+			UpdatedAt: now,
+		}
+
+		checkoutBytes, err := json.Marshal(c)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		db.Send("MULTI")
+		db.Send("SET", userKey, c.Id)
+		db.Send("SET", fmt.Sprintf("checkouts:%s", c.Id), checkoutBytes)
+		db.Send("ZADD", "checkouts", c.UpdatedAt, c.Id)
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			return &c, nil
+		}
+	}
+}
+
+// dbSaveCheckout persists the checkout log, it has to be called after every step
+// so a crashed checkout can be picked up from where it was left
+func dbSaveCheckout(db redis.Conn, c *checkout) error {
+	c.UpdatedAt = time.Now().UnixNano()
+
+	checkoutBytes, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
 
-	var itemKeys []string
-	for _, item := range cartItems {
-		itemKeys = append(itemKeys, fmt.Sprintf("cart:%s:%s", userID, item.ProductID))
+	checkoutKey := fmt.Sprintf("checkouts:%s", c.Id)
+	if _, err := db.Do("SET", checkoutKey, checkoutBytes); err != nil {
+		return err
+	}
+
+	_, err = db.Do("ZADD", "checkouts", c.UpdatedAt, c.Id)
+	return err
+}
+
+func dbGetCheckout(db redis.Conn, checkoutID string) (*checkout, error) {
+	checkoutKey := fmt.Sprintf("checkouts:%s", checkoutID)
+
+	checkoutBytes, err := redis.Bytes(db.Do("GET", checkoutKey))
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = db.Do("DEL", redis.Args{}.AddFlat(&itemKeys))
+	var c checkout
+	err = json.Unmarshal(checkoutBytes, &c)
+	return &c, err
+}
+
+func dbFinishCheckout(db redis.Conn, checkoutID string) error {
+	if _, err := db.Do("ZREM", "checkouts", checkoutID); err != nil {
+		return err
+	}
+
+	checkoutKey := fmt.Sprintf("checkouts:%s", checkoutID)
+	_, err := db.Do("DEL", checkoutKey)
 	return err
 }
+
+func dbStaleCheckouts(db redis.Conn, updatedBefore time.Time) ([]string, error) {
+	return redis.Strings(db.Do("ZRANGEBYSCORE", "checkouts", "-inf", updatedBefore.UnixNano()))
+}
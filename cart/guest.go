@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// The carts of guests are kept under the token of the cart with this prefix,
+// so the store treats them like the carts of users. User ids can't have it.
+const guestCartPrefix = "guest:"
+
+// Cart tokens are this many random bytes in hex
+const cartTokenSize = 16
+
+// mergePolicy decides the quantity of a product which is both in the cart of
+// the guest and of the user when they are merged
+type mergePolicy string
+
+const (
+	mergeSum      mergePolicy = "sum"
+	mergeMax      mergePolicy = "max"
+	mergeKeepUser mergePolicy = "keep_user"
+)
+
+func parseMergePolicy(name string) (mergePolicy, error) {
+	switch policy := mergePolicy(name); policy {
+	case mergeSum, mergeMax, mergeKeepUser:
+		return policy, nil
+	case "":
+		return mergeSum, nil
+	}
+
+	return "", fmt.Errorf("unknown merge policy '%s'", name)
+}
+
+// quantity returns the quantity of a product after merging the quantity in the
+// cart of the guest into the one in the cart of the user, it is capped like the
+// quantities added to the cart. The cart of the user is taken as it is when the
+// policy keeps it.
+func (p mergePolicy) quantity(user, guest int) int {
+	switch p {
+	case mergeMax:
+		if guest > user {
+			return capQuantity(guest)
+		}
+	case mergeSum:
+		return capQuantity(user + guest)
+	}
+
+	return user
+}
+
+func capQuantity(quantity int) int {
+	if quantity > maxItemQuantity {
+		return maxItemQuantity
+	}
+
+	return quantity
+}
+
+func newCartToken() string {
+	var token [cartTokenSize]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+func validCartToken(token string) bool {
+	_, err := hex.DecodeString(token)
+	return err == nil && len(token) == 2*cartTokenSize
+}
+
+func guestCartID(token string) string {
+	return guestCartPrefix + token
+}
+
+func isGuestCart(cartID string) bool {
+	return strings.HasPrefix(cartID, guestCartPrefix)
+}
+
+// cartOwner returns the id the cart of the request is kept under, which is
+// the user_id for users and the id of the cart_token for guests
+func cartOwner(r *http.Request) (string, error) {
+	userID := r.URL.Query().Get("user_id")
+	token := r.URL.Query().Get("cart_token")
+
+	switch {
+	case userID != "" && token != "":
+		return "", service.BadRequest("only one of user_id and cart_token can be given")
+	case userID != "":
+		if isGuestCart(userID) {
+			return "", service.BadRequest("invalid user_id parameter")
+		}
+		return userID, nil
+	case token != "":
+		if !validCartToken(token) {
+			return "", service.BadRequest("invalid cart_token parameter")
+		}
+		return guestCartID(token), nil
+	}
+
+	return "", service.BadRequest("user_id or cart_token parameter is missing")
+}
+
+// guestHandler issues the token of a new guest cart, the cart itself is
+// created when the first item is added to it
+func guestHandler(store CartStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	if err := service.WriteJSON(w, http.StatusCreated, map[string]string{"cart_token": newCartToken()}); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
+	}
+}
+
+// mergeHandler folds the cart of a guest into the cart of the user who just
+// logged in and drops the cart of the guest
+func mergeHandler(store CartStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	query := r.URL.Query()
+	userID, token := query.Get("user_id"), query.Get("cart_token")
+	if userID == "" {
+		service.WriteError(w, service.BadRequest("user_id parameter is missing"))
+		return
+	}
+	if isGuestCart(userID) {
+		service.WriteError(w, service.BadRequest("invalid user_id parameter"))
+		return
+	}
+	if !validCartToken(token) {
+		service.WriteError(w, service.BadRequest("invalid cart_token parameter"))
+		return
+	}
+
+	policy, err := parseMergePolicy(query.Get("policy"))
+	if err != nil {
+		service.WriteError(w, service.BadRequest(err.Error()))
+		return
+	}
+
+	cartItems, err := store.MergeCart(userID, guestCartID(token), policy)
+	if err != nil {
+		log.Printf("ERROR: failed to merge guest cart into the cart of '%s': %v\n", userID, err)
+		service.WriteError(w, err)
+		return
+	}
+
+	if cartItems == nil {
+		cartItems = []cartItem{}
+	}
+
+	if err := service.WriteJSON(w, http.StatusOK, cartItems); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
+	}
+}
@@ -1,266 +1,475 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/client/orders"
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/client/stock"
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
 )
 
 type cartItem struct {
 	ProductID string `json:"product_id"`
 	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+	Currency  string `json:"currency"`
 }
 
-var redisHost = "localhost:6379"
-var ordersHost = "orders"
+// A cart can hold at most this many of a product
+const maxItemQuantity = 99
+
+type checkoutStatus string
+
+const (
+	checkoutOrdering    checkoutStatus = "ordering"
+	checkoutOrdered     checkoutStatus = "ordered"
+	checkoutRollingBack checkoutStatus = "rolling_back"
+)
+
+// checkout is the compensation log of a single checkout. The placed order is
+// recorded before the cart is cleared, so it can be cancelled if the checkout
+// can't be completed.
+type checkout struct {
+	Id        string         `json:"id"`
+	UserID    string         `json:"user_id"`
+	Status    checkoutStatus `json:"status"`
+	Items     []cartItem     `json:"items"`
+	OrderID   string         `json:"order_id"`
+	UpdatedAt int64          `json:"updated_at"`
+}
+
+// Checkouts which haven't been updated for this long are considered crashed
+const checkoutTimeout = 2 * time.Minute
+
+var ordersClient *orders.Client
+var productsClient *products.Client
+var stockClient *stock.Client
 
 var ErrNotFound = errors.New("not found")
-var ErrServiceInternal = errors.New("service returned error")
+
+// ErrCheckoutInProgress is returned when a checkout is started while the last
+// checkout of the user isn't settled yet
+var ErrCheckoutInProgress = errors.New("checkout in progress")
+
+// ErrTooMany is returned when adding to the cart would take a product over
+// maxItemQuantity
+var ErrTooMany = errors.New("too many of the product")
+
+// errorResponses is how the domain errors, and the ones of the services the
+// cart calls, are reported to clients
+var errorResponses = service.ErrorMap{
+	ErrNotFound:                 {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "product is not in the cart"},
+	ErrTooMany:                  {Status: http.StatusBadRequest, Code: service.CodeInvalidRequest, Message: fmt.Sprintf("cart can't have more than %d of a product", maxItemQuantity)},
+	products.ErrNotFound:        {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "product not found"},
+	orders.ErrNotFound:          {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "product not found"},
+	orders.ErrInsufficientStock: {Status: http.StatusNotAcceptable, Code: service.CodeInsufficientStock, Message: "not enough stock"},
+	orders.ErrConflict:          {Status: http.StatusConflict, Code: service.CodeConflict, Message: "order couldn't be placed, try again"},
+}
 
 func main() {
-	if env := os.Getenv("REDIS_HOST"); env != "" {
-		redisHost = env
-	}
-	if env := os.Getenv("ORDERS_HOST"); env != "" {
-		ordersHost = env
-	}
+	ordersClient = orders.New(service.Env("ORDERS_HOST", "orders"), 0)
+	productsClient = products.New(service.Env("PRODUCTS_HOST", "products"), 0)
+	stockClient = stock.New(service.Env("STOCK_HOST", "stocks"), 0)
 
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisHost) },
+	ttl, err := cartTTL()
+	if err != nil {
+		log.Fatalf("FATAL: %v\n", err)
 	}
 
-	conn := pool.Get()
-	_, err := conn.Do("PING")
-	if err != nil {
-		log.Fatalf("failed to ping redis: %v", err)
+	var store CartStore
+	var idempotency service.IdempotencyStore
+	if service.MemoryStorage() {
+		store = newMemoryStore()
+		idempotency = service.NewMemoryIdempotencyStore()
+	} else {
+		pool := service.NewPool()
+		service.MustPing(pool)
+		redisStore := newRedisStore(pool, ttl)
+		idempotency = service.NewRedisIdempotencyStore(pool, "cart")
+
+		// Carts stored before they expired would never be swept
+		count, err := redisStore.TrackCarts()
+		if err != nil {
+			log.Fatalf("FATAL: failed to track carts: %v\n", err)
+		}
+		log.Printf("started tracking %d carts\n", count)
+
+		store = redisStore
 	}
-	conn.Close()
 
-	http.HandleFunc("/", withDB(pool, dispatchCart))
-	http.HandleFunc("/checkout", withDB(pool, checkoutHandler))
+	go recoverCheckouts(store)
+	go sweepCarts(store, ttl)
+
+	http.HandleFunc("/", service.Chain(service.WithStore(store, dispatchCart), service.WithRequestID))
+	http.HandleFunc("/checkout", service.Chain(service.WithStore(store, checkoutHandler), service.WithRequestID, service.WithIdempotency(idempotency)))
+	http.HandleFunc("/guest", service.Chain(service.WithStore(store, guestHandler), service.WithRequestID))
+	http.HandleFunc("/merge", service.Chain(service.WithStore(store, mergeHandler), service.WithRequestID, service.WithIdempotency(idempotency)))
+	http.HandleFunc("/validate", service.Chain(service.WithStore(store, validateHandler), service.WithRequestID))
+	http.HandleFunc("/abandoned", service.Chain(service.WithStore(store, abandonedCartsHandler), service.WithRequestID))
 	log.Println("listening at http://localhost:8082")
 	http.ListenAndServe(":8082", nil)
 }
 
-func withDB(pool *redis.Pool, handler func(redis.Conn, http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		conn := pool.Get()
-		defer conn.Close()
-		handler(conn, w, r)
-	}
-}
-
-func checkoutHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) {
+func checkoutHandler(store CartStore, w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		w.WriteHeader(http.StatusNotFound)
+		service.WriteError(w, service.BadRequest("user_id parameter is missing"))
+		return
+	}
+	if isGuestCart(userID) {
+		service.WriteError(w, service.BadRequest("invalid user_id parameter"))
+		return
+	}
+
+	cartItems, err := store.CartItems(userID)
+	if err != nil {
+		log.Printf("ERROR: failed to get cart items: %v\n", err)
+		service.WriteError(w, err)
+		return
+	}
+	if len(cartItems) == 0 {
+		service.WriteError(w, service.NewError(http.StatusConflict, service.CodeConflict, "trying to checkout an empty cart"))
+		return
+	}
+
+	c, err := store.StartCheckout(userID, cartItems)
+	if err == ErrCheckoutInProgress {
+		service.WriteError(w, service.NewError(http.StatusConflict, service.CodeConflict, "a checkout of the cart is in progress"))
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to start checkout: %v\n", err)
+		service.WriteError(w, err)
 		return
 	}
 
-	cartItems, err := dbCartGetItems(db, userID)
+	orderID, err := placeOrder(r.Context(), c)
 	if err != nil {
-		if err == redis.ErrNil {
-			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte("trying to checkout an empty cart"))
+		if !orderRejected(err) {
+			// The order may have been placed, the checkout is left in the log
+			// for the recovery to find out and complete or cancel it
+			log.Printf("ERROR: failed to make order of checkout '%s': %v\n", c.Id, err)
+			service.WriteError(w, service.NewError(http.StatusServiceUnavailable, service.CodeInternal, "checkout couldn't be confirmed, it will be completed or cancelled shortly"))
 			return
 		}
+
+		rollbackCheckout(store, c)
+
+		if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+			log.Printf("ERROR: failed to make order: %v\n", err)
+		}
+		return
 	}
 
-	orderIDs := make([]string, 0, len(cartItems))
-	for _, item := range cartItems {
-		orderID, err := makeOrder(userID, item)
-		if err != nil {
-			if err == ErrNotFound {
-				http.NotFound(w, r)
-				return
-			}
+	c.OrderID = orderID
+	c.Status = checkoutOrdered
+	if err := store.SaveCheckout(c); err != nil {
+		rollbackCheckout(store, c)
+
+		log.Printf("ERROR: failed to save checkout '%s': %v\n", c.Id, err)
+		service.WriteError(w, err)
+		return
+	}
+
+	// From here on the orders are final, if clearing the cart fails the
+	// recovery will retry it
+	if err := store.CompleteCheckout(c); err != nil {
+		log.Printf("ERROR: failed to complete checkout '%s': %v\n", c.Id, err)
+	}
+
+	if err := service.WriteJSON(w, http.StatusCreated, map[string]string{"order_id": c.OrderID}); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
+	}
+}
 
-			log.Printf("ERROR: failed to make order: %#v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+// placeOrder orders the items of the checkout. The checkout id is the
+// idempotency key of the order, so placing it again returns the order placed
+// before instead of a new one.
+func placeOrder(ctx context.Context, c *checkout) (string, error) {
+	orderItems := make([]orders.Item, 0, len(c.Items))
+	for _, item := range c.Items {
+		orderItems = append(orderItems, orders.Item{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+
+	return ordersClient.Create(ctx, c.UserID, orderItems, "checkout:"+c.Id)
+}
+
+// orderRejected tells whether the orders service refused to place the order,
+// any other error leaves it unknown whether the order was placed
+func orderRejected(err error) bool {
+	switch err {
+	case orders.ErrNotFound, orders.ErrInsufficientStock, orders.ErrConflict:
+		return true
+	case orders.ErrRequestInProgress:
+		// a request with the same key may still be placing the order
+		return false
+	}
+
+	status := httpclient.StatusCode(err)
+	return status >= 400 && status < 500
+}
+
+// rollbackCheckout cancels the order placed by the checkout, which also puts its
+// items back to the stock. If the order couldn't be cancelled the checkout stays
+// in the log for the recovery to retry. The rollback is recorded before the
+// order is cancelled, otherwise the recovery would complete the checkout with
+// the cancelled order.
+func rollbackCheckout(store CartStore, c *checkout) {
+	c.Status = checkoutRollingBack
+	if err := store.SaveCheckout(c); err != nil {
+		log.Printf("ERROR: failed to save checkout '%s': %v\n", c.Id, err)
+		return
+	}
+
+	if c.OrderID != "" {
+		_, err := ordersClient.Cancel(context.Background(), c.UserID, c.OrderID)
+		if err != nil && err != orders.ErrNotFound {
+			log.Printf("ERROR: failed to cancel order '%s' of checkout '%s': %v\n", c.OrderID, c.Id, err)
 			return
 		}
-
-		orderIDs = append(orderIDs, orderID)
 	}
 
-	dbRemoveCartItems(db, userID, cartItems)
+	if err := store.FinishCheckout(c.Id); err != nil {
+		log.Printf("ERROR: failed to finish checkout '%s': %v\n", c.Id, err)
+	}
+}
 
-	body, err := json.Marshal(orderIDs)
+// resumeOrdering settles a checkout which crashed or failed while its order was
+// being placed. The order is placed again with the same idempotency key, which
+// returns the order if it was placed before. The checkout is completed once the
+// order is known to exist and rolled back once it is known it can't be placed,
+// otherwise it is left for the next round.
+func resumeOrdering(store CartStore, c *checkout) {
+	orderID, err := placeOrder(context.Background(), c)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		if !orderRejected(err) {
+			log.Printf("ERROR: failed to make order of checkout '%s': %v\n", c.Id, err)
+			return
+		}
+
+		log.Printf("rolling back checkout '%s', its order was rejected: %v\n", c.Id, err)
+		rollbackCheckout(store, c)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write(body)
+	c.OrderID = orderID
+	c.Status = checkoutOrdered
+	if err := store.SaveCheckout(c); err != nil {
+		log.Printf("ERROR: failed to save checkout '%s': %v\n", c.Id, err)
+		return
+	}
+
+	if err := store.CompleteCheckout(c); err != nil {
+		log.Printf("ERROR: failed to complete checkout '%s': %v\n", c.Id, err)
+	}
 }
 
-func dispatchCart(db redis.Conn, w http.ResponseWriter, r *http.Request) {
-	var err error
+// recoverCheckouts periodically picks up checkouts which were left behind by a
+// crash. Checkouts which placed their order are completed, the ones placing it
+// find out whether it was placed and the others are rolled back.
+func recoverCheckouts(store CartStore) {
+	for {
+		checkoutIDs, err := store.StaleCheckouts(time.Now().Add(-checkoutTimeout))
+		if err != nil {
+			log.Printf("ERROR: failed to list stale checkouts: %v\n", err)
+		}
+
+		for _, checkoutID := range checkoutIDs {
+			c, err := store.Checkout(checkoutID)
+			if err != nil {
+				if err == ErrNotFound {
+					store.FinishCheckout(checkoutID)
+					continue
+				}
 
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user_id paramter is missing"))
+				log.Printf("ERROR: failed to get checkout '%s': %v\n", checkoutID, err)
+				continue
+			}
+
+			if c.Status == checkoutOrdered {
+				log.Printf("resuming checkout '%s'\n", c.Id)
+				if err := store.CompleteCheckout(c); err != nil {
+					log.Printf("ERROR: failed to complete checkout '%s': %v\n", c.Id, err)
+				}
+				continue
+			}
+
+			if c.Status == checkoutOrdering {
+				log.Printf("resuming ordering of checkout '%s'\n", c.Id)
+				resumeOrdering(store, c)
+				continue
+			}
+
+			log.Printf("rolling back checkout '%s'\n", c.Id)
+			rollbackCheckout(store, c)
+		}
+
+		time.Sleep(checkoutTimeout / 2)
+	}
+}
+
+func dispatchCart(store CartStore, w http.ResponseWriter, r *http.Request) {
+	// guests are handled like users with the id of their cart
+	userID, err := cartOwner(r)
+	if err != nil {
+		service.WriteError(w, err)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		err = listCart(db, userID, w, r)
+		err = listCart(store, userID, w, r)
 	case http.MethodPost:
-		err = addToCart(db, userID, w, r)
+		err = addToCart(store, userID, w, r)
+	case http.MethodPut:
+		err = setCartItem(store, userID, w, r)
 	case http.MethodDelete:
-		err = removeFromCart(db, userID, w, r)
+		err = removeFromCart(store, userID, w, r)
 	default:
-		w.WriteHeader(http.StatusNotFound)
+		service.WriteError(w, service.NotFound("no such endpoint"))
 		return
 	}
 
 	if err != nil {
-		w.WriteHeader(500)
 		log.Printf("ERROR: %v", err)
 		return
 	}
 }
 
-func listCart(db redis.Conn, userID string, w http.ResponseWriter, r *http.Request) error {
-	cartItems, err := dbCartGetItems(db, userID)
+func listCart(store CartStore, userID string, w http.ResponseWriter, r *http.Request) error {
+	cartItems, err := store.CartItems(userID)
 	if err != nil {
-		if err != redis.ErrNil {
-			return err
-		}
-
-		cartItems = []cartItem{}
+		return service.WriteError(w, err)
 	}
 
 	if cartItems == nil {
 		cartItems = []cartItem{}
 	}
 
-	body, err := json.Marshal(cartItems)
-	if err != nil {
-		return err
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
-	return nil
+	return service.WriteJSON(w, http.StatusOK, cartItems)
 }
 
-func addToCart(db redis.Conn, userID string, w http.ResponseWriter, r *http.Request) error {
+func addToCart(store CartStore, userID string, w http.ResponseWriter, r *http.Request) error {
 	var payload cartItem
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid payload"))
-		return nil
+		return service.WriteError(w, service.BadRequest("invalid payload"))
 	}
 
-	if err := dbCartAddItem(db, userID, payload.ProductID, payload.Quantity); err != nil {
-		return err
+	if payload.ProductID == "" {
+		return service.WriteError(w, service.BadRequest("product_id is missing"))
+	}
+	if payload.Quantity <= 0 || payload.Quantity > maxItemQuantity {
+		return service.WriteError(w, service.BadRequest(fmt.Sprintf("quantity has to be between 1 and %d", maxItemQuantity)))
+	}
+
+	// The price is snapshotted when the product is first added to the cart
+	product, err := productsClient.Product(r.Context(), payload.ProductID)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	if err := store.AddItem(userID, product, payload.Quantity); err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
 
 	w.WriteHeader(http.StatusCreated)
 	return nil
 }
 
-func removeFromCart(db redis.Conn, userID string, w http.ResponseWriter, r *http.Request) error {
+func removeFromCart(store CartStore, userID string, w http.ResponseWriter, r *http.Request) error {
 	productID := r.URL.Query().Get("product_id")
 	quantityStr := r.URL.Query().Get("quantity")
 	quantity := 1
 
 	if productID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
 	}
 
 	if quantityStr != "" {
 		var err error
 		quantity, err = strconv.Atoi(quantityStr)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("invalid quantity parameter"))
-			return nil
+		if err != nil || quantity <= 0 {
+			return service.WriteError(w, service.BadRequest("invalid quantity parameter"))
 		}
 	}
 
-	if err := dbCartDeleteItem(db, userID, productID, quantity); err != nil {
-		if err == redis.ErrNil {
-			w.WriteHeader(http.StatusNotFound)
-			return nil
-		}
-
-		return err
+	if err := store.DeleteItem(userID, productID, quantity); err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-type order struct {
-	UserID    string `json:"user_id"`
-	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
-}
-
-func makeOrder(userID string, item cartItem) (string, error) {
-	order := order{
-		UserID:    userID,
-		ProductID: item.ProductID,
-		Quantity:  item.Quantity,
+// setCartItem sets the quantity of a product in the cart, zero removes it. With
+// check_stock=true a quantity above the available stock is refused.
+func setCartItem(store CartStore, userID string, w http.ResponseWriter, r *http.Request) error {
+	var payload cartItem
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
 	}
 
-	reqBody, err := json.Marshal(order)
-	if err != nil {
-		return "", err
+	if payload.ProductID == "" {
+		return service.WriteError(w, service.BadRequest("product_id is missing"))
+	}
+	if payload.Quantity < 0 || payload.Quantity > maxItemQuantity {
+		return service.WriteError(w, service.BadRequest(fmt.Sprintf("quantity has to be between 0 and %d", maxItemQuantity)))
 	}
 
-	reqParams := url.Values{}
-	reqParams.Add("user_id", userID)
-	reqURL := fmt.Sprintf("http://%s?%s", ordersHost, reqParams.Encode())
-	req, err := http.NewRequest(http.MethodPost, reqURL, bytes.NewReader(reqBody))
-	if err != nil {
-		return "", err
+	// Removing doesn't need the product, it may be deleted already
+	if payload.Quantity == 0 {
+		if err := store.SetItem(userID, &products.Product{Id: payload.ProductID}, 0); err != nil {
+			return service.WriteError(w, err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return nil
 	}
 
-	client := http.Client{}
-	res, err := client.Do(req)
+	product, err := productsClient.Product(r.Context(), payload.ProductID)
 	if err != nil {
-		return "", err
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
 
-	if res.StatusCode != http.StatusCreated {
-		if res.StatusCode == http.StatusNotFound {
-			return "", ErrNotFound
+	if r.URL.Query().Get("check_stock") == "true" {
+		available, err := availableStock(r.Context(), payload.ProductID)
+		if err != nil {
+			return service.WriteError(w, err)
 		}
 
-		return "", ErrServiceInternal
+		if int64(payload.Quantity) > available {
+			respErr := service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "not enough stock")
+			return service.WriteError(w, respErr.WithDetails(map[string]int64{"available": available}))
+		}
 	}
 
-	var payload struct {
-		OrderID string `json:"order_id"`
+	if err := store.SetItem(userID, product, payload.Quantity); err != nil {
+		return service.WriteError(w, err)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return "", err
-	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
 
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return "", fmt.Errorf("failed to read order response body: %v\nRESPONSE: %s", err, body)
+// availableStock returns the stock of the product, products without a stock
+// record have none
+func availableStock(ctx context.Context, productID string) (int64, error) {
+	s, err := stockClient.Stock(ctx, productID)
+	if err == stock.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
 
-	return payload.OrderID, nil
+	return s.Available, nil
 }
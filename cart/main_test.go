@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/umurgdk/markeet/client/orders"
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// fakeOrders stands in for the orders service, it answers order creations with
+// err when it is set
+type fakeOrders struct {
+	mu        sync.Mutex
+	err       *service.Error
+	created   map[string]string
+	cancelled []string
+}
+
+func (f *fakeOrders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		if f.err != nil {
+			service.WriteError(w, f.err)
+			return
+		}
+
+		// the same key places a single order like the real service
+		key := r.Header.Get(service.IdempotencyKeyHeader)
+		orderID, ok := f.created[key]
+		if !ok {
+			orderID = "order-" + key
+			f.created[key] = orderID
+		}
+		service.WriteJSON(w, http.StatusCreated, map[string]string{"order_id": orderID})
+	case http.MethodDelete:
+		orderID := r.URL.Query().Get("order_id")
+		f.cancelled = append(f.cancelled, orderID)
+		service.WriteJSON(w, http.StatusOK, orders.Order{Id: orderID, Status: orders.StatusCancelled})
+	default:
+		service.WriteError(w, service.NotFound("no such endpoint"))
+	}
+}
+
+func setupCart(t *testing.T) (*memoryStore, *fakeOrders) {
+	t.Helper()
+
+	productsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "missing" {
+			service.WriteError(w, service.NotFound("product not found"))
+			return
+		}
+		service.WriteJSON(w, http.StatusOK, products.Product{Id: id, Name: id, Price: 250, Currency: "USD"})
+	}))
+	t.Cleanup(productsServer.Close)
+
+	fake := &fakeOrders{created: make(map[string]string)}
+	ordersServer := httptest.NewServer(fake)
+	t.Cleanup(ordersServer.Close)
+
+	productsClient = products.New(productsServer.URL, 0)
+	ordersClient = orders.New(ordersServer.URL, 0)
+
+	return newMemoryStore(), fake
+}
+
+func request(store CartStore, handler func(CartStore, http.ResponseWriter, *http.Request), method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(store, w, r)
+	return w
+}
+
+func addItem(t *testing.T, store CartStore, userID, productID string, quantity int) {
+	t.Helper()
+
+	body, _ := json.Marshal(cartItem{ProductID: productID, Quantity: quantity})
+	if w := request(store, dispatchCart, http.MethodPost, "/?user_id="+userID, string(body)); w.Code != http.StatusCreated {
+		t.Fatalf("adding %s: got status %d: %s", productID, w.Code, w.Body)
+	}
+}
+
+func cartItems(t *testing.T, store CartStore, userID string) []cartItem {
+	t.Helper()
+
+	items, err := store.CartItems(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestAddToCart(t *testing.T) {
+	store, _ := setupCart(t)
+
+	addItem(t, store, "u1", "p1", 2)
+	addItem(t, store, "u1", "p1", 3)
+
+	items := cartItems(t, store, "u1")
+	if len(items) != 1 || items[0].Quantity != 5 || items[0].UnitPrice != 250 {
+		t.Fatalf("got items %+v, want 5 of p1 at 250", items)
+	}
+
+	w := request(store, dispatchCart, http.MethodPost, "/?user_id=u1", `{"product_id":"p1","quantity":95}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("adding over the limit: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = request(store, dispatchCart, http.MethodPost, "/?user_id=u1", `{"product_id":"missing","quantity":1}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("adding a missing product: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+
+	w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var res map[string]string
+	json.NewDecoder(w.Body).Decode(&res)
+	if res["order_id"] == "" || len(fake.created) != 1 {
+		t.Fatalf("got %v with %d orders placed, want one order", res, len(fake.created))
+	}
+
+	if items := cartItems(t, store, "u1"); len(items) != 0 {
+		t.Errorf("cart has %+v after the checkout, want it empty", items)
+	}
+	if checkouts, _ := store.StaleCheckouts(time.Now()); len(checkouts) != 0 {
+		t.Errorf("checkouts %v are left, want none", checkouts)
+	}
+
+	w = request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("checking out an empty cart: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestCheckoutRejected(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+	fake.err = service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "not enough stock")
+
+	w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotAcceptable, w.Body)
+	}
+
+	if items := cartItems(t, store, "u1"); len(items) != 1 {
+		t.Errorf("cart has %+v after the rejected checkout, want it untouched", items)
+	}
+
+	// the rejected checkout is settled, so the cart can be checked out again
+	fake.err = nil
+	if w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", ""); w.Code != http.StatusCreated {
+		t.Errorf("checking out again: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCheckoutConflict(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+	fake.err = service.NewError(http.StatusConflict, service.CodeConflict, "stock reservation expired")
+
+	w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+
+	// no order was placed, the checkout is rolled back and the cart unlocked
+	if checkouts, _ := store.StaleCheckouts(time.Now()); len(checkouts) != 0 {
+		t.Errorf("checkouts %v are left, want none", checkouts)
+	}
+	fake.err = nil
+	if w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", ""); w.Code != http.StatusCreated {
+		t.Errorf("checking out again: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCheckoutOrderInProgress(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+	fake.err = service.NewError(http.StatusConflict, service.CodeRequestInProgress, "a request with the same idempotency key is in progress")
+
+	w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+
+	// the order may still be placed, the checkout waits for the recovery
+	if checkouts, _ := store.StaleCheckouts(time.Now()); len(checkouts) != 1 {
+		t.Errorf("got checkouts %v, want one", checkouts)
+	}
+}
+
+func TestCheckoutUnknownOrder(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+	fake.err = service.NewError(http.StatusInternalServerError, service.CodeInternal, "internal error")
+
+	w := request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+
+	// the order may have been placed, the checkout waits for the recovery
+	w = request(store, checkoutHandler, http.MethodPost, "/checkout?user_id=u1", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("checking out again: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	checkoutIDs, _ := store.StaleCheckouts(time.Now())
+	if len(checkoutIDs) != 1 {
+		t.Fatalf("got checkouts %v, want one", checkoutIDs)
+	}
+	c, err := store.Checkout(checkoutIDs[0])
+	if err != nil || c.Status != checkoutOrdering {
+		t.Fatalf("got checkout %+v, %v, want it ordering", c, err)
+	}
+
+	fake.err = nil
+	resumeOrdering(store, c)
+
+	if items := cartItems(t, store, "u1"); len(items) != 0 {
+		t.Errorf("cart has %+v after the checkout was resumed, want it empty", items)
+	}
+	if _, err := store.Checkout(c.Id); err != ErrNotFound {
+		t.Errorf("checkout is left after it was resumed: %v", err)
+	}
+	if len(fake.created) != 1 || len(fake.cancelled) != 0 {
+		t.Errorf("got %d orders placed and %v cancelled, want one placed", len(fake.created), fake.cancelled)
+	}
+}
+
+func TestRollbackCheckout(t *testing.T) {
+	store, fake := setupCart(t)
+	addItem(t, store, "u1", "p1", 2)
+
+	c, err := store.StartCheckout("u1", cartItems(t, store, "u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OrderID = "o1"
+
+	rollbackCheckout(store, c)
+
+	if len(fake.cancelled) != 1 || fake.cancelled[0] != "o1" {
+		t.Errorf("got cancelled orders %v, want o1", fake.cancelled)
+	}
+	if _, err := store.Checkout(c.Id); err != ErrNotFound {
+		t.Errorf("checkout is left after the rollback: %v", err)
+	}
+	if items := cartItems(t, store, "u1"); len(items) != 1 {
+		t.Errorf("cart has %+v after the rollback, want it untouched", items)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/umurgdk/markeet/client/products"
+)
+
+// memoryStore is a CartStore which keeps everything in memory, it is used for
+// tests and running the service without Redis
+type memoryStore struct {
+	mu        sync.Mutex
+	carts     map[string]map[string]cartItem
+	checkouts map[string]checkout
+	// activity is when the carts were last changed
+	activity  map[string]int64
+	abandoned []abandonedCart
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		carts:     make(map[string]map[string]cartItem),
+		checkouts: make(map[string]checkout),
+		activity:  make(map[string]int64),
+	}
+}
+
+func (s *memoryStore) CartItems(userID string) ([]cartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []cartItem
+	for _, item := range s.carts[userID] {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	return items, nil
+}
+
+func (s *memoryStore) AddItem(userID string, product *products.Product, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.carts[userID] == nil {
+		s.carts[userID] = make(map[string]cartItem)
+	}
+
+	item, ok := s.carts[userID][product.Id]
+	if !ok {
+		item = cartItem{ProductID: product.Id, UnitPrice: product.Price, Currency: product.Currency}
+	}
+
+	if item.Quantity+quantity > maxItemQuantity {
+		return ErrTooMany
+	}
+
+	item.Quantity += quantity
+	s.carts[userID][product.Id] = item
+	s.activity[userID] = time.Now().UnixNano()
+	return nil
+}
+
+func (s *memoryStore) DeleteItem(userID, productID string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.carts[userID][productID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	s.activity[userID] = time.Now().UnixNano()
+	item.Quantity -= quantity
+	if item.Quantity <= 0 {
+		delete(s.carts[userID], productID)
+		return nil
+	}
+
+	s.carts[userID][productID] = item
+	return nil
+}
+
+func (s *memoryStore) SetItem(userID string, product *products.Product, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.activity[userID] = time.Now().UnixNano()
+	if quantity == 0 {
+		delete(s.carts[userID], product.Id)
+		return nil
+	}
+
+	if s.carts[userID] == nil {
+		s.carts[userID] = make(map[string]cartItem)
+	}
+
+	item, ok := s.carts[userID][product.Id]
+	if !ok {
+		item = cartItem{ProductID: product.Id, UnitPrice: product.Price, Currency: product.Currency}
+	}
+
+	item.Quantity = quantity
+	s.carts[userID][product.Id] = item
+	return nil
+}
+
+func (s *memoryStore) MergeCart(userID, guestID string, policy mergePolicy) ([]cartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.carts[guestID]) > 0 {
+		if s.carts[userID] == nil {
+			s.carts[userID] = make(map[string]cartItem)
+		}
+
+		for productID, guestItem := range s.carts[guestID] {
+			item, ok := s.carts[userID][productID]
+			if ok {
+				item.Quantity = policy.quantity(item.Quantity, guestItem.Quantity)
+			} else {
+				item = guestItem
+				item.Quantity = capQuantity(item.Quantity)
+			}
+			s.carts[userID][productID] = item
+		}
+
+		s.activity[userID] = time.Now().UnixNano()
+	}
+	delete(s.carts, guestID)
+	delete(s.activity, guestID)
+
+	var items []cartItem
+	for _, item := range s.carts[userID] {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	return items, nil
+}
+
+func (s *memoryStore) IdleCarts(idleBefore time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userIDs []string
+	for userID, at := range s.activity {
+		if at <= idleBefore.UnixNano() {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return s.activity[userIDs[i]] < s.activity[userIDs[j]] })
+
+	if len(userIDs) > limit {
+		userIDs = userIDs[:limit]
+	}
+
+	return userIDs, nil
+}
+
+func (s *memoryStore) AbandonCart(userID string, idleBefore time.Time) (*abandonedCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastActivity, ok := s.activity[userID]
+	if !ok || lastActivity > idleBefore.UnixNano() {
+		return nil, nil
+	}
+
+	var items []cartItem
+	for _, item := range s.carts[userID] {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	delete(s.activity, userID)
+	delete(s.carts, userID)
+
+	now := time.Now()
+	var kept []abandonedCart
+	for _, cart := range s.abandoned {
+		if cart.AbandonedAt > now.Add(-abandonedCartRetention).UnixNano() {
+			kept = append(kept, cart)
+		}
+	}
+	s.abandoned = kept
+
+	if len(items) == 0 || isGuestCart(userID) {
+		return nil, nil
+	}
+
+	cart := abandonedCart{
+		Id:           fmt.Sprintf("%s:%d", userID, lastActivity),
+		UserID:       userID,
+		Items:        items,
+		LastActivity: lastActivity,
+		AbandonedAt:  now.UnixNano(),
+	}
+	s.abandoned = append(s.abandoned, cart)
+	return &cart, nil
+}
+
+func (s *memoryStore) AbandonedCarts(limit int) ([]abandonedCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var carts []abandonedCart
+	for i := len(s.abandoned) - 1; i >= 0 && len(carts) < limit; i-- {
+		carts = append(carts, s.abandoned[i])
+	}
+
+	return carts, nil
+}
+
+func (s *memoryStore) StartCheckout(userID string, cartItems []cartItem) (*checkout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.checkouts {
+		if c.UserID == userID {
+			return nil, ErrCheckoutInProgress
+		}
+	}
+
+	now := time.Now().UnixNano()
+	c := checkout{
+		Id:        strconv.FormatInt(now+rand.Int63n(100), 10),
+		UserID:    userID,
+		Status:    checkoutOrdering,
+		Items:     cartItems,
+		UpdatedAt: now,
+	}
+	s.checkouts[c.Id] = c
+
+	return &c, nil
+}
+
+func (s *memoryStore) SaveCheckout(c *checkout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.UpdatedAt = time.Now().UnixNano()
+	s.checkouts[c.Id] = *c
+	return nil
+}
+
+func (s *memoryStore) Checkout(checkoutID string) (*checkout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.checkouts[checkoutID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &c, nil
+}
+
+func (s *memoryStore) CompleteCheckout(c *checkout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.checkouts[c.Id]; !ok {
+		return nil
+	}
+
+	for _, checkedOut := range c.Items {
+		item, ok := s.carts[c.UserID][checkedOut.ProductID]
+		if !ok {
+			continue
+		}
+
+		item.Quantity -= checkedOut.Quantity
+		if item.Quantity <= 0 {
+			delete(s.carts[c.UserID], item.ProductID)
+			continue
+		}
+		s.carts[c.UserID][item.ProductID] = item
+	}
+
+	delete(s.checkouts, c.Id)
+	return nil
+}
+
+func (s *memoryStore) FinishCheckout(checkoutID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.checkouts, checkoutID)
+	return nil
+}
+
+func (s *memoryStore) StaleCheckouts(updatedBefore time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var checkoutIDs []string
+	for id, c := range s.checkouts {
+		if c.UpdatedAt <= updatedBefore.UnixNano() {
+			checkoutIDs = append(checkoutIDs, id)
+		}
+	}
+
+	return checkoutIDs, nil
+}
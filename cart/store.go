@@ -0,0 +1,166 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/client/products"
+)
+
+// CartStore keeps the carts of the users and the logs of their checkouts.
+// Methods return ErrNotFound when the cart item or the checkout doesn't exist.
+// The carts of guests are kept like the carts of users under guestCartID.
+type CartStore interface {
+	CartItems(userID string) ([]cartItem, error)
+	// AddItem adds quantity of the product to the cart, the price of the
+	// product is only recorded when it isn't in the cart yet. It returns
+	// ErrTooMany when the cart would have more than maxItemQuantity of it.
+	AddItem(userID string, product *products.Product, quantity int) error
+	// DeleteItem removes quantity of the product from the cart, the item is
+	// dropped once its quantity reaches zero
+	DeleteItem(userID, productID string, quantity int) error
+	// SetItem sets the quantity of the product in the cart, zero drops the
+	// item. The price is recorded like AddItem does.
+	SetItem(userID string, product *products.Product, quantity int) error
+	// MergeCart moves the items of the guest cart into the cart of the user
+	// and returns the merged cart
+	MergeCart(userID, guestID string, policy mergePolicy) ([]cartItem, error)
+
+	// IdleCarts returns up to limit users whose carts weren't changed since
+	// idleBefore
+	IdleCarts(idleBefore time.Time, limit int) ([]string, error)
+	// AbandonCart records the cart of the user as abandoned and empties it if
+	// it still wasn't changed since idleBefore, it returns nil when the cart was
+	// changed meanwhile, was empty or belonged to a guest
+	AbandonCart(userID string, idleBefore time.Time) (*abandonedCart, error)
+	// AbandonedCarts returns up to limit abandoned carts, the most recently
+	// abandoned first
+	AbandonedCarts(limit int) ([]abandonedCart, error)
+
+	// StartCheckout logs a new checkout of the user, it returns
+	// ErrCheckoutInProgress while the last checkout of the user is in the log
+	StartCheckout(userID string, cartItems []cartItem) (*checkout, error)
+	SaveCheckout(c *checkout) error
+	Checkout(checkoutID string) (*checkout, error)
+	// CompleteCheckout takes the checked out quantities out of the cart and
+	// drops the checkout from the log, completing it again does nothing
+	CompleteCheckout(c *checkout) error
+	FinishCheckout(checkoutID string) error
+	StaleCheckouts(updatedBefore time.Time) ([]string, error)
+}
+
+type redisStore struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+func newRedisStore(pool *redis.Pool, ttl time.Duration) *redisStore {
+	return &redisStore{pool, ttl}
+}
+
+// TrackCarts starts tracking the activity and the expiry of the carts stored
+// before carts expired, it returns the number of carts it started tracking
+func (s *redisStore) TrackCarts() (int, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbTrackCarts(db, s.ttl)
+}
+
+func (s *redisStore) CartItems(userID string) ([]cartItem, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	items, err := dbCartGetItems(db, userID)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	return items, err
+}
+
+func (s *redisStore) AddItem(userID string, product *products.Product, quantity int) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbCartAddItem(db, userID, product, quantity, s.ttl)
+}
+
+func (s *redisStore) DeleteItem(userID, productID string, quantity int) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return notFound(dbCartDeleteItem(db, userID, productID, quantity, s.ttl))
+}
+
+func (s *redisStore) SetItem(userID string, product *products.Product, quantity int) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbCartSetItem(db, userID, product, quantity, s.ttl)
+}
+
+func (s *redisStore) MergeCart(userID, guestID string, policy mergePolicy) ([]cartItem, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbMergeCart(db, userID, guestID, policy, s.ttl)
+}
+
+func (s *redisStore) IdleCarts(idleBefore time.Time, limit int) ([]string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbIdleCarts(db, idleBefore, limit)
+}
+
+func (s *redisStore) AbandonCart(userID string, idleBefore time.Time) (*abandonedCart, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbAbandonCart(db, userID, idleBefore)
+}
+
+func (s *redisStore) AbandonedCarts(limit int) ([]abandonedCart, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbAbandonedCarts(db, limit)
+}
+
+func (s *redisStore) StartCheckout(userID string, cartItems []cartItem) (*checkout, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbStartCheckout(db, userID, cartItems)
+}
+
+func (s *redisStore) SaveCheckout(c *checkout) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbSaveCheckout(db, c)
+}
+
+func (s *redisStore) Checkout(checkoutID string) (*checkout, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	c, err := dbGetCheckout(db, checkoutID)
+	return c, notFound(err)
+}
+
+func (s *redisStore) CompleteCheckout(c *checkout) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbCompleteCheckout(db, c)
+}
+
+func (s *redisStore) FinishCheckout(checkoutID string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbFinishCheckout(db, checkoutID)
+}
+
+func (s *redisStore) StaleCheckouts(updatedBefore time.Time) ([]string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbStaleCheckouts(db, updatedBefore)
+}
+
+// notFound translates the missing key error of redigo to ErrNotFound
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// eachStore runs test against the memory store and the Redis at REDIS_HOST, the
+// Redis run is skipped without one. Users get ids of their own in every run so
+// runs don't see each other's carts.
+func eachStore(t *testing.T, test func(t *testing.T, store CartStore, userID string)) {
+	userID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(), userID)
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, newRedisStore(redisPool(t), time.Hour), userID)
+	})
+}
+
+// redisPool returns a pool of the Redis at REDIS_HOST, the test is skipped
+// without one
+func redisPool(t *testing.T) *redis.Pool {
+	t.Helper()
+
+	pool := service.NewPool()
+	t.Cleanup(func() { pool.Close() })
+
+	db := pool.Get()
+	_, err := db.Do("PING")
+	db.Close()
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	return pool
+}
+
+func quantities(t *testing.T, store CartStore, userID string) map[string]int {
+	t.Helper()
+
+	items, err := store.CartItems(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quantities := make(map[string]int)
+	for _, item := range items {
+		quantities[item.ProductID] = item.Quantity
+	}
+	return quantities
+}
+
+func TestCompleteCheckout(t *testing.T) {
+	eachStore(t, func(t *testing.T, store CartStore, userID string) {
+		store.AddItem(userID, &products.Product{Id: "p1"}, 2)
+		store.AddItem(userID, &products.Product{Id: "p2"}, 1)
+
+		c, err := store.StartCheckout(userID, []cartItem{{ProductID: "p1", Quantity: 2}, {ProductID: "p2", Quantity: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// added while the order was being placed
+		store.AddItem(userID, &products.Product{Id: "p1"}, 3)
+		store.AddItem(userID, &products.Product{Id: "p3"}, 1)
+
+		if err := store.CompleteCheckout(c); err != nil {
+			t.Fatal(err)
+		}
+		if got := quantities(t, store, userID); fmt.Sprint(got) != fmt.Sprint(map[string]int{"p1": 3, "p3": 1}) {
+			t.Errorf("got cart %v, want what was added during the checkout", got)
+		}
+		if _, err := store.Checkout(c.Id); err != ErrNotFound {
+			t.Errorf("checkout is left after it was completed: %v", err)
+		}
+
+		// the recovery completing it again doesn't take the quantities twice
+		if err := store.CompleteCheckout(c); err != nil {
+			t.Fatal(err)
+		}
+		if got := quantities(t, store, userID); got["p1"] != 3 {
+			t.Errorf("got cart %v after completing again, want 3 of p1", got)
+		}
+	})
+}
+
+func TestAddItemLimit(t *testing.T) {
+	eachStore(t, func(t *testing.T, store CartStore, userID string) {
+		var wg sync.WaitGroup
+		errs := make([]error, 20)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = store.AddItem(userID, &products.Product{Id: "p1"}, 10)
+			}(i)
+		}
+		wg.Wait()
+
+		added := 0
+		for _, err := range errs {
+			if err == nil {
+				added++
+			} else if err != ErrTooMany {
+				t.Fatal(err)
+			}
+		}
+
+		// concurrent adds can't take the item over the limit together
+		if got := quantities(t, store, userID)["p1"]; added != 9 || got != 90 {
+			t.Errorf("got %d of p1 after %d adds, want 90 after 9", got, added)
+		}
+	})
+}
+
+func TestTrackCarts(t *testing.T) {
+	pool := redisPool(t)
+	store := newRedisStore(pool, time.Hour)
+	db := pool.Get()
+	defer db.Close()
+
+	legacyID := fmt.Sprintf("test-legacy-%d", time.Now().UnixNano())
+	trackedID := fmt.Sprintf("test-tracked-%d", time.Now().UnixNano())
+
+	// a cart stored before carts expired
+	db.Do("SADD", "cart:"+legacyID, "p1")
+	db.Do("HSET", "cart:"+legacyID+":p1", "quantity", 2, "price", 100, "currency", "USD")
+	store.AddItem(trackedID, &products.Product{Id: "p1"}, 1)
+	db.Do("ZADD", "carts:activity", 1, trackedID)
+
+	if _, err := store.TrackCarts(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := redis.Int64(db.Do("ZSCORE", "carts:activity", legacyID)); err != nil {
+		t.Errorf("legacy cart has no activity: %v", err)
+	}
+	for _, key := range []string{"cart:" + legacyID, "cart:" + legacyID + ":p1"} {
+		if ttl, _ := redis.Int64(db.Do("PTTL", key)); ttl <= 0 {
+			t.Errorf("got TTL %d of %s, want it to expire", ttl, key)
+		}
+	}
+
+	if score, _ := redis.Int64(db.Do("ZSCORE", "carts:activity", trackedID)); score != 1 {
+		t.Errorf("got activity %d of the tracked cart, want it left alone", score)
+	}
+
+	db.Do("ZREM", "carts:activity", legacyID, trackedID)
+	db.Do("DEL", "cart:"+legacyID, "cart:"+legacyID+":p1", "cart:"+trackedID, "cart:"+trackedID+":p1")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// Problems of the cart items reported by validation
+const (
+	problemProductDeleted    = "product_deleted"
+	problemInsufficientStock = "insufficient_stock"
+	problemPriceChanged      = "price_changed"
+)
+
+// itemValidation is the report of a cart item. Available is the stock of the
+// product and CurrentPrice its price now, they are left out when the product
+// was deleted.
+type itemValidation struct {
+	cartItem
+	Problems        []string `json:"problems,omitempty"`
+	Available       *int64   `json:"available,omitempty"`
+	CurrentPrice    *int64   `json:"current_price,omitempty"`
+	CurrentCurrency string   `json:"current_currency,omitempty"`
+}
+
+type cartValidation struct {
+	Valid bool             `json:"valid"`
+	Items []itemValidation `json:"items"`
+}
+
+// validateHandler checks the items of the cart against the products and their
+// stock, so problems which would fail the checkout are found before it
+func validateHandler(store CartStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	userID, err := cartOwner(r)
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+
+	cartItems, err := store.CartItems(userID)
+	if err != nil {
+		log.Printf("ERROR: failed to get cart items: %v\n", err)
+		service.WriteError(w, err)
+		return
+	}
+
+	validation, err := validateItems(r.Context(), cartItems)
+	if err != nil {
+		log.Printf("ERROR: failed to validate the cart of '%s': %v\n", userID, err)
+		service.WriteError(w, err)
+		return
+	}
+
+	if err := service.WriteJSON(w, http.StatusOK, validation); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
+	}
+}
+
+func validateItems(ctx context.Context, cartItems []cartItem) (*cartValidation, error) {
+	validation := &cartValidation{Valid: true, Items: []itemValidation{}}
+	if len(cartItems) == 0 {
+		return validation, nil
+	}
+
+	productIDs := make([]string, 0, len(cartItems))
+	for _, item := range cartItems {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	found, _, err := productsClient.Products(ctx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]products.Product, len(found))
+	for _, p := range found {
+		byID[p.Id] = p
+	}
+
+	for _, item := range cartItems {
+		v := itemValidation{cartItem: item}
+
+		product, ok := byID[item.ProductID]
+		if !ok {
+			v.Problems = append(v.Problems, problemProductDeleted)
+			validation.Items = append(validation.Items, v)
+			validation.Valid = false
+			continue
+		}
+
+		v.CurrentPrice, v.CurrentCurrency = &product.Price, product.Currency
+		if product.Price != item.UnitPrice || product.Currency != item.Currency {
+			v.Problems = append(v.Problems, problemPriceChanged)
+		}
+
+		available, err := availableStock(ctx, item.ProductID)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Available = &available
+		if int64(item.Quantity) > available {
+			v.Problems = append(v.Problems, problemInsufficientStock)
+		}
+
+		if len(v.Problems) > 0 {
+			validation.Valid = false
+		}
+		validation.Items = append(validation.Items, v)
+	}
+
+	return validation, nil
+}
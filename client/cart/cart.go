@@ -0,0 +1,224 @@
+// Package cart is the client of the cart service
+package cart
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+var (
+	// ErrNotFound is returned when the product or the cart item doesn't exist
+	ErrNotFound          = errors.New("not found")
+	ErrEmptyCart         = errors.New("cart is empty")
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// Policies deciding the quantity of a product which is both in the guest cart
+// and the cart of the user when they are merged
+const (
+	MergeSum      = "sum"
+	MergeMax      = "max"
+	MergeKeepUser = "keep_user"
+)
+
+type Item struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+	Currency  string `json:"currency"`
+}
+
+// Problems of the cart items reported by Validate
+const (
+	ProblemProductDeleted    = "product_deleted"
+	ProblemInsufficientStock = "insufficient_stock"
+	ProblemPriceChanged      = "price_changed"
+)
+
+// ItemValidation is the report of a cart item. Available and CurrentPrice are
+// nil when the product was deleted.
+type ItemValidation struct {
+	Item
+	Problems        []string `json:"problems"`
+	Available       *int64   `json:"available"`
+	CurrentPrice    *int64   `json:"current_price"`
+	CurrentCurrency string   `json:"current_currency"`
+}
+
+type Validation struct {
+	Valid bool             `json:"valid"`
+	Items []ItemValidation `json:"items"`
+}
+
+type Client struct {
+	c *httpclient.Client
+}
+
+// New creates a client for the cart service at host, a zero timeout uses the
+// default one
+func New(host string, timeout time.Duration) *Client {
+	return &Client{httpclient.New(host, timeout)}
+}
+
+func (c *Client) Items(ctx context.Context, userID string) ([]Item, error) {
+	var items []Item
+	if err := c.c.Do(ctx, http.MethodGet, "/", userQuery(userID), nil, &items); err != nil {
+		return nil, mapError(err)
+	}
+
+	return items, nil
+}
+
+func (c *Client) Add(ctx context.Context, userID, productID string, quantity int) error {
+	payload := struct {
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}{productID, quantity}
+
+	return mapError(c.c.Do(ctx, http.MethodPost, "/", userQuery(userID), payload, nil))
+}
+
+func (c *Client) Remove(ctx context.Context, userID, productID string, quantity int) error {
+	query := userQuery(userID)
+	query.Set("product_id", productID)
+	query.Set("quantity", strconv.Itoa(quantity))
+
+	return mapError(c.c.Do(ctx, http.MethodDelete, "/", query, nil, nil))
+}
+
+// Set sets the quantity of the product in the cart, zero removes it. With
+// checkStock a quantity above the available stock fails with
+// ErrInsufficientStock.
+func (c *Client) Set(ctx context.Context, userID, productID string, quantity int, checkStock bool) error {
+	return c.set(ctx, userQuery(userID), productID, quantity, checkStock)
+}
+
+func (c *Client) set(ctx context.Context, query url.Values, productID string, quantity int, checkStock bool) error {
+	payload := struct {
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}{productID, quantity}
+	if checkStock {
+		query.Set("check_stock", "true")
+	}
+
+	return mapError(c.c.Do(ctx, http.MethodPut, "/", query, payload, nil))
+}
+
+// Validate checks the items in the cart against the products and their stock
+func (c *Client) Validate(ctx context.Context, userID string) (*Validation, error) {
+	var v Validation
+	if err := c.c.Do(ctx, http.MethodGet, "/validate", userQuery(userID), nil, &v); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &v, nil
+}
+
+// Checkout orders every item in the cart and returns the order id. Requests
+// with the same non empty idempotency key check out once.
+func (c *Client) Checkout(ctx context.Context, userID, idempotencyKey string) (string, error) {
+	var res struct {
+		OrderID string `json:"order_id"`
+	}
+	header := idempotencyHeader(idempotencyKey)
+	if err := c.c.DoWithHeader(ctx, http.MethodPost, "/checkout", userQuery(userID), header, nil, &res); err != nil {
+		return "", mapError(err)
+	}
+
+	return res.OrderID, nil
+}
+
+// NewGuest returns the token of a new guest cart. Guest carts are used through
+// the Guest methods until they are merged into the cart of a user.
+func (c *Client) NewGuest(ctx context.Context) (string, error) {
+	var res struct {
+		CartToken string `json:"cart_token"`
+	}
+	if err := c.c.Do(ctx, http.MethodPost, "/guest", nil, nil, &res); err != nil {
+		return "", mapError(err)
+	}
+
+	return res.CartToken, nil
+}
+
+func (c *Client) GuestItems(ctx context.Context, token string) ([]Item, error) {
+	var items []Item
+	if err := c.c.Do(ctx, http.MethodGet, "/", guestQuery(token), nil, &items); err != nil {
+		return nil, mapError(err)
+	}
+
+	return items, nil
+}
+
+func (c *Client) GuestAdd(ctx context.Context, token, productID string, quantity int) error {
+	payload := struct {
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}{productID, quantity}
+
+	return mapError(c.c.Do(ctx, http.MethodPost, "/", guestQuery(token), payload, nil))
+}
+
+func (c *Client) GuestRemove(ctx context.Context, token, productID string, quantity int) error {
+	query := guestQuery(token)
+	query.Set("product_id", productID)
+	query.Set("quantity", strconv.Itoa(quantity))
+
+	return mapError(c.c.Do(ctx, http.MethodDelete, "/", query, nil, nil))
+}
+
+func (c *Client) GuestSet(ctx context.Context, token, productID string, quantity int, checkStock bool) error {
+	return c.set(ctx, guestQuery(token), productID, quantity, checkStock)
+}
+
+// Merge moves the items of the guest cart into the cart of the user and
+// returns the merged cart, policy is one of the Merge constants
+func (c *Client) Merge(ctx context.Context, userID, token, policy string) ([]Item, error) {
+	query := userQuery(userID)
+	query.Set("cart_token", token)
+	query.Set("policy", policy)
+
+	var items []Item
+	if err := c.c.Do(ctx, http.MethodPost, "/merge", query, nil, &items); err != nil {
+		return nil, mapError(err)
+	}
+
+	return items, nil
+}
+
+func userQuery(userID string) url.Values {
+	return url.Values{"user_id": []string{userID}}
+}
+
+func guestQuery(token string) url.Values {
+	return url.Values{"cart_token": []string{token}}
+}
+
+func idempotencyHeader(key string) http.Header {
+	if key == "" {
+		return nil
+	}
+
+	return http.Header{service.IdempotencyKeyHeader: []string{key}}
+}
+
+func mapError(err error) error {
+	switch httpclient.Code(err) {
+	case service.CodeNotFound:
+		return ErrNotFound
+	case service.CodeConflict:
+		return ErrEmptyCart
+	case service.CodeInsufficientStock:
+		return ErrInsufficientStock
+	}
+
+	return err
+}
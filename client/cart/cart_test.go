@@ -0,0 +1,77 @@
+package cart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+func TestAdd(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var item Item
+		json.NewDecoder(r.Body).Decode(&item)
+		if r.Method != http.MethodPost || r.URL.Query().Get("user_id") != "u1" || item.Quantity != 2 {
+			t.Errorf("got %s %s with %+v", r.Method, r.URL, item)
+		}
+
+		if item.ProductID != "p1" {
+			service.WriteError(w, service.NotFound("product not found"))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	if err := c.Add(context.Background(), "u1", "p1", 2); err != nil {
+		t.Error(err)
+	}
+	if err := c.Add(context.Background(), "u1", "p2", 2); err != ErrNotFound {
+		t.Errorf("adding a missing product: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	checkouts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkouts++
+		if r.URL.Path != "/checkout" || r.Header.Get(service.IdempotencyKeyHeader) != fmt.Sprintf("k%d", checkouts) {
+			t.Errorf("got %s with headers %v", r.URL, r.Header)
+		}
+
+		if checkouts > 1 {
+			service.WriteError(w, service.NewError(http.StatusConflict, service.CodeConflict, "cart is empty"))
+			return
+		}
+		service.WriteJSON(w, http.StatusCreated, map[string]string{"order_id": "o1"})
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	if orderID, err := c.Checkout(context.Background(), "u1", "k1"); err != nil || orderID != "o1" {
+		t.Errorf("got %q, %v, want o1", orderID, err)
+	}
+	if _, err := c.Checkout(context.Background(), "u1", "k2"); err != ErrEmptyCart {
+		t.Errorf("checking out an empty cart: got %v, want %v", err, ErrEmptyCart)
+	}
+}
+
+func TestSet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != http.MethodPut || query.Get("cart_token") != "g1" || query.Get("check_stock") != "true" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		service.WriteError(w, service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "not enough stock"))
+	}))
+	defer server.Close()
+
+	if err := New(server.URL, 0).GuestSet(context.Background(), "g1", "p1", 5, true); err != ErrInsufficientStock {
+		t.Errorf("got %v, want %v", err, ErrInsufficientStock)
+	}
+}
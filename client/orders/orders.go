@@ -0,0 +1,160 @@
+// Package orders is the client of the orders service
+package orders
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+var (
+	// ErrNotFound is returned when the order or one of the ordered products
+	// doesn't exist
+	ErrNotFound          = errors.New("not found")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrConflict is returned when the order can't move to the requested
+	// status, or when its stock reservation expired before it was stored
+	ErrConflict = errors.New("conflict")
+	// ErrRequestInProgress is returned while a request with the same
+	// idempotency key is still being handled, it may yet succeed
+	ErrRequestInProgress = errors.New("request in progress")
+)
+
+type Status string
+
+const (
+	// StatusBackordered orders wait for the stock of some of their items,
+	// they move to preparing once it arrives
+	StatusBackordered Status = "backordered"
+	StatusPreparing   Status = "preparing"
+	StatusShipped     Status = "shipped"
+	StatusDelivered   Status = "delivered"
+	StatusCancelled   Status = "cancelled"
+)
+
+type Item struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price,omitempty"`
+	// Backorder is the stock reservation of a backordered item
+	Backorder string `json:"backorder,omitempty"`
+	// Locations is how much of the quantity was taken from each stock
+	// location, it is set by the orders service
+	Locations map[string]int64 `json:"locations,omitempty"`
+}
+
+type StatusChange struct {
+	Status Status `json:"status"`
+	At     int64  `json:"at"`
+}
+
+type Order struct {
+	Id        string         `json:"id"`
+	UserID    string         `json:"user_id"`
+	Items     []Item         `json:"items"`
+	Subtotal  int64          `json:"subtotal"`
+	Total     int64          `json:"total"`
+	Currency  string         `json:"currency"`
+	CreatedAt int64          `json:"created_at"`
+	Status    Status         `json:"status"`
+	History   []StatusChange `json:"history"`
+}
+
+type Client struct {
+	c *httpclient.Client
+}
+
+// New creates a client for the orders service at host, a zero timeout uses
+// the default one
+func New(host string, timeout time.Duration) *Client {
+	return &Client{httpclient.New(host, timeout)}
+}
+
+// Create places an order of the items and returns its id, prices are set by
+// the orders service. Requests with the same non empty idempotency key place
+// a single order.
+func (c *Client) Create(ctx context.Context, userID string, items []Item, idempotencyKey string) (string, error) {
+	payload := struct {
+		Items []Item `json:"items"`
+	}{items}
+
+	var res struct {
+		OrderID string `json:"order_id"`
+	}
+	header := idempotencyHeader(idempotencyKey)
+	if err := c.c.DoWithHeader(ctx, http.MethodPost, "/", userQuery(userID), header, payload, &res); err != nil {
+		return "", mapError(err)
+	}
+
+	return res.OrderID, nil
+}
+
+func (c *Client) List(ctx context.Context, userID string) ([]Order, error) {
+	var orders []Order
+	if err := c.c.Do(ctx, http.MethodGet, "/", userQuery(userID), nil, &orders); err != nil {
+		return nil, mapError(err)
+	}
+
+	return orders, nil
+}
+
+// Transition moves the order to the status
+func (c *Client) Transition(ctx context.Context, userID, orderID string, status Status) (*Order, error) {
+	payload := struct {
+		Status Status `json:"status"`
+	}{status}
+
+	var o Order
+	if err := c.c.Do(ctx, http.MethodPatch, "/", orderQuery(userID, orderID), payload, &o); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &o, nil
+}
+
+// Cancel cancels the order and returns its items to the stock, cancelling an
+// already cancelled order succeeds
+func (c *Client) Cancel(ctx context.Context, userID, orderID string) (*Order, error) {
+	var o Order
+	if err := c.c.Do(ctx, http.MethodDelete, "/", orderQuery(userID, orderID), nil, &o); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &o, nil
+}
+
+func userQuery(userID string) url.Values {
+	return url.Values{"user_id": []string{userID}}
+}
+
+func orderQuery(userID, orderID string) url.Values {
+	return url.Values{"user_id": []string{userID}, "order_id": []string{orderID}}
+}
+
+func idempotencyHeader(key string) http.Header {
+	if key == "" {
+		return nil
+	}
+
+	return http.Header{service.IdempotencyKeyHeader: []string{key}}
+}
+
+func mapError(err error) error {
+	switch httpclient.Code(err) {
+	case service.CodeNotFound:
+		return ErrNotFound
+	case service.CodeInsufficientStock:
+		return ErrInsufficientStock
+	case service.CodeConflict:
+		return ErrConflict
+	case service.CodeRequestInProgress:
+		return ErrRequestInProgress
+	}
+
+	return err
+}
@@ -0,0 +1,67 @@
+package orders
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+func TestCreate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Query().Get("user_id") != "u1" || r.Header.Get(service.IdempotencyKeyHeader) != "k" {
+			t.Errorf("got %s %s with headers %v", r.Method, r.URL, r.Header)
+		}
+
+		var payload struct {
+			Items []Item `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if len(payload.Items) != 1 || payload.Items[0].ProductID != "p1" {
+			t.Errorf("got items %+v", payload.Items)
+		}
+		service.WriteJSON(w, http.StatusCreated, map[string]string{"order_id": "o1"})
+	}))
+	defer server.Close()
+
+	orderID, err := New(server.URL, 0).Create(context.Background(), "u1", []Item{{ProductID: "p1", Quantity: 2}}, "k")
+	if err != nil || orderID != "o1" {
+		t.Errorf("got %q, %v, want o1", orderID, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var status int
+	var code string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.WriteError(w, service.NewError(status, code, "failed"))
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	for _, test := range []struct {
+		status int
+		code   string
+		err    error
+	}{
+		{http.StatusNotFound, service.CodeNotFound, ErrNotFound},
+		{http.StatusNotAcceptable, service.CodeInsufficientStock, ErrInsufficientStock},
+		{http.StatusConflict, service.CodeConflict, ErrConflict},
+		{http.StatusConflict, service.CodeRequestInProgress, ErrRequestInProgress},
+	} {
+		status, code = test.status, test.code
+		if _, err := c.Cancel(context.Background(), "u1", "o1"); err != test.err {
+			t.Errorf("got %v for %s, want %v", err, test.code, test.err)
+		}
+	}
+
+	// other errors keep the response
+	status, code = http.StatusInternalServerError, service.CodeInternal
+	if _, err := c.Cancel(context.Background(), "u1", "o1"); httpclient.StatusCode(err) != http.StatusInternalServerError {
+		t.Errorf("got %v, want the 500 response", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package products is the client of the products service
+package products
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+var (
+	ErrNotFound = errors.New("product not found")
+	// ErrVersionMismatch is returned when the product was modified since the
+	// version given to Update
+	ErrVersionMismatch = errors.New("product version mismatch")
+)
+
+// AnyVersion is given to Update to change the product without checking its
+// version
+const AnyVersion int64 = -1
+
+type Product struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+	Category  string `json:"category"`
+	Price     int64  `json:"price"`
+	Currency  string `json:"currency"`
+	Version   int64  `json:"version"`
+}
+
+// ProductUpdate holds the fields to change, nil fields are left as they are
+type ProductUpdate struct {
+	Name     *string `json:"name,omitempty"`
+	Category *string `json:"category,omitempty"`
+	Price    *int64  `json:"price,omitempty"`
+	Currency *string `json:"currency,omitempty"`
+}
+
+// Page is a page of a product listing, NextKey is passed to get the next page
+type Page struct {
+	Products []Product `json:"products"`
+	NextKey  string    `json:"next_key"`
+}
+
+type Category struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type Client struct {
+	c *httpclient.Client
+}
+
+// New creates a client for the products service at host, a zero timeout uses
+// the default one
+func New(host string, timeout time.Duration) *Client {
+	return &Client{httpclient.New(host, timeout)}
+}
+
+func (c *Client) Product(ctx context.Context, productID string) (*Product, error) {
+	var p Product
+	if err := c.c.Do(ctx, http.MethodGet, "/", url.Values{"id": []string{productID}}, nil, &p); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &p, nil
+}
+
+// Products fetches many products at once, ids which don't exist are returned
+// as missing
+func (c *Client) Products(ctx context.Context, productIDs []string) ([]Product, []string, error) {
+	var payload struct {
+		Products []Product `json:"products"`
+		Missing  []string  `json:"missing"`
+	}
+
+	query := url.Values{"ids": []string{strings.Join(productIDs, ",")}}
+	if err := c.c.Do(ctx, http.MethodGet, "/", query, nil, &payload); err != nil {
+		return nil, nil, mapError(err)
+	}
+
+	return payload.Products, payload.Missing, nil
+}
+
+// List returns a page of the products newest first, category and from are
+// optional
+func (c *Client) List(ctx context.Context, category, from string) (*Page, error) {
+	query := url.Values{}
+	if category != "" {
+		query.Set("category", category)
+	}
+	if from != "" {
+		query.Set("from", from)
+	}
+
+	var page Page
+	if err := c.c.Do(ctx, http.MethodGet, "/", query, nil, &page); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &page, nil
+}
+
+// Search returns a page of the products matching the query best first
+func (c *Client) Search(ctx context.Context, query, category, from string) (*Page, error) {
+	params := url.Values{"q": []string{query}}
+	if category != "" {
+		params.Set("category", category)
+	}
+	if from != "" {
+		params.Set("from", from)
+	}
+
+	var page Page
+	if err := c.c.Do(ctx, http.MethodGet, "/search", params, nil, &page); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &page, nil
+}
+
+func (c *Client) Categories(ctx context.Context) ([]Category, error) {
+	var payload struct {
+		Categories []Category `json:"categories"`
+	}
+	if err := c.c.Do(ctx, http.MethodGet, "/categories", nil, nil, &payload); err != nil {
+		return nil, mapError(err)
+	}
+
+	return payload.Categories, nil
+}
+
+// Create creates the product and returns its id
+func (c *Client) Create(ctx context.Context, p Product) (string, error) {
+	var productID string
+	if err := c.c.Do(ctx, http.MethodPost, "/", nil, p, &productID); err != nil {
+		return "", mapError(err)
+	}
+
+	return productID, nil
+}
+
+// Update changes the product if it is still at version, AnyVersion updates
+// whatever version is stored
+func (c *Client) Update(ctx context.Context, productID string, version int64, update ProductUpdate) (*Product, error) {
+	header := http.Header{}
+	if version == AnyVersion {
+		header.Set("If-Match", "*")
+	} else {
+		header.Set("If-Match", fmt.Sprintf(`"%d"`, version))
+	}
+
+	var p Product
+	err := c.c.DoWithHeader(ctx, http.MethodPatch, "/", url.Values{"id": []string{productID}}, header, update, &p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return &p, nil
+}
+
+func (c *Client) Delete(ctx context.Context, productID string) error {
+	return mapError(c.c.Do(ctx, http.MethodDelete, "/", url.Values{"id": []string{productID}}, nil, nil))
+}
+
+func mapError(err error) error {
+	switch httpclient.Code(err) {
+	case service.CodeNotFound:
+		return ErrNotFound
+	case service.CodePreconditionFailed:
+		return ErrVersionMismatch
+	}
+
+	return err
+}
@@ -0,0 +1,52 @@
+package products
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+func TestProduct(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.URL.Query().Get("id"); id != "1" {
+			service.WriteError(w, service.NotFound("product not found"))
+			return
+		}
+		service.WriteJSON(w, http.StatusOK, Product{Id: "1", Price: 250, Currency: "USD"})
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	if p, err := c.Product(context.Background(), "1"); err != nil || p.Price != 250 {
+		t.Errorf("got %+v, %v", p, err)
+	}
+	if _, err := c.Product(context.Background(), "2"); err != ErrNotFound {
+		t.Errorf("getting a missing product: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("If-Match") {
+		case "*", `"2"`:
+			service.WriteJSON(w, http.StatusOK, Product{Id: "1", Version: 3})
+		default:
+			service.WriteError(w, service.NewError(http.StatusPreconditionFailed, service.CodePreconditionFailed, "product was modified"))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	name := "Hat"
+	for _, version := range []int64{2, AnyVersion} {
+		if p, err := c.Update(context.Background(), "1", version, ProductUpdate{Name: &name}); err != nil || p.Version != 3 {
+			t.Errorf("updating version %d: got %+v, %v", version, p, err)
+		}
+	}
+	if _, err := c.Update(context.Background(), "1", 1, ProductUpdate{Name: &name}); err != ErrVersionMismatch {
+		t.Errorf("updating a stale version: got %v, want %v", err, ErrVersionMismatch)
+	}
+}
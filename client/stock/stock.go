@@ -0,0 +1,428 @@
+// Package stock is the client of the stock service
+package stock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/httpclient"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+var (
+	// ErrNotFound is returned when the product has no stock record or the
+	// reservation expired or was already settled
+	ErrNotFound = errors.New("not found")
+	// ErrInsufficientStock is returned when there isn't enough stock to drop
+	// or reserve
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// Strategies picking the locations of drops and reservations
+const (
+	StrategyPriority  = "priority"
+	StrategyMostStock = "most_stock"
+)
+
+// Stock is the stock of a product, Available is the sum of the quantities in
+// the locations. Quantity is the same sum, as the service reported it before
+// it had locations.
+type Stock struct {
+	ProductID string           `json:"product_id"`
+	Quantity  int64            `json:"quantity"`
+	Available int64            `json:"available"`
+	Locations map[string]int64 `json:"locations"`
+}
+
+// Reservation holds stock for its holder until it is committed or released. A
+// backordered reservation waits for the stock of the product, once committed
+// it takes the stock when it arrives and becomes fulfilled.
+type Reservation struct {
+	Id          string           `json:"id"`
+	ProductID   string           `json:"product_id"`
+	Holder      string           `json:"holder"`
+	Reference   string           `json:"reference,omitempty"`
+	Quantity    int64            `json:"quantity"`
+	Locations   map[string]int64 `json:"locations"`
+	ExpiresAt   int64            `json:"expires_at"`
+	Backordered bool             `json:"backordered"`
+	Committed   bool             `json:"committed"`
+	Fulfilled   bool             `json:"fulfilled"`
+}
+
+// Backorder modes of products, both let orders wait for stock
+const (
+	BackorderAllowed  = "backorder"
+	BackorderPreorder = "preorder"
+)
+
+// BackorderPolicy lets a product take reservations beyond its stock while at
+// most Cap units are waiting, an empty Mode doesn't take any. Backordered is
+// the quantity waiting.
+type BackorderPolicy struct {
+	Mode        string `json:"mode"`
+	Cap         int64  `json:"cap"`
+	Backordered int64  `json:"backordered,omitempty"`
+}
+
+// Change describes why the stock of a product is changed, it is recorded in the
+// history of the product. Location is where the stock is put or dropped, drops
+// without one pick the locations with Strategy or the default strategy of the
+// service.
+type Change struct {
+	Location  string `json:"location,omitempty"`
+	Strategy  string `json:"strategy,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	// Requests with the same non empty idempotency key take effect once
+	IdempotencyKey string `json:"-"`
+}
+
+// Movement is an entry of the history of a product's stock, Quantity is the
+// quantity after the change
+type Movement struct {
+	Id        string `json:"id"`
+	ProductID string `json:"product_id"`
+	Location  string `json:"location"`
+	Delta     int64  `json:"delta"`
+	Quantity  int64  `json:"quantity"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	Reference string `json:"reference"`
+	At        int64  `json:"at"`
+}
+
+type HistoryPage struct {
+	Movements []Movement `json:"movements"`
+	NextKey   string     `json:"next_key"`
+}
+
+// Operations of batch lines
+const (
+	OpPut  = "put"
+	OpDrop = "drop"
+)
+
+// BatchLine is a single put or drop of a batch, Location is optional like in
+// Change
+type BatchLine struct {
+	ProductID string `json:"product_id"`
+	Op        string `json:"op"`
+	Quantity  int64  `json:"quantity"`
+	Location  string `json:"location,omitempty"`
+}
+
+// LineError tells why a line of a batch failed, Available is the stock the
+// line could have used
+type LineError struct {
+	Line      int    `json:"line"`
+	ProductID string `json:"product_id"`
+	Message   string `json:"message"`
+	Requested int64  `json:"requested"`
+	Available *int64 `json:"available"`
+}
+
+// BatchError is returned by Batch when some of the lines can't be applied,
+// none of them are applied then. It matches ErrInsufficientStock when the
+// lines failed for the lack of stock.
+type BatchError struct {
+	Lines        []LineError
+	insufficient bool
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d lines of the batch can't be applied", len(e.Lines))
+}
+
+func (e *BatchError) Is(target error) bool {
+	return e.insufficient && target == ErrInsufficientStock
+}
+
+type Client struct {
+	c *httpclient.Client
+}
+
+// New creates a client for the stock service at host, a zero timeout uses
+// the default one
+func New(host string, timeout time.Duration) *Client {
+	return &Client{httpclient.New(host, timeout)}
+}
+
+func (c *Client) Stock(ctx context.Context, productID string) (*Stock, error) {
+	var stock Stock
+	if err := c.c.Do(ctx, http.MethodGet, "/", productQuery(productID), nil, &stock); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &stock, nil
+}
+
+// Drop takes quantity of the product from the stock
+func (c *Client) Drop(ctx context.Context, productID string, quantity int64, change Change) error {
+	header := idempotencyHeader(change.IdempotencyKey)
+	return mapError(c.c.DoWithHeader(ctx, http.MethodPost, "/drop", productQuery(productID), header, quantityPayload{quantity, change}, nil))
+}
+
+// Put adds quantity of the product to the stock
+func (c *Client) Put(ctx context.Context, productID string, quantity int64, change Change) error {
+	header := idempotencyHeader(change.IdempotencyKey)
+	return mapError(c.c.DoWithHeader(ctx, http.MethodPost, "/put", productQuery(productID), header, quantityPayload{quantity, change}, nil))
+}
+
+// Transfer moves quantity of the product from one location to the other
+func (c *Client) Transfer(ctx context.Context, productID, from, to string, quantity int64, change Change) error {
+	payload := struct {
+		quantityPayload
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{quantityPayload{quantity, change}, from, to}
+
+	header := idempotencyHeader(change.IdempotencyKey)
+	return mapError(c.c.DoWithHeader(ctx, http.MethodPost, "/transfer", productQuery(productID), header, payload, nil))
+}
+
+// Batch applies every line or none of them, and returns the change each line
+// made per location. The Location of change is ignored, lines have their own.
+func (c *Client) Batch(ctx context.Context, lines []BatchLine, change Change) ([]map[string]int64, error) {
+	payload := struct {
+		Lines []BatchLine `json:"lines"`
+		Change
+	}{lines, change}
+	payload.Location = ""
+
+	var res struct {
+		Lines []struct {
+			Locations map[string]int64 `json:"locations"`
+		} `json:"lines"`
+	}
+	header := idempotencyHeader(change.IdempotencyKey)
+	if err := c.c.DoWithHeader(ctx, http.MethodPost, "/batch", nil, header, payload, &res); err != nil {
+		if batchErr := batchError(err); batchErr != nil {
+			return nil, batchErr
+		}
+
+		return nil, mapError(err)
+	}
+
+	changes := make([]map[string]int64, len(res.Lines))
+	for i, line := range res.Lines {
+		changes[i] = line.Locations
+	}
+
+	return changes, nil
+}
+
+// batchError returns the *BatchError of a failed batch request, nil if the
+// request didn't fail because of its lines
+func batchError(err error) *BatchError {
+	var statusErr *httpclient.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Body.Details == nil {
+		return nil
+	}
+
+	detailBytes, err := json.Marshal(statusErr.Body.Details)
+	if err != nil {
+		return nil
+	}
+
+	var lines []LineError
+	if err := json.Unmarshal(detailBytes, &lines); err != nil {
+		return nil
+	}
+
+	return &BatchError{lines, statusErr.Body.Code == service.CodeInsufficientStock}
+}
+
+// History returns a page of the stock changes of the product newest first,
+// from is the NextKey of the previous page
+func (c *Client) History(ctx context.Context, productID, from string) (*HistoryPage, error) {
+	query := productQuery(productID)
+	if from != "" {
+		query.Set("from", from)
+	}
+
+	var page HistoryPage
+	if err := c.c.Do(ctx, http.MethodGet, "/history", query, nil, &page); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &page, nil
+}
+
+// Reserve holds quantity of the product for the holder until it is committed,
+// released or ttl passes. A zero ttl uses the default of the service. The
+// reference, like an order id, is recorded in the history with the changes made
+// for the reservation, the reservation id is recorded when it is empty.
+func (c *Client) Reserve(ctx context.Context, productID string, quantity int64, holder, reference string, ttl time.Duration) (*Reservation, error) {
+	return c.reserve(ctx, productID, quantity, holder, reference, ttl, false)
+}
+
+// ReserveOrBackorder is Reserve for products which may take backorders, when
+// there isn't enough stock the reservation is backordered if the product
+// allows it
+func (c *Client) ReserveOrBackorder(ctx context.Context, productID string, quantity int64, holder, reference string, ttl time.Duration) (*Reservation, error) {
+	return c.reserve(ctx, productID, quantity, holder, reference, ttl, true)
+}
+
+func (c *Client) reserve(ctx context.Context, productID string, quantity int64, holder, reference string, ttl time.Duration, backorder bool) (*Reservation, error) {
+	payload := struct {
+		Quantity  int64  `json:"quantity"`
+		Holder    string `json:"holder"`
+		Reference string `json:"reference,omitempty"`
+		TTL       int64  `json:"ttl,omitempty"`
+		Backorder bool   `json:"backorder,omitempty"`
+	}{quantity, holder, reference, int64(ttl / time.Second), backorder}
+
+	var res Reservation
+	if err := c.c.Do(ctx, http.MethodPost, "/reserve", productQuery(productID), payload, &res); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &res, nil
+}
+
+// ReserveLine is a single reservation of ReserveBatch
+type ReserveLine struct {
+	ProductID string `json:"product_id"`
+	Quantity  int64  `json:"quantity"`
+}
+
+// ReserveBatch makes a reservation for every line in one request like Reserve
+// does, either all of them are made or none. The reservations are returned in
+// the order of the lines. When a line can't be reserved for the lack of stock
+// a *BatchError listing it is returned.
+func (c *Client) ReserveBatch(ctx context.Context, lines []ReserveLine, holder, reference string, ttl time.Duration) ([]*Reservation, error) {
+	return c.reserveBatch(ctx, lines, holder, reference, ttl, false)
+}
+
+// ReserveBatchOrBackorder is ReserveBatch with the lines backordered like
+// ReserveOrBackorder does
+func (c *Client) ReserveBatchOrBackorder(ctx context.Context, lines []ReserveLine, holder, reference string, ttl time.Duration) ([]*Reservation, error) {
+	return c.reserveBatch(ctx, lines, holder, reference, ttl, true)
+}
+
+func (c *Client) reserveBatch(ctx context.Context, lines []ReserveLine, holder, reference string, ttl time.Duration, backorder bool) ([]*Reservation, error) {
+	payload := struct {
+		Lines     []ReserveLine `json:"lines"`
+		Holder    string        `json:"holder"`
+		Reference string        `json:"reference,omitempty"`
+		TTL       int64         `json:"ttl,omitempty"`
+		Backorder bool          `json:"backorder,omitempty"`
+	}{lines, holder, reference, int64(ttl / time.Second), backorder}
+
+	var res struct {
+		Reservations []*Reservation `json:"reservations"`
+	}
+	if err := c.c.Do(ctx, http.MethodPost, "/reserve/batch", nil, payload, &res); err != nil {
+		if batchErr := batchError(err); batchErr != nil {
+			return nil, batchErr
+		}
+
+		return nil, mapError(err)
+	}
+
+	return res.Reservations, nil
+}
+
+// Reservation returns a reservation which isn't settled yet or a fulfilled
+// backorder
+func (c *Client) Reservation(ctx context.Context, reservationID string) (*Reservation, error) {
+	var res Reservation
+	if err := c.c.Do(ctx, http.MethodGet, "/reservation", reservationQuery(reservationID), nil, &res); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &res, nil
+}
+
+func (c *Client) Commit(ctx context.Context, reservationID string) error {
+	return mapError(c.c.Do(ctx, http.MethodPost, "/commit", reservationQuery(reservationID), nil, nil))
+}
+
+// CommitBatch commits every reservation or none of them, when one can't be
+// committed the stock of all of them is returned. It fails with ErrNotFound
+// when one of them expired or was already settled.
+func (c *Client) CommitBatch(ctx context.Context, reservationIDs []string) error {
+	payload := struct {
+		ReservationIDs []string `json:"reservation_ids"`
+	}{reservationIDs}
+	return mapError(c.c.Do(ctx, http.MethodPost, "/commit/batch", nil, payload, nil))
+}
+
+func (c *Client) Release(ctx context.Context, reservationID string) error {
+	return mapError(c.c.Do(ctx, http.MethodPost, "/release", reservationQuery(reservationID), nil, nil))
+}
+
+// Threshold returns the total quantity below which the product gets low stock
+// alerts, zero when it has none
+func (c *Client) Threshold(ctx context.Context, productID string) (int64, error) {
+	var out struct {
+		Threshold int64 `json:"threshold"`
+	}
+	if err := c.c.Do(ctx, http.MethodGet, "/threshold", productQuery(productID), nil, &out); err != nil {
+		return 0, mapError(err)
+	}
+
+	return out.Threshold, nil
+}
+
+// SetThreshold sets the threshold of the product's low stock alerts, zero
+// removes it
+func (c *Client) SetThreshold(ctx context.Context, productID string, threshold int64) error {
+	in := struct {
+		Threshold int64 `json:"threshold"`
+	}{threshold}
+	return mapError(c.c.Do(ctx, http.MethodPost, "/threshold", productQuery(productID), in, nil))
+}
+
+func (c *Client) BackorderPolicy(ctx context.Context, productID string) (*BackorderPolicy, error) {
+	var policy BackorderPolicy
+	if err := c.c.Do(ctx, http.MethodGet, "/backorder", productQuery(productID), nil, &policy); err != nil {
+		return nil, mapError(err)
+	}
+
+	return &policy, nil
+}
+
+func (c *Client) SetBackorderPolicy(ctx context.Context, productID string, policy BackorderPolicy) error {
+	policy.Backordered = 0
+	return mapError(c.c.Do(ctx, http.MethodPost, "/backorder", productQuery(productID), policy, nil))
+}
+
+type quantityPayload struct {
+	Quantity int64 `json:"quantity"`
+	Change
+}
+
+func productQuery(productID string) url.Values {
+	return url.Values{"product_id": []string{productID}}
+}
+
+func reservationQuery(reservationID string) url.Values {
+	return url.Values{"reservation_id": []string{reservationID}}
+}
+
+func idempotencyHeader(key string) http.Header {
+	if key == "" {
+		return nil
+	}
+
+	return http.Header{service.IdempotencyKeyHeader: []string{key}}
+}
+
+func mapError(err error) error {
+	switch httpclient.Code(err) {
+	case service.CodeNotFound:
+		return ErrNotFound
+	case service.CodeInsufficientStock:
+		return ErrInsufficientStock
+	}
+
+	return err
+}
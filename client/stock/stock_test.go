@@ -0,0 +1,114 @@
+package stock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+func TestReserve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reserve":
+			var payload map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			if r.URL.Query().Get("product_id") != "p1" || payload["ttl"] != 90.0 {
+				t.Errorf("got %s with %v", r.URL, payload)
+			}
+
+			if payload["quantity"] == 9.0 {
+				service.WriteError(w, service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "insufficient quantity"))
+				return
+			}
+			service.WriteJSON(w, http.StatusCreated, Reservation{Id: "r1", ProductID: "p1", Quantity: 2})
+		default:
+			service.WriteError(w, service.NotFound("reservation not found"))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	res, err := c.Reserve(context.Background(), "p1", 2, "h", "o1", 90*time.Second)
+	if err != nil || res.Id != "r1" || res.Quantity != 2 {
+		t.Errorf("got %+v, %v, want the reservation", res, err)
+	}
+	if _, err := c.Reserve(context.Background(), "p1", 9, "h", "o1", 90*time.Second); err != ErrInsufficientStock {
+		t.Errorf("reserving more than the stock: got %v, want %v", err, ErrInsufficientStock)
+	}
+	if err := c.Commit(context.Background(), "r2"); err != ErrNotFound {
+		t.Errorf("committing a missing reservation: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	var status int
+	var code string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		available := int64(1)
+		lines := []LineError{{Line: 1, ProductID: "p2", Message: "failed", Requested: 3, Available: &available}}
+		service.WriteError(w, service.NewError(status, code, "batch failed").WithDetails(lines))
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	status, code = http.StatusNotAcceptable, service.CodeInsufficientStock
+	_, err := c.Batch(context.Background(), []BatchLine{{ProductID: "p1", Op: OpDrop, Quantity: 1}}, Change{})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Lines) != 1 || *batchErr.Lines[0].Available != 1 {
+		t.Fatalf("got %v, want the failed line", err)
+	}
+	if !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("batch failing for the lack of stock doesn't match %v", ErrInsufficientStock)
+	}
+
+	// invalid lines aren't a lack of stock
+	status, code = http.StatusBadRequest, service.CodeInvalidRequest
+	_, err = c.ReserveBatch(context.Background(), []ReserveLine{{ProductID: "p1", Quantity: 1}}, "h", "o1", 0)
+	if !errors.As(err, &batchErr) || errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("got %v, want a batch error of invalid lines", err)
+	}
+}
+
+func TestReserveBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reserve/batch":
+			var payload struct {
+				Lines     []ReserveLine `json:"lines"`
+				Reference string        `json:"reference"`
+				Backorder bool          `json:"backorder"`
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			if len(payload.Lines) != 2 || payload.Reference != "o1" || !payload.Backorder {
+				t.Errorf("got payload %+v", payload)
+			}
+
+			reservations := []Reservation{}
+			for i, line := range payload.Lines {
+				reservations = append(reservations, Reservation{Id: fmt.Sprintf("r%d", i), ProductID: line.ProductID})
+			}
+			service.WriteJSON(w, http.StatusCreated, map[string]interface{}{"reservations": reservations})
+		case "/commit/batch":
+			service.WriteError(w, service.NotFound("reservation expired or already settled"))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	lines := []ReserveLine{{ProductID: "p1", Quantity: 1}, {ProductID: "p2", Quantity: 2}}
+	reservations, err := c.ReserveBatchOrBackorder(context.Background(), lines, "h", "o1", 0)
+	if err != nil || len(reservations) != 2 || reservations[1].ProductID != "p2" {
+		t.Fatalf("got %+v, %v, want a reservation per line", reservations, err)
+	}
+
+	if err := c.CommitBatch(context.Background(), []string{"r0", "r1"}); err != ErrNotFound {
+		t.Errorf("committing expired reservations: got %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/umurgdk/markeet
+
+go 1.21
+
+require github.com/gomodule/redigo v1.8.9
@@ -8,8 +8,8 @@ STOCK=:8083
 CART=:8082
 ORDERS=:8080
 
-p1_id=$(http post $PRODUCTS name="Logicool mouse" category="oem")
-p2_id=$(http post $PRODUCTS name="Kingston 8GB ram" category="oem")
+p1_id=$(http post $PRODUCTS name="Logicool mouse" category="oem" price:=2499 currency=USD)
+p2_id=$(http post $PRODUCTS name="Kingston 8GB ram" category="oem" price:=3999 currency=USD)
 
 echo "Product 1: ${p1_id}"
 echo "Product 2: ${p2_id}"
@@ -0,0 +1,153 @@
+// Package httpclient holds the request plumbing shared by the service clients
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// DefaultTimeout is used by clients created without a timeout
+const DefaultTimeout = 5 * time.Second
+
+// Error bodies of failed requests are read up to this size
+const maxErrorBody = 4 << 10
+
+// StatusError is returned when a service responds with a non 2xx status, it
+// holds the error body sent by the service
+type StatusError struct {
+	StatusCode int
+	Body       service.Error
+}
+
+func (e *StatusError) Error() string {
+	if e.Body.Message == "" {
+		return fmt.Sprintf("service responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("service responded with %d %s: %s", e.StatusCode, e.Body.Code, e.Body.Message)
+}
+
+// StatusCode returns the response status of a StatusError, zero for any other
+// error
+func StatusCode(err error) int {
+	if err, ok := err.(*StatusError); ok {
+		return err.StatusCode
+	}
+
+	return 0
+}
+
+// Code returns the error code sent by the service with a StatusError, empty for
+// any other error
+func Code(err error) string {
+	if err, ok := err.(*StatusError); ok {
+		return err.Body.Code
+	}
+
+	return ""
+}
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// New creates a client for the service at host, which may omit the scheme
+func New(host string, timeout time.Duration) *Client {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &Client{
+		baseURL: strings.TrimSuffix(host, "/"),
+		http:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Do sends in as the JSON body of the request and decodes the response into
+// out, both may be nil. If out is a *string the response is read as plain
+// text. The response body is always closed.
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	return c.DoWithHeader(ctx, method, path, query, nil, in, out)
+}
+
+// DoWithHeader is Do with additional request headers
+func (c *Client) DoWithHeader(ctx context.Context, method, path string, query url.Values, header http.Header, in, out interface{}) error {
+	reqURL := c.baseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		reqBody, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(reqBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	if id := service.RequestID(ctx); id != "" {
+		req.Header.Set(service.RequestIDHeader, id)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+
+		statusErr := StatusError{StatusCode: res.StatusCode}
+		if err := json.Unmarshal(resBody, &statusErr.Body); err != nil {
+			statusErr.Body.Message = strings.TrimSpace(string(resBody))
+		}
+		return &statusErr
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+
+	if text, ok := out.(*string); ok {
+		resBody, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		*text = string(resBody)
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %v", method, path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/things" || r.URL.Query().Get("id") != "1" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Extra") != "yes" {
+			t.Errorf("got headers %v", r.Header)
+		}
+
+		var in map[string]string
+		json.NewDecoder(r.Body).Decode(&in)
+		service.WriteJSON(w, http.StatusCreated, map[string]string{"echo": in["name"]})
+	}))
+	defer server.Close()
+
+	// the scheme may be left out
+	c := New(strings.TrimPrefix(server.URL, "http://"), 0)
+
+	var out map[string]string
+	header := http.Header{"X-Extra": []string{"yes"}}
+	err := c.DoWithHeader(context.Background(), http.MethodPost, "/things", url.Values{"id": []string{"1"}}, header, map[string]string{"name": "box"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["echo"] != "box" {
+		t.Errorf("got %v, want the name echoed", out)
+	}
+}
+
+func TestDoText(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "" {
+			t.Errorf("got content type %s of a request without a body", r.Header.Get("Content-Type"))
+		}
+		io.WriteString(w, "42")
+	}))
+	defer server.Close()
+
+	var text string
+	if err := New(server.URL, 0).Do(context.Background(), http.MethodGet, "/", nil, nil, &text); err != nil {
+		t.Fatal(err)
+	}
+	if text != "42" {
+		t.Errorf("got %q, want the body as it is", text)
+	}
+}
+
+func TestDoRequestID(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(service.RequestIDHeader))
+	}))
+	defer upstream.Close()
+
+	// the id of the request being handled is passed on to the next service
+	c := New(upstream.URL, 0)
+	handler := service.WithRequestID(func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		if err := c.Do(r.Context(), http.MethodGet, "/", nil, nil, &id); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, id)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(service.RequestIDHeader, "r1")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Body.String() != "r1" {
+		t.Errorf("got request id %q upstream, want r1", w.Body)
+	}
+}
+
+func TestDoStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		service.WriteError(w, service.NotFound("thing not found"))
+	}))
+	defer server.Close()
+	c := New(server.URL, 0)
+
+	err := c.Do(context.Background(), http.MethodGet, "/", nil, nil, nil)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Body.Message != "thing not found" {
+		t.Fatalf("got %v, want the error body of the service", err)
+	}
+	if StatusCode(err) != http.StatusNotFound || Code(err) != service.CodeNotFound {
+		t.Errorf("got %d %s, want %d %s", StatusCode(err), Code(err), http.StatusNotFound, service.CodeNotFound)
+	}
+
+	// bodies which aren't error envelopes are kept as the message
+	err = c.Do(context.Background(), http.MethodGet, "/plain", nil, nil, nil)
+	if StatusCode(err) != http.StatusBadGateway || Code(err) != "" || !strings.Contains(err.Error(), "bad gateway") {
+		t.Errorf("got %v, want a 502 with the body as its message", err)
+	}
+
+	other := errors.New("connection reset")
+	if StatusCode(other) != 0 || Code(other) != "" {
+		t.Errorf("got %d %q for an error which isn't a response", StatusCode(other), Code(other))
+	}
+}
+
+func TestDoTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	err := New(server.URL, 50*time.Millisecond).Do(context.Background(), http.MethodGet, "/", nil, nil, nil)
+	if err == nil || StatusCode(err) != 0 {
+		t.Errorf("got %v, want the request to time out", err)
+	}
+}
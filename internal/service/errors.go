@@ -0,0 +1,105 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Every failed request is answered with an Error as its JSON body. Code is
+// meant for programs and stays the same for a kind of failure, message is
+// meant for humans. Codes and the statuses they are sent with:
+//
+//	invalid_request        400  the request is malformed or fails validation
+//	not_found              404  the resource doesn't exist
+//	insufficient_stock     406  there isn't enough stock to fulfill the request
+//	conflict               409  the resource is in a state which doesn't allow the request
+//	request_in_progress    409  a request with the same idempotency key is still in flight
+//	precondition_failed    412  the resource was modified since the client read it
+//	precondition_required  428  the request has to say which version of the resource it changes
+//	internal               500  anything else, the cause is only logged
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeNotFound             = "not_found"
+	CodeInsufficientStock    = "insufficient_stock"
+	CodeConflict             = "conflict"
+	CodeRequestInProgress    = "request_in_progress"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeInternal             = "internal"
+)
+
+// Error is the body of every failed response
+type Error struct {
+	Status    int         `json:"-"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return NewError(http.StatusBadRequest, CodeInvalidRequest, message)
+}
+
+func NotFound(message string) *Error {
+	return NewError(http.StatusNotFound, CodeNotFound, message)
+}
+
+// WithDetails returns a copy of the error carrying details
+func (e *Error) WithDetails(details interface{}) *Error {
+	copy := *e
+	copy.Details = details
+	return &copy
+}
+
+// ErrorMap maps the domain errors of a service to the status and code they are
+// reported with. The message of an entry may be left empty to report the
+// message of the domain error itself.
+type ErrorMap map[error]Error
+
+// Resolve returns the response error of err if it or any error it wraps is in
+// the map, otherwise err is returned as it is
+func (m ErrorMap) Resolve(err error) error {
+	for domainErr, entry := range m {
+		if !errors.Is(err, domainErr) {
+			continue
+		}
+
+		if entry.Message == "" {
+			entry.Message = err.Error()
+		}
+		return &entry
+	}
+
+	return err
+}
+
+// WriteError writes err as the error body of the response. Errors other than
+// *Error are reported as internal errors without exposing them, and returned
+// so the caller can log them.
+func WriteError(w http.ResponseWriter, err error) error {
+	var respErr *Error
+	if !errors.As(err, &respErr) {
+		respErr = NewError(http.StatusInternalServerError, CodeInternal, "internal error")
+	} else {
+		err = nil
+	}
+
+	body := *respErr
+	body.RequestID = w.Header().Get(RequestIDHeader)
+
+	bytes, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(body.Status)
+	w.Write(bytes)
+	return err
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var errMissing = errors.New("thing is missing")
+var errTaken = errors.New("thing is taken")
+
+var testErrors = ErrorMap{
+	errMissing: {Status: http.StatusNotFound, Code: CodeNotFound},
+	errTaken:   {Status: http.StatusConflict, Code: CodeConflict, Message: "pick another thing"},
+}
+
+func TestErrorMapResolve(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{errMissing, http.StatusNotFound, CodeNotFound, "thing is missing"},
+		{fmt.Errorf("getting thing 1: %w", errMissing), http.StatusNotFound, CodeNotFound, "getting thing 1: thing is missing"},
+		{errTaken, http.StatusConflict, CodeConflict, "pick another thing"},
+	} {
+		var respErr *Error
+		if !errors.As(testErrors.Resolve(test.err), &respErr) {
+			t.Errorf("%v isn't resolved", test.err)
+			continue
+		}
+		if respErr.Status != test.status || respErr.Code != test.code || respErr.Message != test.message {
+			t.Errorf("got %d %s %q for %v, want %d %s %q", respErr.Status, respErr.Code, respErr.Message, test.err, test.status, test.code, test.message)
+		}
+	}
+
+	// the map itself is left as it is
+	if testErrors[errMissing].Message != "" {
+		t.Errorf("resolving changed the entry to %+v", testErrors[errMissing])
+	}
+
+	unknown := errors.New("disk on fire")
+	if err := testErrors.Resolve(unknown); err != unknown {
+		t.Errorf("got %v for an unmapped error, want it returned as it is", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "r1")
+
+	err := WriteError(w, NotFound("thing not found").WithDetails(map[string]string{"id": "1"}))
+	if err != nil {
+		t.Errorf("got %v for a response error, want nil", err)
+	}
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d with content type %s, want a json 404", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&body)
+	want := map[string]interface{}{
+		"code":       CodeNotFound,
+		"message":    "thing not found",
+		"details":    map[string]interface{}{"id": "1"},
+		"request_id": "r1",
+	}
+	if fmt.Sprint(body) != fmt.Sprint(want) {
+		t.Errorf("got body %v, want %v", body, want)
+	}
+}
+
+func TestWriteErrorInternal(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	cause := errors.New("disk on fire")
+	if err := WriteError(w, cause); err != cause {
+		t.Errorf("got %v, want the cause returned to be logged", err)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	var body Error
+	json.NewDecoder(w.Body).Decode(&body)
+	if body.Code != CodeInternal || body.Message != "internal error" {
+		t.Errorf("got body %+v, want an internal error without the cause", body)
+	}
+}
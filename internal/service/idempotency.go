@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyHeader lets clients retry a request without it taking effect
+// twice, the first response is replayed for every request with the same key
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Responses are replayed for this long after the first request
+const IdempotencyTTL = 24 * time.Hour
+
+// A key is held by an in-flight request for at most this long, so a crashed
+// request doesn't lock its key until the TTL passes
+const idempotencyLease = time.Minute
+
+// Duplicates of an in-flight request wait this long for it to finish before
+// they are rejected
+var idempotencyWait = 5 * time.Second
+
+const idempotencyPollInterval = 50 * time.Millisecond
+
+// ErrIdempotencyKeyLost is returned when an in-flight request's lease on its
+// key expired and the key was claimed by another request
+var ErrIdempotencyKeyLost = errors.New("idempotency key lost")
+
+// IdempotencyRecord is what is stored for an idempotency key. Token is set
+// while the first request is in flight, Response once it finished.
+type IdempotencyRecord struct {
+	Token       string          `json:"token,omitempty"`
+	Fingerprint string          `json:"fingerprint"`
+	Response    *StoredResponse `json:"response,omitempty"`
+}
+
+type StoredResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+type IdempotencyStore interface {
+	// Claim stores the record under key unless the key is taken, in which
+	// case the record holding it is returned
+	Claim(key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error)
+	// Complete replaces the in-flight record claimed with token, it fails with
+	// ErrIdempotencyKeyLost if the claim isn't held anymore
+	Complete(key, token string, record *IdempotencyRecord, ttl time.Duration) error
+	// Release deletes the in-flight record claimed with token
+	Release(key, token string) error
+}
+
+// WithIdempotency makes POST requests carrying an Idempotency-Key header take
+// effect once. The first response is stored and replayed for duplicates, a
+// duplicate arriving while the first request is in flight waits for it.
+// Conflicts and server errors aren't stored, they depend on a state which may
+// change, so the request can be retried.
+func WithIdempotency(store IdempotencyStore) Middleware {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" || r.Method != http.MethodPost {
+				handler(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				WriteError(w, BadRequest("failed to read request body"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			key = r.URL.Path + ":" + key
+			record := IdempotencyRecord{
+				Token:       newIdempotencyToken(),
+				Fingerprint: requestFingerprint(r, body),
+			}
+
+			deadline := time.Now().Add(idempotencyWait)
+			for {
+				existing, err := store.Claim(key, &record, idempotencyLease)
+				if err != nil {
+					log.Printf("ERROR: failed to claim idempotency key '%s': %v\n", key, err)
+					WriteError(w, err)
+					return
+				}
+				if existing == nil {
+					break
+				}
+
+				if existing.Fingerprint != record.Fingerprint {
+					WriteError(w, BadRequest("idempotency key was already used for a different request"))
+					return
+				}
+				if existing.Response != nil {
+					replayResponse(w, existing.Response)
+					return
+				}
+				if time.Now().After(deadline) {
+					WriteError(w, NewError(http.StatusConflict, CodeRequestInProgress, "a request with the same idempotency key is in progress"))
+					return
+				}
+
+				time.Sleep(idempotencyPollInterval)
+			}
+
+			recorder := recordingResponseWriter{w: w}
+			handler(&recorder, r)
+			if recorder.status == 0 {
+				recorder.WriteHeader(http.StatusOK)
+			}
+
+			if recorder.status == http.StatusConflict || recorder.status >= http.StatusInternalServerError {
+				if err := store.Release(key, record.Token); err != nil {
+					log.Printf("ERROR: failed to release idempotency key '%s': %v\n", key, err)
+				}
+				return
+			}
+
+			token := record.Token
+			record.Token = ""
+			record.Response = &StoredResponse{recorder.status, recorder.header, recorder.body.Bytes()}
+			if err := store.Complete(key, token, &record, IdempotencyTTL); err != nil {
+				log.Printf("ERROR: failed to store response of idempotency key '%s': %v\n", key, err)
+			}
+		}
+	}
+}
+
+func replayResponse(w http.ResponseWriter, res *StoredResponse) {
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(res.Status)
+	w.Write(res.Body)
+}
+
+// requestFingerprint identifies a request so a key reused for a different one
+// can be told apart from a retry
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func newIdempotencyToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// recordingResponseWriter keeps a copy of the response so it can be replayed
+type recordingResponseWriter struct {
+	w      http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
+	if rw.status != 0 {
+		return
+	}
+
+	rw.status = statusCode
+	rw.header = rw.w.Header().Clone()
+	rw.header.Del(RequestIDHeader)
+	rw.w.WriteHeader(statusCode)
+}
+
+func (rw *recordingResponseWriter) Write(bytes []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	rw.body.Write(bytes)
+	return rw.w.Write(bytes)
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisStore returns a store in the Redis at REDIS_HOST with keys of its own,
+// the test is skipped without Redis
+func redisStore(t *testing.T) IdempotencyStore {
+	t.Helper()
+
+	pool := NewPool()
+	t.Cleanup(func() { pool.Close() })
+
+	conn := pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	serviceName := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	return NewRedisIdempotencyStore(pool, serviceName)
+}
+
+func eachStore(t *testing.T, test func(t *testing.T, store IdempotencyStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryIdempotencyStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, redisStore(t))
+	})
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	eachStore(t, func(t *testing.T, store IdempotencyStore) {
+		first := &IdempotencyRecord{Token: "a", Fingerprint: "f"}
+		if existing, err := store.Claim("k", first, time.Minute); err != nil || existing != nil {
+			t.Fatalf("claiming a free key: got %+v, %v", existing, err)
+		}
+
+		existing, err := store.Claim("k", &IdempotencyRecord{Token: "b", Fingerprint: "f"}, time.Minute)
+		if err != nil || existing == nil || existing.Token != "a" {
+			t.Fatalf("claiming a held key: got %+v, %v, want the first claim", existing, err)
+		}
+
+		if err := store.Release("k", "b"); err != ErrIdempotencyKeyLost {
+			t.Errorf("releasing with another token: got %v, want %v", err, ErrIdempotencyKeyLost)
+		}
+		if err := store.Release("k", "a"); err != nil {
+			t.Fatalf("releasing: %v", err)
+		}
+
+		second := &IdempotencyRecord{Token: "c", Fingerprint: "f"}
+		if existing, err := store.Claim("k", second, time.Minute); err != nil || existing != nil {
+			t.Fatalf("claiming a released key: got %+v, %v", existing, err)
+		}
+
+		done := &IdempotencyRecord{Fingerprint: "f", Response: &StoredResponse{Status: http.StatusCreated, Body: []byte("ok")}}
+		if err := store.Complete("k", "a", done, time.Minute); err != ErrIdempotencyKeyLost {
+			t.Errorf("completing with a lost token: got %v, want %v", err, ErrIdempotencyKeyLost)
+		}
+		if err := store.Complete("k", "c", done, time.Minute); err != nil {
+			t.Fatalf("completing: %v", err)
+		}
+
+		existing, err = store.Claim("k", &IdempotencyRecord{Token: "d", Fingerprint: "f"}, time.Minute)
+		if err != nil || existing == nil || existing.Response == nil || string(existing.Response.Body) != "ok" {
+			t.Fatalf("claiming a completed key: got %+v, %v, want the stored response", existing, err)
+		}
+		if err := store.Release("k", "c"); err != ErrIdempotencyKeyLost {
+			t.Errorf("releasing a completed key: got %v, want %v", err, ErrIdempotencyKeyLost)
+		}
+	})
+}
+
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	eachStore(t, func(t *testing.T, store IdempotencyStore) {
+		store.Claim("k", &IdempotencyRecord{Token: "a"}, 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+
+		// the lease of a crashed request runs out
+		if existing, err := store.Claim("k", &IdempotencyRecord{Token: "b"}, time.Minute); err != nil || existing != nil {
+			t.Errorf("claiming an expired key: got %+v, %v", existing, err)
+		}
+	})
+}
+
+// countingHandler answers with status and counts the requests it handled
+type countingHandler struct {
+	mu     sync.Mutex
+	status int
+	calls  int
+	// wait blocks the handler until it is closed when set
+	wait chan struct{}
+}
+
+func (h *countingHandler) serve(w http.ResponseWriter, r *http.Request) {
+	if h.wait != nil {
+		<-h.wait
+	}
+
+	h.mu.Lock()
+	h.calls++
+	calls := h.calls
+	h.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	w.WriteHeader(h.status)
+	fmt.Fprintf(w, "%d:%s", calls, body)
+}
+
+func (h *countingHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func post(handler http.HandlerFunc, target, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestWithIdempotencyReplay(t *testing.T) {
+	counter := &countingHandler{status: http.StatusCreated}
+	handler := WithIdempotency(NewMemoryIdempotencyStore())(counter.serve)
+
+	first := post(handler, "/orders", "k", "x")
+	second := post(handler, "/orders", "k", "x")
+	if counter.count() != 1 {
+		t.Fatalf("handler ran %d times, want once", counter.count())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("got %d %q for the retry, want the first response %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replayed response isn't marked as replayed")
+	}
+
+	// keys are scoped to the path, and requests without a key always run
+	post(handler, "/checkout", "k", "x")
+	post(handler, "/orders", "", "x")
+	post(handler, "/orders", "", "x")
+	if counter.count() != 4 {
+		t.Errorf("handler ran %d times, want 4", counter.count())
+	}
+}
+
+func TestWithIdempotencyFingerprint(t *testing.T) {
+	counter := &countingHandler{status: http.StatusCreated}
+	handler := WithIdempotency(NewMemoryIdempotencyStore())(counter.serve)
+
+	post(handler, "/orders?user_id=u1", "k", "x")
+
+	if w := post(handler, "/orders?user_id=u2", "k", "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the key with another query: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := post(handler, "/orders?user_id=u1", "k", "y"); w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the key with another body: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if counter.count() != 1 {
+		t.Errorf("handler ran %d times, want once", counter.count())
+	}
+}
+
+func TestWithIdempotencyRetryable(t *testing.T) {
+	for _, status := range []int{http.StatusConflict, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		counter := &countingHandler{status: status}
+		handler := WithIdempotency(NewMemoryIdempotencyStore())(counter.serve)
+
+		post(handler, "/orders", "k", "x")
+		counter.status = http.StatusCreated
+		if w := post(handler, "/orders", "k", "x"); w.Code != http.StatusCreated {
+			t.Errorf("retrying after %d: got status %d, want the request to run again", status, w.Code)
+		}
+	}
+
+	// client errors don't depend on the state, they are replayed
+	counter := &countingHandler{status: http.StatusBadRequest}
+	handler := WithIdempotency(NewMemoryIdempotencyStore())(counter.serve)
+
+	post(handler, "/orders", "k", "x")
+	counter.status = http.StatusCreated
+	if w := post(handler, "/orders", "k", "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("retrying after 400: got status %d, want it replayed", w.Code)
+	}
+}
+
+func TestWithIdempotencyConcurrent(t *testing.T) {
+	counter := &countingHandler{status: http.StatusCreated, wait: make(chan struct{})}
+	handler := WithIdempotency(NewMemoryIdempotencyStore())(counter.serve)
+
+	responses := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = post(handler, "/orders", "k", "x")
+		}(i)
+	}
+
+	// the duplicates wait for the request holding the key
+	time.Sleep(100 * time.Millisecond)
+	close(counter.wait)
+	wg.Wait()
+
+	if counter.count() != 1 {
+		t.Fatalf("handler ran %d times, want once", counter.count())
+	}
+	for _, w := range responses {
+		if w.Code != http.StatusCreated || w.Body.String() != "1:x" {
+			t.Errorf("got %d %q, want every request to get the first response", w.Code, w.Body)
+		}
+	}
+}
+
+func TestWithIdempotencyInProgress(t *testing.T) {
+	defer func(wait time.Duration) { idempotencyWait = wait }(idempotencyWait)
+	idempotencyWait = 100 * time.Millisecond
+
+	store := NewMemoryIdempotencyStore()
+	handler := WithIdempotency(store)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	// a request holding the key for longer than duplicates wait
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("x"))
+	store.Claim("/orders:k", &IdempotencyRecord{Token: "t", Fingerprint: requestFingerprint(r, []byte("x"))}, time.Minute)
+
+	w := post(handler, "/orders", "k", "x")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), CodeRequestInProgress) {
+		t.Errorf("got %d %s, want %d with code %s", w.Code, w.Body, http.StatusConflict, CodeRequestInProgress)
+	}
+}
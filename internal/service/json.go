@@ -0,0 +1,20 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// WriteJSON encodes v as the response body. If v can't be encoded an internal
+// error is written instead and the error is returned.
+func WriteJSON(w http.ResponseWriter, statusCode int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return WriteError(w, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+	return nil
+}
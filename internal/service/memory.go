@@ -0,0 +1,73 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore keeps idempotency records in memory, for services
+// running with STORAGE=memory
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]memoryIdempotencyRecord)}
+}
+
+// get returns the record of the key unless it expired, the caller has to hold
+// the lock
+func (s *memoryIdempotencyStore) get(key string) (IdempotencyRecord, bool) {
+	stored, ok := s.records[key]
+	if !ok {
+		return IdempotencyRecord{}, false
+	}
+	if time.Now().After(stored.expiresAt) {
+		delete(s.records, key)
+		return IdempotencyRecord{}, false
+	}
+
+	return stored.record, true
+}
+
+func (s *memoryIdempotencyStore) Claim(key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.get(key); ok {
+		return &existing, nil
+	}
+
+	s.records[key] = memoryIdempotencyRecord{*record, time.Now().Add(ttl)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(key, token string, record *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.get(key); !ok || existing.Token != token {
+		return ErrIdempotencyKeyLost
+	}
+
+	s.records[key] = memoryIdempotencyRecord{*record, time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.get(key); !ok || existing.Token != token {
+		return ErrIdempotencyKeyLost
+	}
+
+	delete(s.records, key)
+	return nil
+}
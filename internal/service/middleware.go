@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Middleware wraps a handler with additional behaviour
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain wraps handler with the middlewares, the first one is the outermost
+func Chain(handler http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// WithStore passes the storage of the service to the handler
+func WithStore[S any](store S, handler func(S, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(store, w, r)
+	}
+}
+
+// LogErrors adapts handlers which return their errors instead of logging them
+func LogErrors[S any](handler func(S, http.ResponseWriter, *http.Request) error) func(S, http.ResponseWriter, *http.Request) {
+	return func(store S, w http.ResponseWriter, r *http.Request) {
+		if err := handler(store, w, r); err != nil {
+			log.Printf("ERROR: %v\n", err)
+		}
+	}
+}
+
+// RequestIDHeader carries the id of a request between the services and back to
+// the client
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID assigns an id to every request unless the caller already sent
+// one. The id is echoed in the response header and kept in the request context.
+func WithRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// RequestID returns the id of the request the context belongs to, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+type loggingResponseWriter struct {
+	w          http.ResponseWriter
+	StatusCode int
+	Body       []byte
+}
+
+func (l *loggingResponseWriter) Header() http.Header {
+	return l.w.Header()
+}
+
+func (l *loggingResponseWriter) Write(bytes []byte) (int, error) {
+	if l.StatusCode == 0 {
+		l.StatusCode = http.StatusOK
+	}
+
+	l.Body = append(l.Body, bytes...)
+	return l.w.Write(bytes)
+}
+
+func (l *loggingResponseWriter) WriteHeader(statusCode int) {
+	l.StatusCode = statusCode
+	l.w.WriteHeader(statusCode)
+}
+
+// WithLogging logs every request with the response status and body
+func WithLogging(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] %v\n", r.Method, r.URL)
+		writer := loggingResponseWriter{w, 0, nil}
+		handler(&writer, r)
+		log.Printf("-> %d -- %s", writer.StatusCode, string(writer.Body))
+	}
+}
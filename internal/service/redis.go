@@ -0,0 +1,154 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Env returns the environment variable or fallback when it isn't set
+func Env(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// MemoryStorage reports whether the service should keep its data in memory
+// instead of Redis, it is enabled with STORAGE=memory
+func MemoryStorage() bool {
+	return Env("STORAGE", "redis") == "memory"
+}
+
+// NewPool creates the Redis pool of a service, the address is read from
+// REDIS_HOST
+func NewPool() *redis.Pool {
+	redisHost := Env("REDIS_HOST", "localhost:6379")
+
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisHost) },
+	}
+}
+
+// MustPing exits when Redis can't be reached, services call it on start so
+// they don't run without their storage
+func MustPing(pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		log.Fatalf("FATAL: failed to ping redis: %v\n", err)
+	}
+}
+
+type redisIdempotencyStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisIdempotencyStore keeps idempotency records of the service in Redis,
+// the keys are prefixed with the service name
+func NewRedisIdempotencyStore(pool *redis.Pool, serviceName string) IdempotencyStore {
+	return &redisIdempotencyStore{pool, "idempotency:" + serviceName + ":"}
+}
+
+func (s *redisIdempotencyStore) Claim(key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	key = s.prefix + key
+	for {
+		_, err := redis.String(conn.Do("SET", key, recordBytes, "NX", "PX", ttl.Milliseconds()))
+		if err == nil {
+			return nil, nil
+		}
+		if err != redis.ErrNil {
+			return nil, err
+		}
+
+		existingBytes, err := redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			// expired in between, try to claim it again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var existing IdempotencyRecord
+		err = json.Unmarshal(existingBytes, &existing)
+		return &existing, err
+	}
+}
+
+func (s *redisIdempotencyStore) Complete(key, token string, record *IdempotencyRecord, ttl time.Duration) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.replaceClaimed(s.prefix+key, token, func(conn redis.Conn, key string) {
+		conn.Send("SET", key, recordBytes, "PX", ttl.Milliseconds())
+	})
+}
+
+func (s *redisIdempotencyStore) Release(key, token string) error {
+	return s.replaceClaimed(s.prefix+key, token, func(conn redis.Conn, key string) {
+		conn.Send("DEL", key)
+	})
+}
+
+// replaceClaimed queues the commands of update in a transaction which only
+// succeeds if the key is still claimed with token
+func (s *redisIdempotencyStore) replaceClaimed(key, token string, update func(redis.Conn, string)) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+
+		recordBytes, err := redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			conn.Do("UNWATCH")
+			return ErrIdempotencyKeyLost
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		var record IdempotencyRecord
+		if err := json.Unmarshal(recordBytes, &record); err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if record.Token != token {
+			conn.Do("UNWATCH")
+			return ErrIdempotencyKeyLost
+		}
+
+		conn.Send("MULTI")
+		update(conn, key)
+
+		val, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			return nil
+		}
+	}
+}
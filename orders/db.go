@@ -3,9 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
-	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -18,9 +16,19 @@ func dbGetOrder(db redis.Conn, userID, orderID string) (*order, error) {
 		return nil, err
 	}
 
-	var order order
-	err = json.Unmarshal(orderBytes, &order)
-	return &order, err
+	return decodeOrder(orderBytes)
+}
+
+// decodeOrder reads a stored order, upgrading the ones stored by older
+// versions
+func decodeOrder(orderBytes []byte) (*order, error) {
+	var o order
+	if err := json.Unmarshal(orderBytes, &o); err != nil {
+		return nil, err
+	}
+
+	o.upgrade()
+	return &o, nil
 }
 
 func dbGetOrders(db redis.Conn, userID string) ([]order, error) {
@@ -35,22 +43,19 @@ func dbGetOrders(db redis.Conn, userID string) ([]order, error) {
 
 	orders := make([]order, 0, len(byteSlices))
 	for _, orderBytes := range byteSlices {
-		var o order
-		if err := json.Unmarshal(orderBytes, &o); err != nil {
+		o, err := decodeOrder(orderBytes)
+		if err != nil {
 			return nil, err
 		}
 
-		orders = append(orders, o)
+		orders = append(orders, *o)
 	}
 
 	return orders, nil
 }
 
 func dbInsertOrder(db redis.Conn, userID string, order order) (string, error) {
-	now := time.Now().UnixNano()
-	order.Id = strconv.FormatInt(now+rand.Int63n(100), 10)
-	order.CreatedAt = now
-	order.UserID = userID
+	order.init(userID)
 
 	orderListKey := fmt.Sprintf("orders:%s", userID)
 	_, err := db.Do("SADD", orderListKey, order.Id)
@@ -64,10 +69,97 @@ func dbInsertOrder(db redis.Conn, userID string, order order) (string, error) {
 	}
 
 	orderKey := fmt.Sprintf("%s:%s", orderListKey, order.Id)
-	_, err = db.Do("SET", orderKey, orderBytes)
+	if _, err = db.Do("SET", orderKey, orderBytes); err != nil {
+		return "", err
+	}
+
+	if order.Status == OrderBackordered {
+		_, err = db.Do("ZADD", backorderedKey, order.CreatedAt, backorderedMember(userID, order.Id))
+	}
 	return order.Id, err
 }
 
+// backorderedKey is a sorted set of the backordered orders of every user by
+// their creation time
+const backorderedKey = "orders:backordered"
+
+func backorderedMember(userID, orderID string) string {
+	return userID + ":" + orderID
+}
+
+func dbGetBackorderedOrders(db redis.Conn) ([]order, error) {
+	members, err := redis.Strings(db.Do("ZRANGE", backorderedKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]order, 0, len(members))
+	for _, member := range members {
+		// order ids never contain a colon, user ids might
+		sep := strings.LastIndex(member, ":")
+		o, err := dbGetOrder(db, member[:sep], member[sep+1:])
+		if err == redis.ErrNil {
+			db.Do("ZREM", backorderedKey, member)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, *o)
+	}
+
+	return orders, nil
+}
+
+// dbTransitionOrder moves the order to the given status. The order is read and
+// written back under WATCH so concurrent transitions can't both succeed.
+func dbTransitionOrder(db redis.Conn, userID, orderID string, to OrderStatus) (*order, error) {
+	orderKey := fmt.Sprintf("orders:%s:%s", userID, orderID)
+
+	for {
+		if _, err := db.Do("WATCH", orderKey); err != nil {
+			return nil, err
+		}
+
+		orderBytes, err := redis.Bytes(db.Do("GET", orderKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		order, err := decodeOrder(orderBytes)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		if err := order.transition(to); err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		orderBytes, err = json.Marshal(order)
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		db.Send("MULTI")
+		db.Send("SET", orderKey, orderBytes)
+		// no order moves back to backordered
+		db.Send("ZREM", backorderedKey, backorderedMember(userID, orderID))
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			return order, nil
+		}
+	}
+}
+
 func dbDeleteOrder(db redis.Conn, userID, orderID string) error {
 	orderListKey := fmt.Sprintf("orders:%s", userID)
 	ndel, err := redis.Int64(db.Do("SREM", orderListKey, orderID))
@@ -80,5 +172,10 @@ func dbDeleteOrder(db redis.Conn, userID, orderID string) error {
 
 	orderKey := fmt.Sprintf("%s:%s", orderListKey, orderID)
 	_, err = db.Do("DEL", orderKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Do("ZREM", backorderedKey, backorderedMember(userID, orderID))
 	return err
 }
@@ -1,88 +1,196 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
-	"net/url"
-	"os"
+	"sort"
+	"strconv"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/client/stock"
+	"github.com/umurgdk/markeet/internal/service"
 )
 
 type OrderStatus string
 
 const (
-	OrderPreparing OrderStatus = "preparing"
-	OrderShipped               = "shipped"
-	OrderDelivered             = "arrived"
+	// OrderBackordered orders wait for the stock of their backordered items,
+	// they are moved to preparing once all of it arrived
+	OrderBackordered OrderStatus = "backordered"
+	OrderPreparing   OrderStatus = "preparing"
+	OrderShipped     OrderStatus = "shipped"
+	OrderDelivered   OrderStatus = "delivered"
+	OrderCancelled   OrderStatus = "cancelled"
 )
 
-type order struct {
-	Id           string      `json:"id"`
-	UserID       string      `json:"user_id"`
-	ProductID    string      `json:"product_id"`
-	Quantity     int         `json:"quantity"`
-	CreatedAt    int64       `json:"created_at"`
-	Status       OrderStatus `json:"status"`
-	DroppedStock bool        `json:"-" redis:"-"`
+// orderTransitions lists the statuses an order is allowed to move to from
+// each status. Delivered and cancelled orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderBackordered: {OrderPreparing, OrderCancelled},
+	OrderPreparing:   {OrderShipped, OrderCancelled},
+	OrderShipped:     {OrderDelivered},
 }
 
-type stockInfo struct {
-	ProductID string `json:"product_id"`
-	Quanity   int    `json:"quantity"`
+// Backordered orders are checked this often for the stock of their items
+const backorderPollInterval = 2 * time.Second
+
+type statusChange struct {
+	Status OrderStatus `json:"status"`
+	At     int64       `json:"at"`
 }
 
-var notFoundError = errors.New("not found")
-var notEnoughStockError = errors.New("not enough stock")
+type transitionError struct {
+	From OrderStatus
+	To   OrderStatus
+}
 
-var stockHost = "stocks"
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("order can't move from '%s' to '%s'", e.From, e.To)
+}
 
-func main() {
-	if os.Getenv("STOCK_HOST") != "" {
-		stockHost = os.Getenv("STOCK_HOST")
+func (e *transitionError) Is(target error) bool {
+	return target == errIllegalTransition
+}
+
+// orderItem is a product of an order, Backorder is the stock reservation of an
+// item which was backordered. Locations is how much of the quantity was taken
+// from each stock location, so it can be put back where it came from.
+type orderItem struct {
+	ProductID string           `json:"product_id"`
+	Quantity  int              `json:"quantity"`
+	UnitPrice int64            `json:"unit_price"`
+	Backorder string           `json:"backorder,omitempty"`
+	Locations map[string]int64 `json:"locations,omitempty"`
+}
+
+type order struct {
+	Id        string         `json:"id"`
+	UserID    string         `json:"user_id"`
+	Items     []orderItem    `json:"items"`
+	Subtotal  int64          `json:"subtotal"`
+	Total     int64          `json:"total"`
+	Currency  string         `json:"currency"`
+	CreatedAt int64          `json:"created_at"`
+	Status    OrderStatus    `json:"status"`
+	History   []statusChange `json:"history"`
+
+	// Orders stored before orders had items kept their single item in
+	// product_id and quantity, upgrade moves it to the items
+	LegacyProductID string `json:"product_id,omitempty"`
+	LegacyQuantity  int    `json:"quantity,omitempty"`
+}
+
+// upgrade brings an order stored by an older version to the current shape
+func (o *order) upgrade() {
+	if len(o.Items) == 0 && o.LegacyProductID != "" {
+		o.Items = []orderItem{{ProductID: o.LegacyProductID, Quantity: o.LegacyQuantity}}
+	}
+	o.LegacyProductID, o.LegacyQuantity = "", 0
+
+	// Statuses weren't set before orders had transitions, every order was
+	// being prepared and delivered ones would have been "arrived"
+	switch o.Status {
+	case "":
+		o.Status = OrderPreparing
+	case "arrived":
+		o.Status = OrderDelivered
 	}
+}
 
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost:6379"
+// transition moves the order to the given status and records it in the
+// history, it fails if the move isn't allowed from the current status
+func (o *order) transition(to OrderStatus) error {
+	for _, next := range orderTransitions[o.Status] {
+		if next == to {
+			o.Status = to
+			o.History = append(o.History, statusChange{to, time.Now().UnixNano()})
+			return nil
+		}
 	}
 
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisHost) },
+	return &transitionError{o.Status, to}
+}
+
+// init prepares a new order of the user for storing, orders with backordered
+// items start as backordered. An order which already has an id keeps it.
+func (o *order) init(userID string) {
+	now := time.Now().UnixNano()
+	if o.Id == "" {
+		o.Id = newOrderID()
+	}
+	o.CreatedAt = now
+	o.UserID = userID
+	o.Status = OrderPreparing
+	for _, item := range o.Items {
+		if item.Backorder != "" {
+			o.Status = OrderBackordered
+		}
 	}
+	o.History = []statusChange{{o.Status, now}}
+	o.computeTotals()
+}
 
-	conn := pool.Get()
-	_, err := conn.Do("PING")
-	if err != nil {
-		log.Fatalf("failed to ping redis: %v", err)
+func newOrderID() string {
+	return strconv.FormatInt(time.Now().UnixNano()+rand.Int63n(100), 10)
+}
+
+func (o *order) computeTotals() {
+	o.Subtotal = 0
+	for _, item := range o.Items {
+		o.Subtotal += item.UnitPrice * int64(item.Quantity)
 	}
-	conn.Close()
 
-	log.Printf("Listening at http://localhost:8080")
-	http.HandleFunc("/", withLogging(withDB(pool, ordersHandler)))
-	http.ListenAndServe(":8080", nil)
+	o.Total = o.Subtotal
+}
+
+var notFoundError = errors.New("not found")
+
+// errIllegalTransition matches every *transitionError
+var errIllegalTransition = errors.New("illegal order transition")
+
+// errorResponses is how the domain errors are reported to clients
+var errorResponses = service.ErrorMap{
+	notFoundError:              {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "order not found"},
+	errIllegalTransition:       {Status: http.StatusConflict, Code: service.CodeConflict},
+	stock.ErrInsufficientStock: {Status: http.StatusNotAcceptable, Code: service.CodeInsufficientStock, Message: "not enough stock"},
 }
 
-func withDB(pool *redis.Pool, handler func(redis.Conn, http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		conn := pool.Get()
-		defer conn.Close()
-		handler(conn, w, r)
+var stockClient *stock.Client
+var productsClient *products.Client
+
+func main() {
+	stockClient = stock.New(service.Env("STOCK_HOST", "stocks"), 0)
+	productsClient = products.New(service.Env("PRODUCTS_HOST", "products"), 0)
+
+	var store OrderStore
+	var idempotency service.IdempotencyStore
+	if service.MemoryStorage() {
+		store = newMemoryStore()
+		idempotency = service.NewMemoryIdempotencyStore()
+	} else {
+		pool := service.NewPool()
+		service.MustPing(pool)
+		store = newRedisStore(pool)
+		idempotency = service.NewRedisIdempotencyStore(pool, "orders")
 	}
+
+	go promoteBackorders(store)
+
+	log.Printf("Listening at http://localhost:8080")
+	http.HandleFunc("/", service.Chain(service.WithStore(store, ordersHandler), service.WithRequestID, service.WithLogging, service.WithIdempotency(idempotency)))
+	http.ListenAndServe(":8080", nil)
 }
 
-func ordersHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) {
+func ordersHandler(store OrderStore, w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		w.WriteHeader(404)
-		w.Write([]byte("User ID not found"))
+		service.WriteError(w, service.BadRequest("user_id parameter is missing"))
 		return
 	}
 
@@ -90,244 +198,307 @@ func ordersHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		orderID := r.URL.Query().Get("order_id")
 		if orderID == "" {
-			w.WriteHeader(http.StatusNotFound)
+			service.WriteError(w, service.BadRequest("order_id parameter is missing"))
 			return
 		}
 
-		order, err := dbGetOrder(db, userID, orderID)
-		if err != nil {
-			if err == redis.ErrNil {
-				w.WriteHeader(http.StatusNotFound)
-				return
+		order, err := store.Order(userID, orderID)
+		if err == nil && order.Status == OrderCancelled {
+			if err := service.WriteJSON(w, http.StatusOK, order); err != nil {
+				log.Printf("ERROR: failed to encode json: %v\n", err)
 			}
-
-			log.Printf("ERROR: failed to get order: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if err := dbDeleteOrder(db, userID, orderID); err != nil {
-			if err == redis.ErrNil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
+		transitionOrder(store, w, userID, orderID, OrderCancelled)
+		return
+	case http.MethodPatch:
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			service.WriteError(w, service.BadRequest("order_id parameter is missing"))
+			return
+		}
 
-			log.Printf("ERROR: failed to delete order: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var payload struct {
+			Status OrderStatus `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			service.WriteError(w, service.BadRequest("invalid payload"))
 			return
 		}
 
-		if err := putItemsToStock(order.ProductID, order.Quantity); err != nil {
-			log.Printf("CRITICAL: product '%s', stock couldn't updated\n", order.ProductID)
+		switch payload.Status {
+		case OrderShipped, OrderDelivered, OrderCancelled:
+		case OrderPreparing:
+			service.WriteError(w, service.NewError(http.StatusConflict, service.CodeConflict, "backordered orders are moved to preparing when their stock arrives"))
+			return
+		default:
+			service.WriteError(w, service.BadRequest(fmt.Sprintf("unknown order status '%s'", payload.Status)))
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		transitionOrder(store, w, userID, orderID, payload.Status)
 		return
 	case http.MethodGet:
-		orders, err := dbGetOrders(db, userID)
+		orders, err := store.Orders(userID)
 		if err != nil {
 			log.Printf("ERROR: failed to retrieve orders for userID: '%s' with: %v\n", userID, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(w, err)
 			return
 		}
 
-		payload, err := json.Marshal(orders)
-		if err != nil {
+		if err := service.WriteJSON(w, http.StatusOK, orders); err != nil {
 			log.Printf("ERROR: failed to encode json: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
 		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(payload)
 		return
 
 	case http.MethodPost:
 		var payload order
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			log.Printf("ERROR: failed encode json: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(w, service.BadRequest("invalid payload"))
 			return
 		}
 
-		stockInfo, err := getStockInfo(payload.ProductID)
-		if err != nil {
-			if err == notFoundError {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("not enough stock"))
+		if len(payload.Items) == 0 {
+			service.WriteError(w, service.BadRequest("order has no items"))
+			return
+		}
+
+		for _, item := range payload.Items {
+			if item.Quantity <= 0 {
+				service.WriteError(w, service.BadRequest("quantity has to be a positive number greater than zero"))
 				return
 			}
+		}
+
+		// Prices are snapshotted from the products service, whatever the client
+		// sent is ignored
+		productIDs := make([]string, 0, len(payload.Items))
+		for _, item := range payload.Items {
+			productIDs = append(productIDs, item.ProductID)
+		}
 
-			log.Printf("ERROR: failed to get stock info: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		found, _, err := productsClient.Products(r.Context(), productIDs)
+		if err != nil {
+			log.Printf("ERROR: failed to get product info: %v\n", err)
+			service.WriteError(w, err)
 			return
 		}
 
-		if stockInfo.Quanity < payload.Quantity {
-			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte("not enough stock"))
+		productsByID := make(map[string]products.Product, len(found))
+		for _, p := range found {
+			productsByID[p.Id] = p
+		}
+
+		for i, item := range payload.Items {
+			info, ok := productsByID[item.ProductID]
+			if !ok {
+				service.WriteError(w, service.NotFound(fmt.Sprintf("product '%s' not found", item.ProductID)))
+				return
+			}
+
+			if i > 0 && info.Currency != payload.Currency {
+				service.WriteError(w, service.BadRequest("order items have different currencies"))
+				return
+			}
+
+			payload.Items[i].UnitPrice = info.Price
+			payload.Currency = info.Currency
+		}
+
+		// Stock is only held while the order record is written, it is either
+		// committed or released before responding. Items of products taking
+		// backorders may be backordered, they wait for their stock after the
+		// commit. The id of the order is picked up front so the stock history
+		// refers to it.
+		payload.Id = newOrderID()
+		reservations, err := reserveItems(r.Context(), payload.Items, "orders:"+userID, payload.Id)
+		if err != nil {
+			if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+				log.Printf("ERROR: failed to reserve stock: %v\n", err)
+			}
 			return
 		}
 
-		orderID, err := dbInsertOrder(db, userID, payload)
+		reservationIDs := make([]string, len(reservations))
+		for i, res := range reservations {
+			reservationIDs[i] = res.Id
+			payload.Items[i].Backorder, payload.Items[i].Locations = "", res.Locations
+			if res.Backordered {
+				payload.Items[i].Backorder = res.Id
+			}
+		}
+
+		orderID, err := store.InsertOrder(userID, payload)
 		if err != nil {
+			releaseReservations(context.Background(), reservationIDs)
+
 			log.Printf("ERROR: failed to insert order record: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(w, err)
 			return
 		}
 
-		if err := dropFromStock(payload.ProductID, payload.Quantity); err != nil {
+		if err := commitReservations(r.Context(), reservationIDs); err != nil {
 			// revert order record
-			dbDeleteOrder(db, userID, orderID)
+			store.DeleteOrder(userID, orderID)
 
-			if err == notEnoughStockError {
-				w.WriteHeader(http.StatusNotAcceptable)
-				w.Write([]byte("not enough stock"))
+			if err == stock.ErrNotFound {
+				service.WriteError(w, service.NewError(http.StatusConflict, service.CodeConflict, "stock reservation expired"))
 				return
 			}
 
-			log.Printf("ERROR: failed to drop ordered items from stock: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("ERROR: failed to commit stock reservation: %v\n", err)
+			service.WriteError(w, err)
 			return
 		}
 
 		responsePayload := map[string]string{"order_id": orderID}
-		response, err := json.Marshal(responsePayload)
-		if err != nil {
+		if err := service.WriteJSON(w, http.StatusCreated, responsePayload); err != nil {
 			log.Printf("ERROR: failed to encode json: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
 		}
-
-		w.WriteHeader(http.StatusCreated)
-		w.Write(response)
 		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	service.WriteError(w, service.NotFound("no such endpoint"))
 }
 
-func getStockInfo(productID string) (*stockInfo, error) {
-	client := &http.Client{}
-
-	reqParams := url.Values{"product_id": []string{productID}}
-	reqURL := fmt.Sprintf("http://%s?%s", stockHost, reqParams.Encode())
-
-	req, err := http.NewRequest("GET", reqURL, nil)
+func transitionOrder(store OrderStore, w http.ResponseWriter, userID, orderID string, to OrderStatus) {
+	order, err := store.TransitionOrder(userID, orderID, to)
 	if err != nil {
-		return nil, err
+		if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+			log.Printf("ERROR: failed to update order status: %v\n", err)
+		}
+		return
 	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	if order.Status == OrderCancelled {
+		for i, item := range order.Items {
+			// a backorder which didn't get its stock yet only leaves the
+			// queue, a fulfilled one is gone and its stock is put back
+			locations := item.Locations
+			if item.Backorder != "" {
+				err := stockClient.Release(context.Background(), item.Backorder)
+				if err == nil {
+					continue
+				}
+				if err != stock.ErrNotFound {
+					log.Printf("CRITICAL: backorder '%s' of cancelled order '%s' couldn't be released: %v\n", item.Backorder, order.Id, err)
+					continue
+				}
+
+				if res, err := stockClient.Reservation(context.Background(), item.Backorder); err == nil && res.Fulfilled {
+					locations = res.Locations
+				}
+			}
 
-	if res.StatusCode != http.StatusOK {
-		if res.StatusCode == http.StatusNotFound {
-			return nil, notFoundError
+			change := stock.Change{
+				Reason:         "order_cancelled",
+				Source:         "orders",
+				Reference:      order.Id,
+				IdempotencyKey: fmt.Sprintf("orders:%s:cancel:%d", order.Id, i),
+			}
+			if err := putBack(context.Background(), item.ProductID, item.Quantity, locations, change); err != nil {
+				log.Printf("CRITICAL: product '%s' of cancelled order '%s', stock couldn't updated: %v\n", item.ProductID, order.Id, err)
+			}
 		}
-
-		return nil, errors.New(res.Status)
 	}
 
-	var info stockInfo
-	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
-		return nil, err
+	if err := service.WriteJSON(w, http.StatusOK, order); err != nil {
+		log.Printf("ERROR: failed to encode json: %v\n", err)
 	}
-
-	return &info, nil
 }
 
-func dropFromStock(productID string, quantity int) error {
-	client := &http.Client{}
-
-	reqParams := url.Values{"product_id": []string{productID}}
-	reqURL := fmt.Sprintf("http://%s/drop?%s", stockHost, reqParams.Encode())
-
-	payload := struct {
-		Quantity int `json:"quantity"`
-	}{quantity}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodGet, reqURL, bytes.NewReader(body))
-	res, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	if res.StatusCode != http.StatusOK {
-		if res.StatusCode == http.StatusNotAcceptable {
-			return notEnoughStockError
-		}
-
-		return errors.New(res.Status)
+// reserveItems reserves every item of an order in one request, either all of
+// them are reserved or none. Items of products taking backorders are
+// backordered when there isn't enough stock.
+func reserveItems(ctx context.Context, items []orderItem, holder, orderID string) ([]*stock.Reservation, error) {
+	lines := make([]stock.ReserveLine, len(items))
+	for i, item := range items {
+		lines[i] = stock.ReserveLine{ProductID: item.ProductID, Quantity: int64(item.Quantity)}
 	}
 
-	return nil
+	return stockClient.ReserveBatchOrBackorder(ctx, lines, holder, orderID, 0)
 }
 
-func putItemsToStock(productID string, quantity int) error {
-	client := &http.Client{}
-
-	reqParams := url.Values{"product_id": []string{productID}}
-	reqURL := fmt.Sprintf("http://%s/put?%s", stockHost, reqParams.Encode())
-
-	payload := struct {
-		Quantity int `json:"quantity"`
-	}{quantity}
+// commitReservations commits the reservations of the order items in one
+// request. If one of them fails the stock service returns the stock of all of
+// them.
+func commitReservations(ctx context.Context, reservationIDs []string) error {
+	return stockClient.CommitBatch(ctx, reservationIDs)
+}
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
+// putBack returns the stock taken for an item to the locations it was taken
+// from in one batch. Items of orders stored before the locations were recorded
+// put it to the default location.
+func putBack(ctx context.Context, productID string, quantity int, locations map[string]int64, change stock.Change) error {
+	if len(locations) == 0 {
+		return stockClient.Put(ctx, productID, int64(quantity), change)
 	}
 
-	req, err := http.NewRequest("GET", reqURL, bytes.NewReader(body))
-	if err != nil {
-		return err
+	lines := make([]stock.BatchLine, 0, len(locations))
+	for location, taken := range locations {
+		lines = append(lines, stock.BatchLine{ProductID: productID, Op: stock.OpPut, Quantity: taken, Location: location})
 	}
+	// the lines are sorted so a retry sends the same request for the
+	// idempotency key
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Location < lines[j].Location })
 
-	res, err := client.Do(req)
-	if err != nil {
-		return err
-	}
+	_, err := stockClient.Batch(ctx, lines, change)
+	return err
+}
 
-	if res.StatusCode != http.StatusOK {
-		return errors.New(res.Status)
+func releaseReservations(ctx context.Context, reservationIDs []string) {
+	for _, reservationID := range reservationIDs {
+		if err := stockClient.Release(ctx, reservationID); err != nil {
+			log.Printf("ERROR: failed to release reservation '%s': %v\n", reservationID, err)
+		}
 	}
-
-	return nil
 }
 
-type loggingResponseWriter struct {
-	w          http.ResponseWriter
-	StatusCode int
-	Body       []byte
-}
+// promoteBackorders moves the backordered orders whose items all got their
+// stock to preparing. Stock goes to the backorders of a product in the order
+// they were made, and the orders are checked oldest first.
+func promoteBackorders(store OrderStore) {
+	for range time.Tick(backorderPollInterval) {
+		orders, err := store.BackorderedOrders()
+		if err != nil {
+			log.Printf("ERROR: failed to list backordered orders: %v\n", err)
+			continue
+		}
 
-func (l *loggingResponseWriter) Header() http.Header {
-	return l.w.Header()
-}
+		for _, o := range orders {
+			fulfilled, err := backordersFulfilled(context.Background(), &o)
+			if err != nil {
+				log.Printf("ERROR: failed to check backorders of order '%s': %v\n", o.Id, err)
+				continue
+			}
+			if !fulfilled {
+				continue
+			}
 
-func (l *loggingResponseWriter) Write(bytes []byte) (int, error) {
-	l.Body = append(l.Body, bytes...)
-	return l.w.Write(bytes)
+			// the order may have been cancelled in the meantime
+			_, err = store.TransitionOrder(o.UserID, o.Id, OrderPreparing)
+			if err != nil && !errors.Is(err, errIllegalTransition) && err != notFoundError {
+				log.Printf("ERROR: failed to promote backordered order '%s': %v\n", o.Id, err)
+			}
+		}
+	}
 }
 
-func (l *loggingResponseWriter) WriteHeader(statusCode int) {
-	l.StatusCode = statusCode
-	l.w.WriteHeader(statusCode)
-}
+func backordersFulfilled(ctx context.Context, o *order) (bool, error) {
+	for _, item := range o.Items {
+		if item.Backorder == "" {
+			continue
+		}
 
-func withLogging(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%s] %v\n", r.Method, r.URL)
-		writer := loggingResponseWriter{w, 0, nil}
-		handler(&writer, r)
-		log.Printf("-> %d -- %s", writer.StatusCode, string(writer.Body))
+		res, err := stockClient.Reservation(ctx, item.Backorder)
+		if err != nil {
+			return false, err
+		}
+		if !res.Fulfilled {
+			return false, nil
+		}
 	}
+
+	return true, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/umurgdk/markeet/client/products"
+	"github.com/umurgdk/markeet/client/stock"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// fakeStock stands in for the stock service, it keeps the stock of every
+// product in a single location
+type fakeStock struct {
+	mu           sync.Mutex
+	available    map[string]int64
+	reservations map[string]*stock.Reservation
+	next         int
+	// references are the references the reservations were made with
+	references []string
+	// expired makes commits fail as if the reservations expired
+	expired bool
+}
+
+func (f *fakeStock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	switch r.URL.Path {
+	case "/reserve/batch":
+		var payload struct {
+			Lines     []stock.ReserveLine `json:"lines"`
+			Holder    string              `json:"holder"`
+			Reference string              `json:"reference"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		needed := make(map[string]int64)
+		for i, line := range payload.Lines {
+			needed[line.ProductID] += line.Quantity
+			if f.available[line.ProductID] < needed[line.ProductID] {
+				details := []stock.LineError{{Line: i, ProductID: line.ProductID, Message: "insufficient quantity"}}
+				service.WriteError(w, service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "not enough stock").WithDetails(details))
+				return
+			}
+		}
+
+		var reservations []*stock.Reservation
+		for _, line := range payload.Lines {
+			f.available[line.ProductID] -= line.Quantity
+
+			f.next++
+			res := &stock.Reservation{
+				Id:        "r" + strconv.Itoa(f.next),
+				ProductID: line.ProductID,
+				Holder:    payload.Holder,
+				Reference: payload.Reference,
+				Quantity:  line.Quantity,
+				Locations: map[string]int64{"main": line.Quantity},
+			}
+			f.reservations[res.Id] = res
+			f.references = append(f.references, payload.Reference)
+			reservations = append(reservations, res)
+		}
+		service.WriteJSON(w, http.StatusCreated, map[string]interface{}{"reservations": reservations})
+	case "/commit/batch":
+		var payload struct {
+			ReservationIDs []string `json:"reservation_ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		missing := f.expired
+		for _, reservationID := range payload.ReservationIDs {
+			if _, ok := f.reservations[reservationID]; !ok {
+				missing = true
+			}
+		}
+
+		// like the real service, either all are committed or all are returned
+		for _, reservationID := range payload.ReservationIDs {
+			if res, ok := f.reservations[reservationID]; ok && missing {
+				f.available[res.ProductID] += res.Quantity
+			}
+			delete(f.reservations, reservationID)
+		}
+		if missing {
+			service.WriteError(w, service.NotFound("reservation not found"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "/release":
+		res, ok := f.reservations[query.Get("reservation_id")]
+		if !ok {
+			service.WriteError(w, service.NotFound("reservation not found"))
+			return
+		}
+
+		delete(f.reservations, res.Id)
+		f.available[res.ProductID] += res.Quantity
+		w.WriteHeader(http.StatusOK)
+	case "/batch":
+		var payload struct {
+			Lines []stock.BatchLine `json:"lines"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		for _, line := range payload.Lines {
+			f.available[line.ProductID] += line.Quantity
+		}
+		service.WriteJSON(w, http.StatusOK, map[string]interface{}{"lines": payload.Lines})
+	default:
+		service.WriteError(w, service.NotFound("no such endpoint"))
+	}
+}
+
+func (f *fakeStock) stock(productID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.available[productID]
+}
+
+func setupOrders(t *testing.T, available map[string]int64) (*memoryStore, *fakeStock) {
+	t.Helper()
+
+	productsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var found []products.Product
+		var missing []string
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			if _, ok := available[id]; !ok {
+				missing = append(missing, id)
+				continue
+			}
+			found = append(found, products.Product{Id: id, Price: 100, Currency: "USD"})
+		}
+		service.WriteJSON(w, http.StatusOK, map[string]interface{}{"products": found, "missing": missing})
+	}))
+	t.Cleanup(productsServer.Close)
+
+	fake := &fakeStock{available: available, reservations: make(map[string]*stock.Reservation)}
+	stockServer := httptest.NewServer(fake)
+	t.Cleanup(stockServer.Close)
+
+	productsClient = products.New(productsServer.URL, 0)
+	stockClient = stock.New(stockServer.URL, 0)
+
+	return newMemoryStore(), fake
+}
+
+func request(store OrderStore, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ordersHandler(store, w, r)
+	return w
+}
+
+func createOrder(t *testing.T, store OrderStore, body string) string {
+	t.Helper()
+
+	w := request(store, http.MethodPost, "/?user_id=u1", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var res map[string]string
+	json.NewDecoder(w.Body).Decode(&res)
+	return res["order_id"]
+}
+
+func TestCreateOrder(t *testing.T) {
+	store, fake := setupOrders(t, map[string]int64{"p1": 5, "p2": 5})
+
+	orderID := createOrder(t, store, `{"items":[{"product_id":"p1","quantity":2},{"product_id":"p2","quantity":1,"unit_price":1}]}`)
+
+	o, err := store.Order("u1", orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != OrderPreparing || o.Total != 300 || o.Currency != "USD" {
+		t.Errorf("got order %+v, want it preparing with a total of 300 USD", o)
+	}
+	if o.Items[0].Locations["main"] != 2 {
+		t.Errorf("got locations %v of the first item, want 2 from main", o.Items[0].Locations)
+	}
+
+	if fake.stock("p1") != 3 || fake.stock("p2") != 4 {
+		t.Errorf("got stock %v, want 3 of p1 and 4 of p2", fake.available)
+	}
+	if len(fake.reservations) != 0 {
+		t.Errorf("reservations %v are left, want them committed", fake.reservations)
+	}
+	for _, reference := range fake.references {
+		if reference != orderID {
+			t.Errorf("got reservation reference '%s', want the order id '%s'", reference, orderID)
+		}
+	}
+}
+
+func TestCreateOrderInsufficientStock(t *testing.T) {
+	store, fake := setupOrders(t, map[string]int64{"p1": 5, "p2": 1})
+
+	w := request(store, http.MethodPost, "/?user_id=u1", `{"items":[{"product_id":"p1","quantity":2},{"product_id":"p2","quantity":2}]}`)
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotAcceptable, w.Body)
+	}
+
+	if orders, _ := store.Orders("u1"); len(orders) != 0 {
+		t.Errorf("got orders %+v, want none", orders)
+	}
+	// the first item isn't left reserved either
+	if fake.stock("p1") != 5 || len(fake.reservations) != 0 {
+		t.Errorf("got %d of p1 with reservations %v, want 5 and none", fake.stock("p1"), fake.reservations)
+	}
+}
+
+func TestCreateOrderReservationExpired(t *testing.T) {
+	store, fake := setupOrders(t, map[string]int64{"p1": 5})
+	fake.expired = true
+
+	w := request(store, http.MethodPost, "/?user_id=u1", `{"items":[{"product_id":"p1","quantity":2}]}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+
+	if orders, _ := store.Orders("u1"); len(orders) != 0 {
+		t.Errorf("got orders %+v, want the order reverted", orders)
+	}
+	if fake.stock("p1") != 5 {
+		t.Errorf("got %d of p1, want 5", fake.stock("p1"))
+	}
+}
+
+func TestCreateOrderMissingProduct(t *testing.T) {
+	store, _ := setupOrders(t, map[string]int64{"p1": 5})
+
+	w := request(store, http.MethodPost, "/?user_id=u1", `{"items":[{"product_id":"p3","quantity":1}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	store, fake := setupOrders(t, map[string]int64{"p1": 5})
+	orderID := createOrder(t, store, `{"items":[{"product_id":"p1","quantity":2}]}`)
+
+	w := request(store, http.MethodDelete, "/?user_id=u1&order_id="+orderID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var o order
+	json.NewDecoder(w.Body).Decode(&o)
+	if o.Status != OrderCancelled {
+		t.Errorf("got status %s, want %s", o.Status, OrderCancelled)
+	}
+	if fake.stock("p1") != 5 {
+		t.Errorf("got %d of p1 after the cancel, want 5", fake.stock("p1"))
+	}
+
+	// cancelling again doesn't put the stock back twice
+	if w := request(store, http.MethodDelete, "/?user_id=u1&order_id="+orderID, ""); w.Code != http.StatusOK {
+		t.Fatalf("cancelling again: got status %d: %s", w.Code, w.Body)
+	}
+	if fake.stock("p1") != 5 {
+		t.Errorf("got %d of p1 after cancelling again, want 5", fake.stock("p1"))
+	}
+
+	w = request(store, http.MethodPatch, "/?user_id=u1&order_id="+orderID, `{"status":"shipped"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("shipping a cancelled order: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStore is an OrderStore which keeps everything in memory, it is used for
+// tests and running the service without Redis
+type memoryStore struct {
+	mu     sync.Mutex
+	orders map[string]map[string]order
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{orders: make(map[string]map[string]order)}
+}
+
+func (s *memoryStore) Order(userID, orderID string) (*order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[userID][orderID]
+	if !ok {
+		return nil, notFoundError
+	}
+
+	return &o, nil
+}
+
+func (s *memoryStore) Orders(userID string) ([]order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := make([]order, 0, len(s.orders[userID]))
+	for _, o := range s.orders[userID] {
+		orders = append(orders, o)
+	}
+
+	return orders, nil
+}
+
+func (s *memoryStore) InsertOrder(userID string, o order) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.init(userID)
+	if s.orders[userID] == nil {
+		s.orders[userID] = make(map[string]order)
+	}
+
+	s.orders[userID][o.Id] = o
+	return o.Id, nil
+}
+
+func (s *memoryStore) TransitionOrder(userID, orderID string, to OrderStatus) (*order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[userID][orderID]
+	if !ok {
+		return nil, notFoundError
+	}
+
+	// The history is copied so appending to it doesn't share the backing array
+	// with the stored order
+	o.History = append([]statusChange(nil), o.History...)
+	if err := o.transition(to); err != nil {
+		return nil, err
+	}
+
+	s.orders[userID][orderID] = o
+	return &o, nil
+}
+
+func (s *memoryStore) DeleteOrder(userID, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[userID][orderID]; !ok {
+		return notFoundError
+	}
+
+	delete(s.orders[userID], orderID)
+	return nil
+}
+
+func (s *memoryStore) BackorderedOrders() ([]order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var orders []order
+	for _, userOrders := range s.orders {
+		for _, o := range userOrders {
+			if o.Status == OrderBackordered {
+				orders = append(orders, o)
+			}
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].CreatedAt < orders[j].CreatedAt
+	})
+	return orders, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+)
+
+// OrderStore keeps the orders of the users. Methods return notFoundError when
+// the order doesn't exist.
+type OrderStore interface {
+	Order(userID, orderID string) (*order, error)
+	Orders(userID string) ([]order, error)
+	// InsertOrder stores a new order of the user and returns its id
+	InsertOrder(userID string, order order) (string, error)
+	TransitionOrder(userID, orderID string, to OrderStatus) (*order, error)
+	DeleteOrder(userID, orderID string) error
+	// BackorderedOrders returns the orders of every user which are
+	// backordered, oldest first
+	BackorderedOrders() ([]order, error)
+}
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+func newRedisStore(pool *redis.Pool) *redisStore {
+	return &redisStore{pool}
+}
+
+func (s *redisStore) Order(userID, orderID string) (*order, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	o, err := dbGetOrder(db, userID, orderID)
+	return o, notFound(err)
+}
+
+func (s *redisStore) Orders(userID string) ([]order, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetOrders(db, userID)
+}
+
+func (s *redisStore) InsertOrder(userID string, order order) (string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbInsertOrder(db, userID, order)
+}
+
+func (s *redisStore) TransitionOrder(userID, orderID string, to OrderStatus) (*order, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	o, err := dbTransitionOrder(db, userID, orderID, to)
+	return o, notFound(err)
+}
+
+func (s *redisStore) BackorderedOrders() ([]order, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetBackorderedOrders(db)
+}
+
+func (s *redisStore) DeleteOrder(userID, orderID string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return notFound(dbDeleteOrder(db, userID, orderID))
+}
+
+// notFound translates the missing key error of redigo to notFoundError
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return notFoundError
+	}
+
+	return err
+}
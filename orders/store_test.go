@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// eachStore runs test against the memory store and the Redis at REDIS_HOST, the
+// Redis run is skipped without one. Users get ids of their own in every run so
+// runs don't see each other's orders.
+func eachStore(t *testing.T, test func(t *testing.T, store OrderStore, userID string)) {
+	userID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(), userID)
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, newRedisStore(redisPool(t)), userID)
+	})
+}
+
+// redisPool returns a pool of the Redis at REDIS_HOST, the test is skipped
+// without one
+func redisPool(t *testing.T) *redis.Pool {
+	t.Helper()
+
+	pool := service.NewPool()
+	t.Cleanup(func() { pool.Close() })
+
+	db := pool.Get()
+	_, err := db.Do("PING")
+	db.Close()
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	return pool
+}
+
+func TestStoreOrders(t *testing.T) {
+	eachStore(t, func(t *testing.T, store OrderStore, userID string) {
+		orderID, err := store.InsertOrder(userID, order{Items: []orderItem{{ProductID: "p1", Quantity: 2, UnitPrice: 100}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := store.Order(userID, orderID)
+		if err != nil || o.Status != OrderPreparing || o.Total != 200 || len(o.History) != 1 {
+			t.Fatalf("got order %+v, %v, want a preparing order of 200", o, err)
+		}
+		if orders, _ := store.Orders(userID); len(orders) != 1 {
+			t.Errorf("got orders %+v, want the one order", orders)
+		}
+
+		if _, err := store.TransitionOrder(userID, orderID, OrderDelivered); !errors.Is(err, errIllegalTransition) {
+			t.Errorf("delivering a preparing order: got %v, want %v", err, errIllegalTransition)
+		}
+		if o, err := store.TransitionOrder(userID, orderID, OrderShipped); err != nil || o.Status != OrderShipped || len(o.History) != 2 {
+			t.Errorf("got order %+v, %v, want it shipped", o, err)
+		}
+
+		if err := store.DeleteOrder(userID, orderID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Order(userID, orderID); err != notFoundError {
+			t.Errorf("getting a deleted order: got %v, want %v", err, notFoundError)
+		}
+		if _, err := store.TransitionOrder(userID, orderID, OrderDelivered); err != notFoundError {
+			t.Errorf("moving a deleted order: got %v, want %v", err, notFoundError)
+		}
+	})
+}
+
+func TestStoreBackorderedOrders(t *testing.T) {
+	eachStore(t, func(t *testing.T, store OrderStore, userID string) {
+		orderID, _ := store.InsertOrder(userID, order{Items: []orderItem{{ProductID: "p1", Quantity: 1, Backorder: "r1"}}})
+
+		backordered := func() bool {
+			orders, err := store.BackorderedOrders()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range orders {
+				if o.Id == orderID {
+					return true
+				}
+			}
+			return false
+		}
+
+		if !backordered() {
+			t.Fatalf("order isn't listed as backordered")
+		}
+
+		// concurrent moves of the order can't both succeed
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = store.TransitionOrder(userID, orderID, OrderPreparing)
+			}(i)
+		}
+		wg.Wait()
+		if (errs[0] == nil) == (errs[1] == nil) {
+			t.Errorf("got %v and %v, want exactly one move to succeed", errs[0], errs[1])
+		}
+
+		if backordered() {
+			t.Errorf("order is still listed as backordered after it moved on")
+		}
+	})
+}
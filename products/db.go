@@ -1,53 +1,116 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
 )
 
-func dbGetAllProducts(db redis.Conn, startFrom string, maxItems int) ([]product, string, error) {
+func dbGetAllProducts(db redis.Conn, category, startFrom string, maxItems int) ([]product, string, error) {
+	listKey := "products"
+	if category != "" {
+		listKey = categoryKey(category)
+	}
+
 	if startFrom == "" {
 		startFrom = "+inf"
 	} else {
 		startFrom = "(" + startFrom
 	}
 
-	productKeys, err := redis.Strings(db.Do("ZREVRANGEBYSCORE", "products", startFrom, "-inf", "LIMIT", 0, maxItems))
+	productKeys, err := redis.Strings(db.Do("ZREVRANGEBYSCORE", listKey, startFrom, "-inf", "LIMIT", 0, maxItems))
 	if err != nil {
 		return nil, "", err
 	}
 
+	products, _, err := dbGetProductsByKeys(db, productKeys)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(products) == 0 {
+		return nil, "", nil
+	}
+
+	nextKey := strconv.FormatInt(products[len(products)-1].CreatedAt, 10)
+	return products, nextKey, nil
+}
+
+func dbGetProductsByIDs(db redis.Conn, productIDs []string) ([]product, []string, error) {
+	productKeys := make([]string, 0, len(productIDs))
+	for _, id := range productIDs {
+		productKeys = append(productKeys, fmt.Sprintf("products:%s", id))
+	}
+
+	products, missing, err := dbGetProductsByKeys(db, productKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missingIDs := make([]string, 0, len(missing))
+	for _, i := range missing {
+		missingIDs = append(missingIDs, productIDs[i])
+	}
+
+	return products, missingIDs, nil
+}
+
+// dbGetProductsByKeys fetches the products in a single round trip. Keys which
+// don't exist are skipped and their indexes are returned as missing.
+func dbGetProductsByKeys(db redis.Conn, productKeys []string) ([]product, []int, error) {
 	for _, key := range productKeys {
 		db.Send("HGETALL", key)
 	}
 	if err := db.Flush(); err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
+	var missing []int
 	products := make([]product, 0, len(productKeys))
-	for _, _ = range productKeys {
+	for i := range productKeys {
 		values, err := redis.Values(db.Receive())
 		if err != nil {
-			return nil, "", err
+			return nil, nil, err
+		}
+		if len(values) == 0 {
+			missing = append(missing, i)
+			continue
 		}
 
 		var p product
 		if err := redis.ScanStruct(values, &p); err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
 
 		products = append(products, p)
 	}
 
-	if len(products) == 0 {
-		return nil, "", nil
+	return products, missing, nil
+}
+
+func dbGetProduct(db redis.Conn, productID string) (*product, error) {
+	productKey := fmt.Sprintf("products:%s", productID)
+
+	values, err := redis.Values(db.Do("HGETALL", productKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, redis.ErrNil
 	}
 
-	nextKey := strconv.FormatInt(products[len(products)-1].CreatedAt, 10)
-	return products, nextKey, nil
+	var p product
+	if err := redis.ScanStruct(values, &p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
 }
 
 func dbInsertProduct(db redis.Conn, product product) error {
@@ -61,18 +124,405 @@ func dbInsertProduct(db redis.Conn, product product) error {
 		return err
 	}
 
-	return nil
+	if product.Category != "" {
+		if _, err := db.Do("ZADD", categoryKey(product.Category), product.CreatedAt, productKey); err != nil {
+			db.Do("ZREM", "products", productKey)
+			db.Do("DEL", productKey)
+			return err
+		}
+
+		if _, err := db.Do("SADD", "categories", product.Category); err != nil {
+			return err
+		}
+	}
+
+	return dbIndexProduct(db, productKey, product.Name)
+}
+
+// dbUpdateProduct applies update to the stored product and bumps its version.
+// Unless expectedVersion is anyVersion the update is rejected when the stored
+// product isn't at that version anymore.
+func dbUpdateProduct(db redis.Conn, productID string, expectedVersion int64, update func(*product) error) (*product, error) {
+	productKey := fmt.Sprintf("products:%s", productID)
+
+	for {
+		if _, err := db.Do("WATCH", productKey); err != nil {
+			return nil, err
+		}
+
+		values, err := redis.Values(db.Do("HGETALL", productKey))
+		if err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+		if len(values) == 0 {
+			db.Do("UNWATCH")
+			return nil, redis.ErrNil
+		}
+
+		var p product
+		if err := redis.ScanStruct(values, &p); err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+
+		if expectedVersion != anyVersion && p.Version != expectedVersion {
+			db.Do("UNWATCH")
+			return nil, ErrVersionMismatch
+		}
+
+		oldCategory, oldName := p.Category, p.Name
+		if err := update(&p); err != nil {
+			db.Do("UNWATCH")
+			return nil, err
+		}
+		p.Version++
+
+		db.Send("MULTI")
+		db.Send("HSET", redis.Args{}.Add(productKey).AddFlat(&p)...)
+		if p.Category != oldCategory {
+			if oldCategory != "" {
+				db.Send("ZREM", categoryKey(oldCategory), productKey)
+			}
+			if p.Category != "" {
+				db.Send("ZADD", categoryKey(p.Category), p.CreatedAt, productKey)
+				db.Send("SADD", "categories", p.Category)
+			}
+		}
+
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			if p.Category != oldCategory && oldCategory != "" {
+				dbPruneCategory(db, oldCategory)
+			}
+
+			if p.Name != oldName {
+				if err := dbUnindexProduct(db, productKey, oldName); err != nil {
+					log.Printf("WARN: failed to unindex product '%s': %v\n", productID, err)
+				}
+				if err := dbIndexProduct(db, productKey, p.Name); err != nil {
+					log.Printf("WARN: failed to index product '%s': %v\n", productID, err)
+				}
+			}
+
+			return &p, nil
+		}
+	}
 }
 
 func dbDeleteProduct(db redis.Conn, productID string) error {
 	productKey := fmt.Sprintf("products:%s", productID)
-	if _, err := db.Do("DEL", productKey); err != nil {
+
+	fields, err := redis.Strings(db.Do("HMGET", productKey, "Category", "Name"))
+	if err != nil {
+		return err
+	}
+	category, name := fields[0], fields[1]
+
+	ndel, err := redis.Int(db.Do("DEL", productKey))
+	if err != nil {
 		return err
 	}
+	if ndel == 0 {
+		return redis.ErrNil
+	}
 
-	if _, err := db.Do("ZREM", productKey); err != nil {
+	if _, err := db.Do("ZREM", "products", productKey); err != nil {
 		log.Printf("WARN: product not found in list")
 	}
 
+	if category != "" {
+		if _, err := db.Do("ZREM", categoryKey(category), productKey); err != nil {
+			log.Printf("WARN: product not found in category list")
+		}
+
+		dbPruneCategory(db, category)
+	}
+
+	if err := dbUnindexProduct(db, productKey, name); err != nil {
+		log.Printf("WARN: failed to unindex product '%s': %v\n", productID, err)
+	}
+
 	return nil
 }
+
+// dbGetCategories returns every category with the number of products in it
+func dbGetCategories(db redis.Conn) ([]category, error) {
+	names, err := redis.Strings(db.Do("SMEMBERS", "categories"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		db.Send("ZCARD", categoryKey(name))
+	}
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	categories := make([]category, 0, len(names))
+	for _, name := range names {
+		count, err := redis.Int64(db.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+
+		categories = append(categories, category{name, count})
+	}
+
+	return categories, nil
+}
+
+// dbPruneCategory drops the category from the category list once it has no
+// products left
+func dbPruneCategory(db redis.Conn, category string) {
+	count, err := redis.Int(db.Do("ZCARD", categoryKey(category)))
+	if err != nil || count > 0 {
+		return
+	}
+
+	if _, err := db.Do("SREM", "categories", category); err != nil {
+		log.Printf("WARN: failed to remove empty category '%s': %v\n", category, err)
+	}
+}
+
+func categoryKey(category string) string {
+	return fmt.Sprintf("categories:%s", category)
+}
+
+// Products are read this many at a time while reindexing
+const reindexBatch = 100
+
+// dbReindexProducts adds every stored product to the product list, to the list
+// of its category and to the search index. These are only maintained when
+// products are written, so products stored before they existed are missing
+// from them.
+// Adding a product again doesn't change anything, so it is safe to run at any
+// time.
+func dbReindexProducts(db redis.Conn) (int, error) {
+	count := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(db.Do("SCAN", cursor, "MATCH", "products:*", "COUNT", reindexBatch))
+		if err != nil {
+			return count, err
+		}
+
+		var productKeys []string
+		if _, err := redis.Scan(values, &cursor, &productKeys); err != nil {
+			return count, err
+		}
+
+		products, _, err := dbGetProductsByKeys(db, productKeys)
+		if err != nil {
+			return count, err
+		}
+
+		for _, p := range products {
+			if err := dbIndexCategory(db, p); err != nil {
+				return count, err
+			}
+			if err := dbIndexProduct(db, fmt.Sprintf("products:%s", p.Id), p.Name); err != nil {
+				return count, err
+			}
+		}
+		count += len(products)
+
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+func dbIndexCategory(db redis.Conn, p product) error {
+	productKey := fmt.Sprintf("products:%s", p.Id)
+
+	db.Send("MULTI")
+	db.Send("ZADD", "products", p.CreatedAt, productKey)
+	if p.Category != "" {
+		db.Send("ZADD", categoryKey(p.Category), p.CreatedAt, productKey)
+		db.Send("SADD", "categories", p.Category)
+	}
+	_, err := db.Do("EXEC")
+	return err
+}
+
+// dbIndexProduct adds the product to the inverted index of its name tokens.
+// Every token is also kept in search:terms so prefixes can be expanded with
+// ZRANGEBYLEX.
+func dbIndexProduct(db redis.Conn, productKey, name string) error {
+	for _, token := range tokenize(name) {
+		db.Send("ZADD", termKey(token), 1, productKey)
+		db.Send("ZADD", "search:terms", 0, token)
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	for range tokenize(name) {
+		for i := 0; i < 2; i++ {
+			if _, err := db.Receive(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func dbUnindexProduct(db redis.Conn, productKey, name string) error {
+	for _, token := range tokenize(name) {
+		if _, err := db.Do("ZREM", termKey(token), productKey); err != nil {
+			return err
+		}
+
+		count, err := redis.Int(db.Do("ZCARD", termKey(token)))
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := db.Do("ZREM", "search:terms", token); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dbSearchProducts ranks the products matching the query tokens. An exact token
+// match scores higher than a prefix match and the scores of the query tokens
+// are summed up. Results are cached for a short while so paging through them
+// with the returned offset stays stable.
+func dbSearchProducts(db redis.Conn, query, category string, offset, maxItems int) ([]product, string, error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, "", nil
+	}
+
+	resultKey := fmt.Sprintf("search:results:%s:%s", strings.Join(tokens, " "), category)
+
+	exists, err := redis.Bool(db.Do("EXISTS", resultKey))
+	if err != nil {
+		return nil, "", err
+	}
+	if !exists {
+		if err := dbBuildSearchResult(db, resultKey, tokens, category); err != nil {
+			return nil, "", err
+		}
+	}
+
+	productKeys, err := redis.Strings(db.Do("ZREVRANGE", resultKey, offset, offset+maxItems-1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	products, _, err := dbGetProductsByKeys(db, productKeys)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextKey := ""
+	if len(productKeys) == maxItems {
+		nextKey = strconv.Itoa(offset + maxItems)
+	}
+
+	return products, nextKey, nil
+}
+
+// dbBuildSearchResult stores the ranked products matching the tokens at
+// resultKey. The result is built under keys of its own and renamed into place,
+// so concurrent searches for the same query don't clobber each other's work.
+func dbBuildSearchResult(db redis.Conn, resultKey string, tokens []string, category string) error {
+	buildKey := fmt.Sprintf("%s:build:%s", resultKey, newBuildID())
+
+	tempKeys := []string{buildKey}
+	defer func() {
+		db.Do("DEL", redis.Args{}.AddFlat(tempKeys)...)
+	}()
+
+	var tokenKeys []string
+	for i, token := range tokens {
+		terms, err := redis.Strings(db.Do("ZRANGEBYLEX", "search:terms", "["+token, "["+token+"\xff", "LIMIT", 0, maxPrefixExpansions))
+		if err != nil {
+			return err
+		}
+		if len(terms) == 0 {
+			continue
+		}
+
+		args := redis.Args{}
+		weights := redis.Args{"WEIGHTS"}
+		for _, term := range terms {
+			args = args.Add(termKey(term))
+			if term == token {
+				weights = weights.Add(2)
+			} else {
+				weights = weights.Add(1)
+			}
+		}
+
+		tokenKey := fmt.Sprintf("%s:%d", buildKey, i)
+		tempKeys = append(tempKeys, tokenKey)
+		args = redis.Args{}.Add(tokenKey, len(terms)).AddFlat(args).AddFlat(weights).Add("AGGREGATE", "MAX")
+		if _, err := db.Do("ZUNIONSTORE", args...); err != nil {
+			return err
+		}
+
+		tokenKeys = append(tokenKeys, tokenKey)
+	}
+
+	if len(tokenKeys) == 0 {
+		return nil
+	}
+
+	unionKey := buildKey
+	if category != "" {
+		unionKey = fmt.Sprintf("%s:all", buildKey)
+		tempKeys = append(tempKeys, unionKey)
+	}
+
+	args := redis.Args{}.Add(unionKey, len(tokenKeys)).AddFlat(tokenKeys).Add("AGGREGATE", "SUM")
+	count, err := redis.Int(db.Do("ZUNIONSTORE", args...))
+	if err != nil {
+		return err
+	}
+
+	if category != "" {
+		count, err = redis.Int(db.Do("ZINTERSTORE", buildKey, 2, unionKey, categoryKey(category), "WEIGHTS", 1, 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Nothing is stored for an empty result, there is nothing to rename
+	if count == 0 {
+		return nil
+	}
+
+	if _, err := db.Do("EXPIRE", buildKey, int(searchResultTTL.Seconds())); err != nil {
+		return err
+	}
+
+	_, err = db.Do("RENAME", buildKey, resultKey)
+	return err
+}
+
+// newBuildID returns a random id which keeps the keys of a search result being
+// built apart from the other builds
+func newBuildID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func termKey(token string) string {
+	return fmt.Sprintf("search:terms:%s", token)
+}
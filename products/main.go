@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
 )
 
 type product struct {
@@ -16,53 +19,175 @@ type product struct {
 	Name      string `json:"name"`
 	CreatedAt int64  `json:"created_at"`
 	Category  string `json:"category"`
+	Price     int64  `json:"price"`
+	Currency  string `json:"currency"`
+	Version   int64  `json:"version"`
 }
 
-func main() {
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost:6379"
+// invalidProductError is returned when a product sent by a client fails validation
+type invalidProductError string
+
+func (e invalidProductError) Error() string {
+	return string(e)
+}
+
+func (e invalidProductError) Is(target error) bool {
+	return target == ErrInvalidProduct
+}
+
+type category struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+const searchResultTTL = time.Minute
+
+// Maximum number of index terms a query token is expanded to as a prefix
+const maxPrefixExpansions = 50
+
+var ErrNotFound = errors.New("not found")
+var ErrVersionMismatch = errors.New("version mismatch")
+var ErrVersionRequired = errors.New("version required")
+
+// anyVersion is the expected version of an update sent with "If-Match: *", it
+// is applied to whatever version is stored
+const anyVersion int64 = -1
+
+// ErrInvalidProduct matches every invalidProductError
+var ErrInvalidProduct = errors.New("invalid product")
+
+// errorResponses is how the domain errors are reported to clients
+var errorResponses = service.ErrorMap{
+	ErrNotFound:        {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "product not found"},
+	ErrVersionMismatch: {Status: http.StatusPreconditionFailed, Code: service.CodePreconditionFailed, Message: "product was modified by someone else"},
+	ErrVersionRequired: {Status: http.StatusPreconditionRequired, Code: service.CodePreconditionRequired, Message: "If-Match header is missing, send the ETag of the product or * to update any version"},
+	ErrInvalidProduct:  {Status: http.StatusBadRequest, Code: service.CodeInvalidRequest},
+}
+
+// validate checks the fields set by clients. Prices are in the minor unit of
+// the currency, e.g. cents for USD.
+func (p *product) validate() error {
+	if err := validateName(p.Name); err != nil {
+		return err
+	}
+	if err := validatePrice(p.Price); err != nil {
+		return err
+	}
+
+	return validateCurrency(p.Currency)
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return invalidProductError("name can't be empty")
 	}
 
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisHost) },
+	return nil
+}
+
+func validatePrice(price int64) error {
+	if price < 0 {
+		return invalidProductError("price can't be negative")
 	}
 
-	conn := pool.Get()
-	_, err := conn.Do("PING")
-	if err != nil {
-		log.Fatalf("FATAL: failed to ping redis: %v\n", err)
+	return nil
+}
+
+func validateCurrency(currency string) error {
+	if !isCurrencyCode(currency) {
+		return invalidProductError("currency has to be a three letter ISO 4217 code")
 	}
-	conn.Close()
 
-	log.Println("listening at http://localhost:8081")
+	return nil
+}
 
-	http.HandleFunc("/", withDB(pool, handleProducts))
-	http.ListenAndServe(":8081", nil)
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+
+	return true
 }
 
-func withDB(pool *redis.Pool, handler func(redis.Conn, http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		db := pool.Get()
-		defer db.Close()
-		handler(db, w, r)
+func main() {
+	var store ProductStore
+	if service.MemoryStorage() {
+		store = newMemoryStore()
+	} else {
+		pool := service.NewPool()
+		service.MustPing(pool)
+		redisStore := newRedisStore(pool)
+
+		// Products written before an index was added are missing from it
+		count, err := redisStore.Reindex()
+		if err != nil {
+			log.Fatalf("FATAL: failed to reindex products: %v\n", err)
+		}
+		log.Printf("reindexed %d products\n", count)
+
+		store = redisStore
 	}
+
+	log.Println("listening at http://localhost:8081")
+
+	http.HandleFunc("/", service.Chain(service.WithStore(store, handleProducts), service.WithRequestID))
+	http.HandleFunc("/categories", service.Chain(service.WithStore(store, handleCategories), service.WithRequestID))
+	http.HandleFunc("/search", service.Chain(service.WithStore(store, handleSearch), service.WithRequestID))
+	http.ListenAndServe(":8081", nil)
 }
 
-func handleProducts(db redis.Conn, w http.ResponseWriter, r *http.Request) {
+func handleProducts(store ProductStore, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		products, next, err := dbGetAllProducts(db, r.URL.Query().Get("from"), 20)
+		if id := r.URL.Query().Get("id"); id != "" {
+			product, err := store.Product(id)
+			if err != nil {
+				if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+					log.Printf("ERROR: failed to get product: %v", err)
+				}
+				return
+			}
+
+			writeProduct(w, product)
+			return
+		}
+
+		if ids := r.URL.Query().Get("ids"); ids != "" {
+			products, missing, err := store.ProductsByIDs(strings.Split(ids, ","))
+			if err != nil {
+				log.Printf("ERROR: failed to get products: %v", err)
+				service.WriteError(w, err)
+				return
+			}
+
+			if missing == nil {
+				missing = []string{}
+			}
+
+			if err := service.WriteJSON(w, http.StatusOK, struct {
+				Products []product `json:"products"`
+				Missing  []string  `json:"missing"`
+			}{products, missing}); err != nil {
+				log.Printf("ERROR: failed to encode product json: %v", err)
+			}
+			return
+		}
+
+		products, next, err := store.AllProducts(r.URL.Query().Get("category"), r.URL.Query().Get("from"), 20)
 		if err != nil {
-			if r.URL.Query().Get("from") != "" && err == redis.ErrNil {
-				w.WriteHeader(http.StatusNotFound)
+			if r.URL.Query().Get("from") != "" && err == ErrNotFound {
+				service.WriteError(w, service.NotFound("from key not found"))
 				return
 			}
 
 			log.Printf("ERROR: failed to get products: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(w, err)
 			return
 		}
 
@@ -70,53 +195,132 @@ func handleProducts(db redis.Conn, w http.ResponseWriter, r *http.Request) {
 			products = []product{}
 		}
 
-		body, err := json.Marshal(struct {
+		if err := service.WriteJSON(w, http.StatusOK, struct {
 			Products []product `json:"products"`
 			NextKey  string    `json:"next_key"`
-		}{products, next})
-		if err != nil {
+		}{products, next}); err != nil {
 			log.Printf("ERROR: failed to encode product json: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
 		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(body)
 		return
 	case http.MethodPost:
 		var payload product
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("invalid payload"))
+			service.WriteError(w, service.BadRequest("invalid payload"))
+			return
+		}
+
+		if err := payload.validate(); err != nil {
+			service.WriteError(w, errorResponses.Resolve(err))
 			return
 		}
 
 		payload.CreatedAt = time.Now().UnixNano()
 		payload.Id = strconv.FormatInt(payload.CreatedAt, 10)
+		payload.Version = 1
 
-		if err := dbInsertProduct(db, payload); err != nil {
+		if err := store.InsertProduct(payload); err != nil {
 			log.Printf("ERROR: failed to insert product: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(w, err)
 			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte(payload.Id))
 		return
-	case http.MethodDelete:
+	case http.MethodPut, http.MethodPatch:
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			w.WriteHeader(http.StatusNotFound)
+			service.WriteError(w, service.BadRequest("id parameter is missing"))
 			return
 		}
 
-		if err := dbDeleteProduct(db, id); err != nil {
-			if err == redis.ErrNil {
-				w.WriteHeader(http.StatusNotFound)
-				return
+		expectedVersion, err := parseIfMatch(r.Header.Get("If-Match"))
+		if errors.Is(err, ErrVersionRequired) {
+			service.WriteError(w, errorResponses.Resolve(err))
+			return
+		}
+		if err != nil {
+			service.WriteError(w, service.BadRequest("invalid If-Match header"))
+			return
+		}
+
+		var payload struct {
+			Name     *string `json:"name"`
+			Category *string `json:"category"`
+			Price    *int64  `json:"price"`
+			Currency *string `json:"currency"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			service.WriteError(w, service.BadRequest("invalid payload"))
+			return
+		}
+
+		// PUT replaces every field, missing fields are left empty and fail
+		// the validation
+		if r.Method == http.MethodPut {
+			var empty string
+			var zero int64
+			if payload.Name == nil {
+				payload.Name = &empty
+			}
+			if payload.Category == nil {
+				payload.Category = &empty
+			}
+			if payload.Price == nil {
+				payload.Price = &zero
+			}
+			if payload.Currency == nil {
+				payload.Currency = &empty
+			}
+		}
+
+		// Only the fields being set are validated, so products stored before a
+		// field was required can still be patched
+		product, err := store.UpdateProduct(id, expectedVersion, func(p *product) error {
+			if payload.Name != nil {
+				if err := validateName(*payload.Name); err != nil {
+					return err
+				}
+				p.Name = *payload.Name
+			}
+			if payload.Category != nil {
+				p.Category = *payload.Category
+			}
+			if payload.Price != nil {
+				if err := validatePrice(*payload.Price); err != nil {
+					return err
+				}
+				p.Price = *payload.Price
+			}
+			if payload.Currency != nil {
+				if err := validateCurrency(*payload.Currency); err != nil {
+					return err
+				}
+				p.Currency = *payload.Currency
 			}
 
-			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		})
+		if err != nil {
+			if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+				log.Printf("ERROR: failed to update product: %v\n", err)
+			}
+			return
+		}
+
+		writeProduct(w, product)
+		return
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			service.WriteError(w, service.BadRequest("id parameter is missing"))
+			return
+		}
+
+		if err := store.DeleteProduct(id); err != nil {
+			if err := service.WriteError(w, errorResponses.Resolve(err)); err != nil {
+				log.Printf("ERROR: failed to delete product: %v\n", err)
+			}
 			return
 		}
 
@@ -124,5 +328,112 @@ func handleProducts(db redis.Conn, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	service.WriteError(w, service.NotFound("no such endpoint"))
+}
+
+func handleCategories(store ProductStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	categories, err := store.Categories()
+	if err != nil {
+		log.Printf("ERROR: failed to get categories: %v", err)
+		service.WriteError(w, err)
+		return
+	}
+
+	if err := service.WriteJSON(w, http.StatusOK, struct {
+		Categories []category `json:"categories"`
+	}{categories}); err != nil {
+		log.Printf("ERROR: failed to encode category json: %v", err)
+	}
+}
+
+func handleSearch(store ProductStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		service.WriteError(w, service.NotFound("no such endpoint"))
+		return
+	}
+
+	offset := 0
+	if from := r.URL.Query().Get("from"); from != "" {
+		var err error
+		offset, err = strconv.Atoi(from)
+		if err != nil || offset < 0 {
+			service.WriteError(w, service.BadRequest("invalid from parameter"))
+			return
+		}
+	}
+
+	products, next, err := store.SearchProducts(r.URL.Query().Get("q"), r.URL.Query().Get("category"), offset, 20)
+	if err != nil {
+		log.Printf("ERROR: failed to search products: %v", err)
+		service.WriteError(w, err)
+		return
+	}
+
+	if products == nil {
+		products = []product{}
+	}
+
+	if err := service.WriteJSON(w, http.StatusOK, struct {
+		Products []product `json:"products"`
+		NextKey  string    `json:"next_key"`
+	}{products, next}); err != nil {
+		log.Printf("ERROR: failed to encode product json: %v", err)
+	}
+}
+
+// tokenize splits text into lower cased words for the search index, duplicates
+// are dropped
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+
+	seen := make(map[string]bool, len(words))
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if seen[word] {
+			continue
+		}
+
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+func writeProduct(w http.ResponseWriter, product *product) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, product.Version))
+	if err := service.WriteJSON(w, http.StatusOK, product); err != nil {
+		log.Printf("ERROR: failed to encode product json: %v", err)
+	}
+}
+
+// parseIfMatch returns the product version expected by the If-Match header,
+// anyVersion for "*". Products stored before versioning are at version zero.
+// Updates without the header are rejected with ErrVersionRequired, so a client
+// can't overwrite changes it hasn't seen by forgetting it.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	switch header {
+	case "":
+		return 0, ErrVersionRequired
+	case "*":
+		return anyVersion, nil
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if version < 0 {
+		return 0, errors.New("version can't be negative")
+	}
+
+	return version, nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func request(store ProductStore, handler func(ProductStore, http.ResponseWriter, *http.Request), method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler(store, w, r)
+	return w
+}
+
+func ifMatch(etag string) http.Header {
+	return http.Header{"If-Match": []string{etag}}
+}
+
+func createProduct(t *testing.T, store ProductStore, body string) string {
+	t.Helper()
+
+	w := request(store, handleProducts, http.MethodPost, "/", body, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestProductETag(t *testing.T) {
+	store := newMemoryStore()
+	id := createProduct(t, store, `{"name":"Red shoe","price":1000,"currency":"USD"}`)
+
+	w := request(store, handleProducts, http.MethodGet, "/?id="+id, "", nil)
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Fatalf("got ETag %s of a new product, want \"1\"", etag)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id="+id, `{"price":1200}`, ifMatch(`"1"`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("updating: got status %d: %s", w.Code, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("got ETag %s after the update, want \"2\"", etag)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id="+id, `{"price":1300}`, ifMatch(`"1"`))
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("updating a stale version: got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id="+id, `{"price":1300}`, nil)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("updating without If-Match: got status %d, want %d", w.Code, http.StatusPreconditionRequired)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id="+id, `{"price":1400}`, ifMatch("*"))
+	if w.Code != http.StatusOK {
+		t.Errorf("updating any version: got status %d: %s", w.Code, w.Body)
+	}
+
+	p, _ := store.Product(id)
+	if p.Price != 1400 || p.Version != 3 {
+		t.Errorf("got product %+v, want it at version 3 with a price of 1400", p)
+	}
+}
+
+func TestProductETagLegacy(t *testing.T) {
+	store := newMemoryStore()
+	// products stored before versioning have no version
+	store.InsertProduct(product{Id: "1", Name: "Old hat", Price: 500, Currency: "USD"})
+
+	w := request(store, handleProducts, http.MethodGet, "/?id=1", "", nil)
+	if etag := w.Header().Get("ETag"); etag != `"0"` {
+		t.Fatalf("got ETag %s of a legacy product, want \"0\"", etag)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id=1", `{"price":600}`, ifMatch(`"0"`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("updating: got status %d: %s", w.Code, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("got ETag %s after the update, want \"1\"", etag)
+	}
+}
+
+func TestProductPatchLegacy(t *testing.T) {
+	store := newMemoryStore()
+	// products stored before prices had no currency
+	store.InsertProduct(product{Id: "1", Name: "Old hat"})
+
+	w := request(store, handleProducts, http.MethodPatch, "/?id=1", `{"name":"Old red hat"}`, ifMatch("*"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("patching the name: got status %d: %s", w.Code, w.Body)
+	}
+
+	w = request(store, handleProducts, http.MethodPatch, "/?id=1", `{"price":-1}`, ifMatch("*"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("patching an invalid price: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// replacing the product needs every field
+	w = request(store, handleProducts, http.MethodPut, "/?id=1", `{"name":"Hat","price":100}`, ifMatch("*"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("putting without a currency: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if p, _ := store.Product("1"); p.Name != "Old red hat" || p.Price != 0 {
+		t.Errorf("got product %+v, want only the name patched", p)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	store := newMemoryStore()
+	createProduct(t, store, `{"name":"Red shoe","category":"shoes","price":1000,"currency":"USD"}`)
+	createProduct(t, store, `{"name":"Redwood table","category":"furniture","price":9000,"currency":"USD"}`)
+	createProduct(t, store, `{"name":"Blue shoe","category":"shoes","price":1000,"currency":"USD"}`)
+
+	search := func(target string) []string {
+		t.Helper()
+
+		w := request(store, handleSearch, http.MethodGet, target, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+
+		var res struct {
+			Products []product `json:"products"`
+		}
+		json.NewDecoder(w.Body).Decode(&res)
+
+		names := []string{}
+		for _, p := range res.Products {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	// an exact match ranks above a prefix match
+	if names := search("/search?q=red"); strings.Join(names, ",") != "Red shoe,Redwood table" {
+		t.Errorf("got %v, want the red shoe before the redwood table", names)
+	}
+	if names := search("/search?q=red+shoe"); len(names) != 3 || names[0] != "Red shoe" {
+		t.Errorf("got %v, want the red shoe first of all three", names)
+	}
+	if names := search("/search?q=shoe&category=furniture"); len(names) != 0 {
+		t.Errorf("got %v in furniture, want nothing", names)
+	}
+	if names := search("/search?q=re&category=shoes"); strings.Join(names, ",") != "Red shoe" {
+		t.Errorf("got %v in shoes, want the red shoe", names)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryStore is a ProductStore which keeps everything in memory, it is used
+// for tests and running the service without Redis
+type memoryStore struct {
+	mu       sync.RWMutex
+	products map[string]product
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{products: make(map[string]product)}
+}
+
+func (s *memoryStore) AllProducts(category, startFrom string, maxItems int) ([]product, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var before int64
+	if startFrom != "" {
+		var err error
+		before, err = strconv.ParseInt(startFrom, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var products []product
+	for _, p := range s.sortedProducts() {
+		if len(products) == maxItems {
+			break
+		}
+		if startFrom != "" && p.CreatedAt >= before {
+			continue
+		}
+		if category != "" && p.Category != category {
+			continue
+		}
+
+		products = append(products, p)
+	}
+
+	if len(products) == 0 {
+		return nil, "", nil
+	}
+
+	nextKey := strconv.FormatInt(products[len(products)-1].CreatedAt, 10)
+	return products, nextKey, nil
+}
+
+func (s *memoryStore) Product(productID string) (*product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.products[productID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &p, nil
+}
+
+func (s *memoryStore) ProductsByIDs(productIDs []string) ([]product, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := make([]product, 0, len(productIDs))
+	missing := make([]string, 0)
+	for _, id := range productIDs {
+		p, ok := s.products[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+
+		products = append(products, p)
+	}
+
+	return products, missing, nil
+}
+
+func (s *memoryStore) InsertProduct(product product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.products[product.Id] = product
+	return nil
+}
+
+func (s *memoryStore) UpdateProduct(productID string, expectedVersion int64, update func(*product) error) (*product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.products[productID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if expectedVersion != anyVersion && p.Version != expectedVersion {
+		return nil, ErrVersionMismatch
+	}
+
+	if err := update(&p); err != nil {
+		return nil, err
+	}
+	p.Version++
+
+	s.products[productID] = p
+	return &p, nil
+}
+
+func (s *memoryStore) DeleteProduct(productID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.products[productID]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.products, productID)
+	return nil
+}
+
+func (s *memoryStore) Categories() ([]category, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, p := range s.products {
+		if p.Category != "" {
+			counts[p.Category]++
+		}
+	}
+
+	categories := make([]category, 0, len(counts))
+	for name, count := range counts {
+		categories = append(categories, category{name, count})
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Name < categories[j].Name })
+
+	return categories, nil
+}
+
+// SearchProducts scores the products the same way the Redis index does, an
+// exact token match is worth 2, a prefix match 1 and the best match of every
+// query token is summed up
+func (s *memoryStore) SearchProducts(query, category string, offset, maxItems int) ([]product, string, error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, "", nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type match struct {
+		product product
+		score   int
+	}
+
+	var matches []match
+	for _, p := range s.sortedProducts() {
+		if category != "" && p.Category != category {
+			continue
+		}
+
+		score := 0
+		nameTokens := tokenize(p.Name)
+		for _, token := range tokens {
+			best := 0
+			for _, nameToken := range nameTokens {
+				if nameToken == token {
+					best = 2
+					break
+				}
+				if strings.HasPrefix(nameToken, token) {
+					best = 1
+				}
+			}
+
+			score += best
+		}
+
+		if score > 0 {
+			matches = append(matches, match{p, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	var products []product
+	for i := offset; i < len(matches) && i < offset+maxItems; i++ {
+		products = append(products, matches[i].product)
+	}
+
+	nextKey := ""
+	if offset+maxItems < len(matches) {
+		nextKey = strconv.Itoa(offset + maxItems)
+	}
+
+	return products, nextKey, nil
+}
+
+// sortedProducts returns the products newest first, callers must hold the lock
+func (s *memoryStore) sortedProducts() []product {
+	products := make([]product, 0, len(s.products))
+	for _, p := range s.products {
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].CreatedAt > products[j].CreatedAt })
+
+	return products
+}
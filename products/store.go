@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+)
+
+// ProductStore keeps the product catalogue. Methods return ErrNotFound when
+// the product doesn't exist.
+type ProductStore interface {
+	AllProducts(category, startFrom string, maxItems int) ([]product, string, error)
+	Product(productID string) (*product, error)
+	// ProductsByIDs returns the existing products and the ids which are missing
+	ProductsByIDs(productIDs []string) ([]product, []string, error)
+	InsertProduct(product product) error
+	UpdateProduct(productID string, expectedVersion int64, update func(*product) error) (*product, error)
+	DeleteProduct(productID string) error
+	Categories() ([]category, error)
+	SearchProducts(query, category string, offset, maxItems int) ([]product, string, error)
+}
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+func newRedisStore(pool *redis.Pool) *redisStore {
+	return &redisStore{pool}
+}
+
+// Reindex rebuilds the product lists and the search index from the stored
+// products and returns the number of products
+func (s *redisStore) Reindex() (int, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbReindexProducts(db)
+}
+
+func (s *redisStore) AllProducts(category, startFrom string, maxItems int) ([]product, string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetAllProducts(db, category, startFrom, maxItems)
+}
+
+func (s *redisStore) Product(productID string) (*product, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	p, err := dbGetProduct(db, productID)
+	return p, notFound(err)
+}
+
+func (s *redisStore) ProductsByIDs(productIDs []string) ([]product, []string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetProductsByIDs(db, productIDs)
+}
+
+func (s *redisStore) InsertProduct(product product) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbInsertProduct(db, product)
+}
+
+func (s *redisStore) UpdateProduct(productID string, expectedVersion int64, update func(*product) error) (*product, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	p, err := dbUpdateProduct(db, productID, expectedVersion, update)
+	return p, notFound(err)
+}
+
+func (s *redisStore) DeleteProduct(productID string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return notFound(dbDeleteProduct(db, productID))
+}
+
+func (s *redisStore) Categories() ([]category, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetCategories(db)
+}
+
+func (s *redisStore) SearchProducts(query, category string, offset, maxItems int) ([]product, string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbSearchProducts(db, query, category, offset, maxItems)
+}
+
+// notFound translates the missing key error of redigo to ErrNotFound
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+
+	return err
+}
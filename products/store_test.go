@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// eachStore runs test against the memory store and the Redis at REDIS_HOST, the
+// Redis run is skipped without one. tag is unique to the run, products are
+// given ids, categories and names with it so runs don't see each other's
+// products.
+func eachStore(t *testing.T, test func(t *testing.T, store ProductStore, tag string)) {
+	tag := fmt.Sprintf("t%d", time.Now().UnixNano())
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(), tag)
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, newRedisStore(redisPool(t)), tag)
+	})
+}
+
+// redisPool returns a pool of the Redis at REDIS_HOST, the test is skipped
+// without one
+func redisPool(t *testing.T) *redis.Pool {
+	t.Helper()
+
+	pool := service.NewPool()
+	t.Cleanup(func() { pool.Close() })
+
+	db := pool.Get()
+	_, err := db.Do("PING")
+	db.Close()
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	return pool
+}
+
+func names(products []product) string {
+	names := []string{}
+	for _, p := range products {
+		names = append(names, p.Name)
+	}
+	return fmt.Sprint(names)
+}
+
+func TestStoreUpdateProduct(t *testing.T) {
+	eachStore(t, func(t *testing.T, store ProductStore, tag string) {
+		shoes, boots := tag+"-shoes", tag+"-boots"
+		store.InsertProduct(product{Id: tag, Name: "Red " + tag, Category: shoes, CreatedAt: 1, Price: 100, Currency: "USD", Version: 1})
+
+		// concurrent updates of the same version can't both succeed
+		var wg sync.WaitGroup
+		errs := make([]error, 5)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = store.UpdateProduct(tag, 1, func(p *product) error {
+					p.Price += 10
+					return nil
+				})
+			}(i)
+		}
+		wg.Wait()
+
+		updated := 0
+		for _, err := range errs {
+			if err == nil {
+				updated++
+			} else if err != ErrVersionMismatch {
+				t.Fatal(err)
+			}
+		}
+		if p, _ := store.Product(tag); updated != 1 || p.Price != 110 || p.Version != 2 {
+			t.Errorf("got %+v after %d updates, want a single update to version 2", p, updated)
+		}
+
+		// the lists and the search index follow the category and the name
+		_, err := store.UpdateProduct(tag, anyVersion, func(p *product) error {
+			p.Category, p.Name = boots, "Blue "+tag
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if products, _, _ := store.AllProducts(shoes, "", 10); len(products) != 0 {
+			t.Errorf("got %s in the old category, want nothing", names(products))
+		}
+		if products, _, _ := store.AllProducts(boots, "", 10); names(products) != "[Blue "+tag+"]" {
+			t.Errorf("got %s in the new category, want the product", names(products))
+		}
+		categories, _ := store.Categories()
+		for _, c := range categories {
+			if c.Name == shoes || (c.Name == boots && c.Count != 1) {
+				t.Errorf("got category %+v, want only %s with one product", c, boots)
+			}
+		}
+		if products, _, _ := store.SearchProducts("red", boots, 0, 10); len(products) != 0 {
+			t.Errorf("searching the old name: got %s, want nothing", names(products))
+		}
+		if products, _, _ := store.SearchProducts("blue", boots, 0, 10); len(products) != 1 {
+			t.Errorf("searching the new name: got %s, want the product", names(products))
+		}
+
+		if _, err := store.UpdateProduct(tag+"-missing", anyVersion, func(p *product) error { return nil }); err != ErrNotFound {
+			t.Errorf("updating a missing product: got %v, want %v", err, ErrNotFound)
+		}
+	})
+}
+
+func TestStoreDeleteProduct(t *testing.T) {
+	eachStore(t, func(t *testing.T, store ProductStore, tag string) {
+		category := tag + "-hats"
+		store.InsertProduct(product{Id: tag + "-1", Name: "Old hat", Category: category, CreatedAt: 1})
+		store.InsertProduct(product{Id: tag + "-2", Name: "New hat", Category: category, CreatedAt: 2})
+
+		products, missing, err := store.ProductsByIDs([]string{tag + "-1", tag + "-3", tag + "-2"})
+		if err != nil || names(products) != "[Old hat New hat]" || fmt.Sprint(missing) != "["+tag+"-3]" {
+			t.Errorf("got %s missing %v, %v, want both hats and the third missing", names(products), missing, err)
+		}
+
+		if err := store.DeleteProduct(tag + "-2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteProduct(tag + "-2"); err != ErrNotFound {
+			t.Errorf("deleting again: got %v, want %v", err, ErrNotFound)
+		}
+
+		if products, _, _ := store.AllProducts(category, "", 10); names(products) != "[Old hat]" {
+			t.Errorf("got %s in the category, want the old hat", names(products))
+		}
+		if products, _, _ := store.SearchProducts("hat", category, 0, 10); names(products) != "[Old hat]" {
+			t.Errorf("searching: got %s, want the old hat", names(products))
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// Levels of the alerts
+const (
+	alertLowStock   = "low_stock"
+	alertOutOfStock = "out_of_stock"
+)
+
+// The alerts stream is trimmed to about this many alerts
+const maxAlerts = 10000
+
+// Alerts are read from the store in batches, waiting this long for new ones
+const alertBatchSize = 10
+const alertBlock = 5 * time.Second
+
+// A webhook is tried this many times, waiting twice as long after every
+// failed attempt
+const alertWebhookAttempts = 5
+const alertRetryDelay = time.Second
+const alertWebhookTimeout = 10 * time.Second
+
+// alert is emitted when the total stock of a product drops below its threshold
+// or runs out
+type alert struct {
+	Id        string `json:"id" redis:"-"`
+	ProductID string `json:"product_id"`
+	Level     string `json:"level"`
+	Quantity  int64  `json:"quantity"`
+	Threshold int64  `json:"threshold"`
+	At        int64  `json:"at"`
+}
+
+// nextAlertState returns the alert state of a product after its total stock
+// changed from before to after, and whether an alert has to be emitted for the
+// new state. The state is the level of the last alert, an alert is emitted
+// once when the stock drops to a level and again only after the stock went
+// back above the threshold, so a product going up and down below its threshold
+// doesn't emit alerts for every change. stockScript does the same in Lua.
+func nextAlertState(state string, before, after, threshold int64) (string, bool) {
+	level := ""
+	switch {
+	case after <= 0:
+		level = alertOutOfStock
+	case after < threshold:
+		level = alertLowStock
+	}
+
+	switch {
+	case level == "":
+		return "", false
+	case state == alertOutOfStock && level == alertLowStock:
+		// restocked but still below the threshold, running out again is
+		// reported
+		return level, false
+	case level == state || after >= before:
+		return state, false
+	}
+
+	return level, true
+}
+
+// alertWebhooks reads the URLs the alerts are POSTed to from
+// STOCK_ALERT_WEBHOOKS as a comma separated list
+func alertWebhooks() []string {
+	var webhooks []string
+	for _, url := range strings.Split(service.Env("STOCK_ALERT_WEBHOOKS", ""), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			webhooks = append(webhooks, url)
+		}
+	}
+
+	return webhooks
+}
+
+// notifyAlerts POSTs every alert to each of the webhooks. An alert is
+// acknowledged once it was delivered or its delivery failed after all the
+// attempts, so a broken webhook doesn't stop the others.
+func notifyAlerts(store StockStore, webhooks []string) {
+	client := &http.Client{Timeout: alertWebhookTimeout}
+	for {
+		alerts, err := store.PendingAlerts(alertBatchSize, alertBlock)
+		if err != nil {
+			log.Printf("ERROR: failed to read alerts: %v\n", err)
+			time.Sleep(alertRetryDelay)
+			continue
+		}
+
+		for _, a := range alerts {
+			for _, url := range webhooks {
+				if err := postAlert(client, url, a); err != nil {
+					log.Printf("ERROR: failed to deliver alert '%s' to %s: %v\n", a.Id, url, err)
+				}
+			}
+
+			if err := store.AckAlert(a.Id); err != nil {
+				log.Printf("ERROR: failed to acknowledge alert '%s': %v\n", a.Id, err)
+			}
+		}
+	}
+}
+
+// postAlert delivers the alert to the webhook. The id of the alert is sent as
+// the idempotency key, so receivers can drop the alerts delivered twice when a
+// response was lost.
+func postAlert(client *http.Client, url string, a alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	delay := alertRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = sendAlert(client, url, a.Id, body)
+		if err == nil || attempt == alertWebhookAttempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func sendAlert(client *http.Client, url, id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(service.IdempotencyKeyHeader, id)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return nil
+}
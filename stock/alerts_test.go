@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNextAlertState(t *testing.T) {
+	for _, test := range []struct {
+		state     string
+		before    int64
+		after     int64
+		threshold int64
+		next      string
+		emit      bool
+	}{
+		{"", 10, 6, 5, "", false},
+		{"", 6, 4, 5, alertLowStock, true},
+		{alertLowStock, 4, 3, 5, alertLowStock, false},
+		{alertLowStock, 3, 0, 5, alertOutOfStock, true},
+		{"", 3, 0, 0, alertOutOfStock, true},
+		// restocked but still low, the state goes back to low without an alert
+		{alertOutOfStock, 0, 2, 5, alertLowStock, false},
+		{alertLowStock, 2, 0, 5, alertOutOfStock, true},
+		{alertLowStock, 2, 3, 5, alertLowStock, false},
+		{alertLowStock, 4, 5, 5, "", false},
+	} {
+		next, emit := nextAlertState(test.state, test.before, test.after, test.threshold)
+		if next != test.next || emit != test.emit {
+			t.Errorf("%q from %d to %d below %d: got %q, %v, want %q, %v", test.state, test.before, test.after, test.threshold, next, emit, test.next, test.emit)
+		}
+	}
+}
+
+// pendingAlerts reads and acknowledges every pending alert and returns the ones
+// of the product
+func pendingAlerts(t *testing.T, store StockStore, productID string) []alert {
+	t.Helper()
+
+	var alerts []alert
+	for {
+		pending, err := store.PendingAlerts(100, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			return alerts
+		}
+
+		for _, a := range pending {
+			if a.ProductID == productID {
+				alerts = append(alerts, a)
+			}
+			if err := store.AckAlert(a.Id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestStoreAlerts(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		if err := store.SetThreshold(productID, 5); err != nil {
+			t.Fatal(err)
+		}
+		if threshold, err := store.Threshold(productID); err != nil || threshold != 5 {
+			t.Fatalf("got threshold %d, %v, want 5", threshold, err)
+		}
+
+		// alerts from before the test aren't of interest
+		pendingAlerts(t, store, productID)
+
+		m := movement{Reason: reasonDrop}
+		store.IncrQuantity(productID, "front", 8, m)
+		for _, change := range []int64{-4, -1, -3, 2, -2, 10, -6} {
+			var err error
+			if change > 0 {
+				err = store.IncrQuantity(productID, "front", change, m)
+			} else {
+				_, err = store.Drop(productID, -change, strategyPriority, m)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		levels := []string{}
+		for _, a := range pendingAlerts(t, store, productID) {
+			levels = append(levels, fmt.Sprintf("%s:%d", a.Level, a.Quantity))
+			if a.Threshold != 5 {
+				t.Errorf("got alert %+v, want it with the threshold", a)
+			}
+		}
+		want := []string{"low_stock:4", "out_of_stock:0", "out_of_stock:0", "low_stock:4"}
+		if fmt.Sprint(levels) != fmt.Sprint(want) {
+			t.Errorf("got alerts %v, want %v", levels, want)
+		}
+
+		// acknowledged alerts aren't delivered again
+		if alerts := pendingAlerts(t, store, productID); len(alerts) != 0 {
+			t.Errorf("got alerts %+v after acknowledging them", alerts)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// backorderMode tells whether a product takes reservations it has no stock
+// for. Reservations which can't be covered wait in the queue of the product
+// and take the stock in the order they were made when it is put, the modes
+// only differ in what they tell the customers.
+type backorderMode string
+
+const (
+	// backorderAllowed takes reservations for a product which ran out until
+	// it is restocked
+	backorderAllowed backorderMode = "backorder"
+	// backorderPreorder takes reservations for a product before its stock
+	// arrives
+	backorderPreorder backorderMode = "preorder"
+)
+
+// Fulfilled backorders are kept this long so their holders can find out
+const fulfilledBackorderTTL = 7 * 24 * time.Hour
+
+// backorderPolicy lets a product take reservations beyond its stock while at
+// most Cap units are waiting. Backordered is the quantity waiting, it isn't
+// set by clients.
+type backorderPolicy struct {
+	Mode        backorderMode `json:"mode"`
+	Cap         int64         `json:"cap"`
+	Backordered int64         `json:"backordered" redis:"-"`
+}
+
+func parseBackorderMode(name string) (backorderMode, error) {
+	switch mode := backorderMode(name); mode {
+	case "", backorderAllowed, backorderPreorder:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown backorder mode '%s'", name)
+}
+
+// accepts tells whether quantity more can be backordered
+func (p *backorderPolicy) accepts(quantity int64) bool {
+	return p.Mode != "" && p.Backordered+quantity <= p.Cap
+}
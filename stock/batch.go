@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Maximum number of lines accepted by /batch
+const maxBatchLines = 100
+
+type batchOp string
+
+const (
+	batchPut  batchOp = "put"
+	batchDrop batchOp = "drop"
+)
+
+// batchLine is a single put or drop of /batch. Puts without a location go to
+// the default location, drops without one pick the locations with the
+// strategy of the batch.
+type batchLine struct {
+	ProductID string  `json:"product_id"`
+	Op        batchOp `json:"op"`
+	Quantity  int64   `json:"quantity"`
+	Location  string  `json:"location,omitempty"`
+}
+
+// lineError tells why a line of a batch failed, Available is the stock the
+// line could have used
+type lineError struct {
+	Line      int    `json:"line"`
+	ProductID string `json:"product_id"`
+	Message   string `json:"message"`
+	Requested int64  `json:"requested,omitempty"`
+	Available *int64 `json:"available,omitempty"`
+}
+
+// batchError is returned when some lines of a batch can't be applied, none of
+// the lines are applied then
+type batchError struct {
+	Lines []lineError
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%d lines of the batch can't be applied", len(e.Lines))
+}
+
+func (e *batchError) Is(target error) bool {
+	return target == ErrInsufficientAmount
+}
+
+// validateBatch checks the lines before anything is read from the storage
+func validateBatch(lines []batchLine) []lineError {
+	var errs []lineError
+	for i, line := range lines {
+		message := ""
+		switch {
+		case line.ProductID == "":
+			message = "product_id is missing"
+		case line.Op != batchPut && line.Op != batchDrop:
+			message = fmt.Sprintf("unknown op '%s'", line.Op)
+		case line.Quantity <= 0:
+			message = "quantity has to be a positive number greater than zero"
+		case line.Location != "" && !isLocation(line.Location):
+			message = fmt.Sprintf("unknown location '%s'", line.Location)
+		}
+
+		if message != "" {
+			errs = append(errs, lineError{Line: i, ProductID: line.ProductID, Message: message})
+		}
+	}
+
+	return errs
+}
+
+func batchProductIDs(lines []batchLine) []string {
+	seen := make(map[string]bool, len(lines))
+	var productIDs []string
+	for _, line := range lines {
+		if !seen[line.ProductID] {
+			seen[line.ProductID] = true
+			productIDs = append(productIDs, line.ProductID)
+		}
+	}
+
+	return productIDs
+}
+
+// planBatch returns the changes of the batch by product id, and what each line
+// put or took per location. Lines are applied in order, so a line sees the
+// stock left by the lines before it. If any line can't be applied a
+// *batchError listing all of them is returned.
+func planBatch(stocks map[string]allocation, lines []batchLine, strategy dropStrategy) (map[string]allocation, []allocation, error) {
+	remaining := make(map[string]allocation, len(stocks))
+	for productID, stock := range stocks {
+		remaining[productID] = allocation{}
+		for location, quantity := range stock {
+			remaining[productID][location] = quantity
+		}
+	}
+
+	changes := make(map[string]allocation)
+	taken := make([]allocation, len(lines))
+	var errs []lineError
+	for i, line := range lines {
+		stock := remaining[line.ProductID]
+
+		var change allocation
+		var available int64
+		switch {
+		case line.Op == batchPut:
+			location := line.Location
+			if location == "" {
+				location = defaultLocation()
+			}
+			change = allocation{location: line.Quantity}
+		case line.Location != "":
+			available = stock[line.Location]
+			if available >= line.Quantity {
+				change = allocation{line.Location: -line.Quantity}
+			}
+		default:
+			available = stock.total()
+			change, _ = planDrop(stock, line.Quantity, strategy)
+		}
+
+		if change == nil {
+			errs = append(errs, lineError{
+				Line:      i,
+				ProductID: line.ProductID,
+				Message:   "insufficient quantity",
+				Requested: line.Quantity,
+				Available: &available,
+			})
+			continue
+		}
+
+		if changes[line.ProductID] == nil {
+			changes[line.ProductID] = allocation{}
+		}
+		for location, delta := range change {
+			stock[location] += delta
+			changes[line.ProductID][location] += delta
+		}
+		taken[i] = change
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, &batchError{errs}
+	}
+
+	return changes, taken, nil
+}
+
+// reservationLine is a single reservation of /reserve/batch
+type reservationLine struct {
+	ProductID string `json:"product_id"`
+	Quantity  int64  `json:"quantity"`
+}
+
+// reserveAll makes the reservations in order. If one of them can't be made the
+// ones made before it are released, so either all of them hold their stock or
+// none. A reservation failing for the lack of stock is reported as the line of
+// a *batchError.
+func reserveAll(store StockStore, reservations []reservation, strategy dropStrategy, backorder bool) ([]*reservation, error) {
+	reserved := make([]*reservation, 0, len(reservations))
+	for i, res := range reservations {
+		made, err := store.Reserve(res, strategy, backorder)
+		if err == nil {
+			reserved = append(reserved, made)
+			continue
+		}
+
+		for _, made := range reserved {
+			if err := store.ReleaseReservation(made.Id, reasonRelease); err != nil {
+				log.Printf("ERROR: failed to release reservation '%s': %v\n", made.Id, err)
+			}
+		}
+
+		if errors.Is(err, ErrInsufficientAmount) {
+			return nil, &batchError{[]lineError{{Line: i, ProductID: res.ProductID, Message: "insufficient quantity", Requested: res.Quantity}}}
+		}
+		return nil, err
+	}
+
+	return reserved, nil
+}
+
+// commitAll commits the reservations in order. If one of them can't be
+// committed the ones committed before it are reverted and the rest are
+// released, so the stock of all of them is either taken or returned. It fails
+// with ErrNotFound when one of them expired or was already settled.
+func commitAll(store StockStore, reservationIDs []string) error {
+	// the reservations are read first, committing removes them and their
+	// locations are needed to revert them
+	reservations := make([]*reservation, len(reservationIDs))
+	for i, reservationID := range reservationIDs {
+		res, err := store.Reservation(reservationID)
+		if err != nil {
+			releaseAll(store, reservationIDs)
+			return err
+		}
+		reservations[i] = res
+	}
+
+	for i, res := range reservations {
+		err := store.CommitReservation(res.Id)
+		if err == nil {
+			continue
+		}
+
+		for _, committed := range reservations[:i] {
+			revertCommit(store, committed)
+		}
+		releaseAll(store, reservationIDs[i+1:])
+
+		return err
+	}
+
+	return nil
+}
+
+// revertCommit returns the stock a committed reservation took, a committed
+// backorder is removed from the queue instead
+func revertCommit(store StockStore, res *reservation) {
+	if res.Backordered {
+		if err := store.ReleaseReservation(res.Id, reasonRevert); err != nil {
+			log.Printf("CRITICAL: backorder '%s' couldn't be released: %v\n", res.Id, err)
+		}
+		return
+	}
+
+	taken := res.taken()
+	lines := make([]batchLine, 0, len(taken))
+	for _, location := range taken.sortedLocations() {
+		lines = append(lines, batchLine{ProductID: res.ProductID, Op: batchPut, Quantity: taken[location], Location: location})
+	}
+
+	if _, err := store.Batch(lines, defaultDropStrategy, res.movement(reasonRevert)); err != nil {
+		log.Printf("CRITICAL: product '%s' of reservation '%s', stock couldn't updated: %v\n", res.ProductID, res.Id, err)
+	}
+}
+
+func releaseAll(store StockStore, reservationIDs []string) {
+	for _, reservationID := range reservationIDs {
+		err := store.ReleaseReservation(reservationID, reasonRelease)
+		if err != nil && err != ErrNotFound {
+			log.Printf("ERROR: failed to release reservation '%s': %v\n", reservationID, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// BenchmarkDrop measures concurrent drops of a single unit on one product,
+// which is the worst case for contention. Drops run through the write workers
+// of the store and through stockScript directly. It needs the Redis at
+// REDIS_HOST and is skipped without one.
+func BenchmarkDrop(b *testing.B) {
+	if err := loadLocations(); err != nil {
+		b.Fatal(err)
+	}
+
+	pool := service.NewPool()
+	pool.MaxIdle = 64
+	defer pool.Close()
+
+	db := pool.Get()
+	_, err := db.Do("PING")
+	db.Close()
+	if err != nil {
+		b.Skipf("redis is not available: %v", err)
+	}
+
+	store := newRedisStore(pool, 16)
+
+	for _, mode := range []struct {
+		name string
+		drop func(db redis.Conn, productID string) error
+	}{
+		{"workers", func(db redis.Conn, productID string) error {
+			_, err := store.Drop(productID, 1, strategyPriority, movement{Reason: reasonDrop, Source: "bench"})
+			return err
+		}},
+		{"script", func(db redis.Conn, productID string) error {
+			_, err := dbDrop(db, productID, 1, strategyPriority, movement{Reason: reasonDrop, Source: "bench"})
+			return err
+		}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			benchmarkDrop(b, store, pool, mode.drop)
+		})
+	}
+}
+
+func benchmarkDrop(b *testing.B, store *redisStore, pool *redis.Pool, drop func(redis.Conn, string) error) {
+	productID := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+
+	db := pool.Get()
+	defer db.Close()
+	defer db.Do("DEL", "stock:"+productID, locationsKey(productID), historyKey(productID))
+
+	if err := store.IncrQuantity(productID, defaultLocation(), int64(b.N), movement{Reason: reasonPut, Source: "bench"}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		db := pool.Get()
+		defer db.Close()
+
+		for pb.Next() {
+			if err := drop(db, productID); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	left, err := dbGetLocations(db, productID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if left.total() != 0 {
+		b.Fatalf("%d units left after %d drops", left.total(), b.N)
+	}
+}
@@ -2,55 +2,637 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
-func dbIncrQuantity(db redis.Conn, productID string, amount int64) (err error) {
-	defer func() {
+// dbApplyStock runs the operations of the request with stockScript, which
+// checks the quantities and applies the changes in a single round trip. Every
+// changed location is recorded in the ledger by the script as well. It fails
+// with ErrInsufficientAmount if any operation would take a quantity below
+// zero.
+func dbApplyStock(db redis.Conn, req *stockRequest) ([]allocation, error) {
+	res, err := dbRunStockScript(db, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Errors) > 0 {
+		return nil, ErrInsufficientAmount
+	}
+
+	return res.Changes, nil
+}
+
+func dbDrop(db redis.Conn, productID string, amount int64, strategy dropStrategy, m movement) (allocation, error) {
+	req := stockRequest{Strategy: strategy, Movement: m}
+	req.drop(productID, amount)
+	changes, err := dbApplyStock(db, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes[0], nil
+}
+
+// dbReturn adds the quantities of the allocation back to the stock, it is
+// used to undo drops
+func dbReturn(db redis.Conn, productID string, taken allocation, m movement) error {
+	req := stockRequest{Movement: m}
+	for _, location := range taken.sortedLocations() {
+		req.add(productID, location, taken[location])
+	}
+	if len(req.Ops) == 0 {
+		return nil
+	}
+
+	_, err := dbApplyStock(db, &req)
+	return err
+}
+
+func dbTransfer(db redis.Conn, productID, from, to string, amount int64, m movement) error {
+	req := stockRequest{Movement: m}
+	req.add(productID, from, -amount)
+	req.add(productID, to, amount)
+	_, err := dbApplyStock(db, &req)
+	return err
+}
+
+// dbApplyQuantityOps writes the ops queued by a worker with a single partial
+// run of stockScript, every op is recorded in the ledger with its own movement.
+// It returns the error of each op, the taken allocation of the ops which were
+// applied is set.
+func dbApplyQuantityOps(db redis.Conn, ops []*quantityOp) []error {
+	req := stockRequest{Partial: true}
+	for _, op := range ops {
+		m := op.m
+		if op.location == "" {
+			req.drop(op.product, -op.amount)
+		} else {
+			req.add(op.product, op.location, op.amount)
+		}
+
+		last := &req.Ops[len(req.Ops)-1]
+		last.Strategy = op.strategy
+		last.Movement = &m
+	}
+
+	errs := make([]error, len(ops))
+	res, err := dbRunStockScript(db, &req)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for _, opErr := range res.Errors {
+		errs[opErr.Op] = ErrInsufficientAmount
+	}
+	for i, op := range ops {
+		if errs[i] == nil {
+			op.taken = res.Changes[i]
+		}
+	}
+
+	return errs
+}
+
+// dbGetLocations returns the stock of the product per location, it fails with
+// redis.ErrNil if the product has never been stocked. Stock which was put
+// before there were locations only exists in stock:<productID>, it is counted
+// in the default location.
+func dbGetLocations(db redis.Conn, productID string) (allocation, error) {
+	db.Send("HGETALL", locationsKey(productID))
+	db.Send("GET", fmt.Sprintf("stock:%s", productID))
+	db.Flush()
+
+	values, err := redis.Int64Map(db.Receive())
+	if err != nil {
+		db.Receive()
+		return nil, err
+	}
+
+	stock := allocation(values)
+	total, err := redis.Int64(db.Receive())
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if err == redis.ErrNil && len(stock) == 0 {
+		return stock, redis.ErrNil
+	}
+
+	if len(stock) == 0 && total > 0 {
+		stock[defaultLocation()] = total
+	}
+
+	return stock, nil
+}
+
+// dbBatch runs the lines as the operations of a single script, so a line sees
+// the stock left by the lines before it and either all of them are applied or
+// none
+func dbBatch(db redis.Conn, lines []batchLine, strategy dropStrategy, m movement) ([]allocation, error) {
+	req := stockRequest{Strategy: strategy, Movement: m}
+	for _, line := range lines {
+		switch {
+		case line.Op == batchPut && line.Location == "":
+			req.add(line.ProductID, defaultLocation(), line.Quantity)
+		case line.Op == batchPut:
+			req.add(line.ProductID, line.Location, line.Quantity)
+		case line.Location != "":
+			req.add(line.ProductID, line.Location, -line.Quantity)
+		default:
+			req.drop(line.ProductID, line.Quantity)
+		}
+	}
+
+	res, err := dbRunStockScript(db, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Errors) > 0 {
+		errs := make([]lineError, len(res.Errors))
+		for i, opErr := range res.Errors {
+			line := lines[opErr.Op]
+			available := opErr.Available
+			errs[i] = lineError{
+				Line:      opErr.Op,
+				ProductID: line.ProductID,
+				Message:   "insufficient quantity",
+				Requested: line.Quantity,
+				Available: &available,
+			}
+		}
+
+		return nil, &batchError{errs}
+	}
+
+	return res.Changes, nil
+}
+
+func locationsKey(productID string) string {
+	return fmt.Sprintf("stock:%s:locations", productID)
+}
+
+func reservationKey(reservationID string) string {
+	return fmt.Sprintf("reservations:%s", reservationID)
+}
+
+// dbReserve takes the quantity from the stock for a new reservation. If there
+// isn't enough and backorder is set, the reservation is queued as a backorder
+// when the policy of the product has room for it. A backorder waits behind the
+// ones already waiting even if there is stock for it.
+func dbReserve(db redis.Conn, res reservation, strategy dropStrategy, backorder bool) (*reservation, error) {
+	productID := res.ProductID
+
+	queued := 0
+	if backorder {
+		var err error
+		queued, err = redis.Int(db.Do("LLEN", backorderQueueKey(productID)))
 		if err != nil {
-			db.Do("DISCARD")
+			return nil, err
 		}
-	}()
+	}
+
+	if queued == 0 {
+		// the stock is taken and the reservation stored by the same script,
+		// so there can't be one without the other
+		req := stockRequest{Strategy: strategy, Movement: res.movement(reasonReserve), Reservation: &res}
+		req.drop(productID, res.Quantity)
+		changes, err := dbApplyStock(db, &req)
+		if err == nil {
+			res.Locations = changes[0].negate()
+			return &res, nil
+		}
+		if err != ErrInsufficientAmount || !backorder {
+			return nil, err
+		}
+	}
 
-	stockKey := fmt.Sprintf("stock:%s", productID)
+	return dbBackorder(db, &res)
+}
+
+// dbBackorder queues the reservation behind the backorders of its product, it
+// fails with ErrInsufficientAmount if the product doesn't take backorders or
+// the cap would be exceeded
+func dbBackorder(db redis.Conn, res *reservation) (*reservation, error) {
+	policy, err := dbGetBackorderPolicy(db, res.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Mode == "" {
+		return nil, ErrInsufficientAmount
+	}
+
+	// The quantity is counted first, so concurrent backorders can't exceed the
+	// cap together
+	backordered, err := redis.Int64(db.Do("INCRBY", backorderedKey(res.ProductID), res.Quantity))
+	if err != nil {
+		return nil, err
+	}
+	if backordered > policy.Cap {
+		db.Do("DECRBY", backorderedKey(res.ProductID), res.Quantity)
+		return nil, ErrInsufficientAmount
+	}
+
+	res.Backordered = true
+	db.Send("MULTI")
+	db.Send("HSET", redis.Args{}.Add(reservationKey(res.Id)).AddFlat(res)...)
+	db.Send("ZADD", "reservations", res.ExpiresAt, res.Id)
+	db.Send("RPUSH", backorderQueueKey(res.ProductID), res.Id)
+	if _, err := db.Do("EXEC"); err != nil {
+		db.Do("DECRBY", backorderedKey(res.ProductID), res.Quantity)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// dbGetReservation returns the reservation, it fails with redis.ErrNil if it
+// doesn't exist
+func dbGetReservation(db redis.Conn, reservationID string) (*reservation, error) {
+	values, err := redis.Values(db.Do("HGETALL", reservationKey(reservationID)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, redis.ErrNil
+	}
+
+	var res reservation
+	if err := redis.ScanStruct(values, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// dbClaimReservation removes the reservation and adds returned back to the
+// stock in the same script run. Commit, release and the reaper all go through
+// here, only the first of them finds the reservation and the others fail with
+// redis.ErrNil.
+func dbClaimReservation(db redis.Conn, res *reservation, returned allocation, m movement) error {
+	req := stockRequest{Claim: res.Id, Movement: m}
+	for _, location := range returned.sortedLocations() {
+		req.add(res.ProductID, location, returned[location])
+	}
 
-	// Incrementing the quantity must be atomic, Redis has INCRBY method but first we need
-	// to check quantity doesn't goes below zero
+	result, err := dbRunStockScript(db, &req)
+	if err != nil {
+		return err
+	}
+	if result.Missing {
+		return redis.ErrNil
+	}
+
+	return nil
+}
+
+func dbCommitReservation(db redis.Conn, reservationID string) error {
+	res, err := dbGetReservation(db, reservationID)
+	if err != nil {
+		return err
+	}
+	if res.Backordered {
+		return dbCommitBackorder(db, reservationID)
+	}
+
+	return dbClaimReservation(db, res, nil, movement{})
+}
+
+// dbCommitBackorder keeps the backorder in the queue without expiring until
+// its stock arrives. Backorder changes are made under WATCH of the reservation,
+// so a backorder can't be committed, released and fulfilled at the same time.
+func dbCommitBackorder(db redis.Conn, reservationID string) error {
 	for {
-		if _, err := db.Do("WATCH", stockKey); err != nil {
+		if _, err := db.Do("WATCH", reservationKey(reservationID)); err != nil {
 			return err
 		}
 
-		quantity, err := redis.Int64(db.Do("GET", stockKey))
+		res, err := dbGetReservation(db, reservationID)
 		if err != nil {
-			if err != redis.ErrNil {
-				return err
-			}
+			db.Do("UNWATCH")
+			return err
+		}
+		if res.Committed || res.Fulfilled {
+			db.Do("UNWATCH")
+			return redis.ErrNil
+		}
 
-			quantity = 0
+		db.Send("MULTI")
+		db.Send("HSET", reservationKey(reservationID), "Committed", true)
+		db.Send("ZREM", "reservations", reservationID)
+		val, err := db.Do("EXEC")
+		if err != nil {
+			return err
 		}
+		if val != nil {
+			return nil
+		}
+	}
+}
+
+func dbReleaseReservation(db redis.Conn, reservationID, reason string) error {
+	res, err := dbGetReservation(db, reservationID)
+	if err != nil {
+		return err
+	}
+	if res.Backordered {
+		return dbReleaseBackorder(db, reservationID, reason)
+	}
 
-		if quantity+amount < 0 {
-			return ErrInsufficientAmount
+	return dbClaimReservation(db, res, res.taken(), res.movement(reason))
+}
+
+// dbReleaseBackorder removes the backorder from the queue, no stock has to be
+// returned. Committed backorders don't expire, and fulfilled ones can't be
+// released since their stock was taken.
+func dbReleaseBackorder(db redis.Conn, reservationID, reason string) error {
+	for {
+		if _, err := db.Do("WATCH", reservationKey(reservationID)); err != nil {
+			return err
 		}
 
-		db.Send("MULTI")
-		db.Send("SET", stockKey, quantity+amount)
+		res, err := dbGetReservation(db, reservationID)
+		if err != nil {
+			db.Do("UNWATCH")
+			return err
+		}
+		if res.Fulfilled || (res.Committed && reason == reasonExpire) {
+			db.Do("UNWATCH")
+			return redis.ErrNil
+		}
 
+		db.Send("MULTI")
+		db.Send("LREM", backorderQueueKey(res.ProductID), 0, reservationID)
+		db.Send("DECRBY", backorderedKey(res.ProductID), res.Quantity)
+		db.Send("ZREM", "reservations", reservationID)
+		db.Send("DEL", reservationKey(reservationID))
 		val, err := db.Do("EXEC")
 		if err != nil {
 			return err
 		}
 		if val != nil {
-			break
+			return nil
 		}
 	}
+}
 
-	return nil
+// dbFulfillBackorders hands the stock of the product to its committed
+// backorders in the order they were made, it stops at the first one which
+// isn't committed yet or can't be covered. A backorder whose reservation
+// changed while its stock was dropped gets the stock back.
+func dbFulfillBackorders(db redis.Conn, productID string) ([]reservation, error) {
+	var fulfilled []reservation
+	for {
+		reservationID, err := redis.String(db.Do("LINDEX", backorderQueueKey(productID), 0))
+		if err == redis.ErrNil {
+			return fulfilled, nil
+		}
+		if err != nil {
+			return fulfilled, err
+		}
+
+		if _, err := db.Do("WATCH", reservationKey(reservationID)); err != nil {
+			return fulfilled, err
+		}
+
+		res, err := dbGetReservation(db, reservationID)
+		if err == redis.ErrNil {
+			// the queue entry outlived its reservation
+			db.Do("UNWATCH")
+			db.Do("LREM", backorderQueueKey(productID), 0, reservationID)
+			continue
+		}
+		if err != nil {
+			db.Do("UNWATCH")
+			return fulfilled, err
+		}
+		if !res.Committed {
+			db.Do("UNWATCH")
+			return fulfilled, nil
+		}
+
+		change, err := dbDrop(db, productID, res.Quantity, defaultDropStrategy, res.movement(reasonBackorder))
+		if err == ErrInsufficientAmount {
+			db.Do("UNWATCH")
+			return fulfilled, nil
+		}
+		if err != nil {
+			db.Do("UNWATCH")
+			return fulfilled, err
+		}
+
+		res.Locations = change.negate()
+		res.Fulfilled = true
+		db.Send("MULTI")
+		db.Send("LREM", backorderQueueKey(productID), 0, reservationID)
+		db.Send("DECRBY", backorderedKey(productID), res.Quantity)
+		db.Send("HSET", reservationKey(reservationID), "Fulfilled", true, "Locations", res.Locations)
+		db.Send("EXPIRE", reservationKey(reservationID), int64(fulfilledBackorderTTL.Seconds()))
+		val, err := db.Do("EXEC")
+		if err == nil && val != nil {
+			fulfilled = append(fulfilled, *res)
+			continue
+		}
+
+		if err := dbReturn(db, productID, res.Locations, res.movement(reasonRelease)); err != nil {
+			log.Printf("CRITICAL: stock taken for backorder '%s' couldn't be returned: %v\n", reservationID, err)
+		}
+		if err != nil {
+			return fulfilled, err
+		}
+	}
+}
+
+func dbExpiredReservations(db redis.Conn, until time.Time) ([]string, error) {
+	return redis.Strings(db.Do("ZRANGEBYSCORE", "reservations", "-inf", until.UnixNano()))
+}
+
+func backorderPolicyKey(productID string) string {
+	return fmt.Sprintf("stock:%s:backorder", productID)
+}
+
+// backorderQueueKey is the list of the backordered reservation ids of the
+// product, oldest first
+func backorderQueueKey(productID string) string {
+	return fmt.Sprintf("stock:%s:backorders", productID)
+}
+
+// backorderedKey counts the quantity waiting in the queue
+func backorderedKey(productID string) string {
+	return fmt.Sprintf("stock:%s:backordered", productID)
+}
+
+func dbSetBackorderPolicy(db redis.Conn, productID string, policy backorderPolicy) error {
+	if policy.Mode == "" {
+		_, err := db.Do("DEL", backorderPolicyKey(productID))
+		return err
+	}
+
+	_, err := db.Do("HSET", redis.Args{}.Add(backorderPolicyKey(productID)).AddFlat(&policy)...)
+	return err
+}
+
+func dbGetBackorderPolicy(db redis.Conn, productID string) (backorderPolicy, error) {
+	db.Send("HGETALL", backorderPolicyKey(productID))
+	db.Send("GET", backorderedKey(productID))
+	db.Flush()
+
+	var policy backorderPolicy
+	values, err := redis.Values(db.Receive())
+	if err != nil {
+		db.Receive()
+		return policy, err
+	}
+	if err := redis.ScanStruct(values, &policy); err != nil {
+		db.Receive()
+		return policy, err
+	}
+
+	policy.Backordered, err = redis.Int64(db.Receive())
+	if err != nil && err != redis.ErrNil {
+		return policy, err
+	}
+
+	return policy, nil
+}
+
+func historyKey(productID string) string {
+	return fmt.Sprintf("stock:%s:history", productID)
+}
+
+// dbGetMovements pages through the ledger stream of the product from the newest
+// entry backwards
+func dbGetMovements(db redis.Conn, productID, startAfter string, maxItems int) ([]movement, string, error) {
+	start := "+"
+	if startAfter != "" {
+		start = "(" + startAfter
+	}
+
+	entries, err := redis.Values(db.Do("XREVRANGE", historyKey(productID), start, "-", "COUNT", maxItems))
+	if err != nil {
+		return nil, "", err
+	}
+
+	movements := make([]movement, 0, len(entries))
+	for _, entry := range entries {
+		values, err := redis.Values(entry, nil)
+		if err != nil {
+			return nil, "", err
+		}
+
+		var id string
+		var fields []interface{}
+		if _, err := redis.Scan(values, &id, &fields); err != nil {
+			return nil, "", err
+		}
+
+		m := movement{Id: id}
+		if err := redis.ScanStruct(fields, &m); err != nil {
+			return nil, "", err
+		}
+
+		movements = append(movements, m)
+	}
+
+	nextKey := ""
+	if len(movements) == maxItems {
+		nextKey = movements[len(movements)-1].Id
+	}
+
+	return movements, nextKey, nil
+}
+
+// Alerts of every product are added to a single stream, they are delivered to
+// the webhooks by the consumers of alertsGroup
+const alertsKey = "stock:alerts"
+const alertsGroup = "webhooks"
+
+func thresholdKey(productID string) string {
+	return fmt.Sprintf("stock:%s:threshold", productID)
+}
+
+// alertStateKey holds the level of the last alert of the product until its
+// stock goes back above the threshold
+func alertStateKey(productID string) string {
+	return fmt.Sprintf("stock:%s:alert", productID)
+}
+
+func dbSetThreshold(db redis.Conn, productID string, threshold int64) error {
+	if threshold == 0 {
+		_, err := db.Do("DEL", thresholdKey(productID))
+		return err
+	}
+
+	_, err := db.Do("SET", thresholdKey(productID), threshold)
+	return err
+}
+
+func dbGetThreshold(db redis.Conn, productID string) (int64, error) {
+	threshold, err := redis.Int64(db.Do("GET", thresholdKey(productID)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return threshold, err
+}
+
+// dbCreateAlertsGroup creates the consumer group of the alerts stream, alerts
+// emitted before the group existed aren't delivered
+func dbCreateAlertsGroup(db redis.Conn) error {
+	_, err := db.Do("XGROUP", "CREATE", alertsKey, alertsGroup, "$", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// dbReadAlerts reads the alerts for the consumer, start is ">" for new alerts
+// or "0" for the ones it read before but didn't acknowledge
+func dbReadAlerts(db redis.Conn, consumer, start string, maxItems int, block time.Duration) ([]alert, error) {
+	streams, err := redis.Values(db.Do("XREADGROUP", "GROUP", alertsGroup, consumer,
+		"COUNT", maxItems, "BLOCK", block.Milliseconds(), "STREAMS", alertsKey, start))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []alert
+	for _, stream := range streams {
+		var name string
+		var entries []interface{}
+		if _, err := redis.Scan(stream.([]interface{}), &name, &entries); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			var id string
+			var fields []interface{}
+			if _, err := redis.Scan(entry.([]interface{}), &id, &fields); err != nil {
+				return nil, err
+			}
+
+			a := alert{Id: id}
+			if err := redis.ScanStruct(fields, &a); err != nil {
+				return nil, err
+			}
+
+			alerts = append(alerts, a)
+		}
+	}
+
+	return alerts, nil
 }
 
-func dbGetProductStock(db redis.Conn, productID string) (int64, error) {
-	stockKey := fmt.Sprintf("stock:%s", productID)
-	return redis.Int64(db.Do("GET", stockKey))
+func dbAckAlert(db redis.Conn, alertID string) error {
+	_, err := db.Do("XACK", alertsKey, alertsGroup, alertID)
+	return err
 }
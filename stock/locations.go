@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+var ErrUnknownLocation = errors.New("unknown location")
+
+// locations are the warehouses the stock is kept in, in the order of their
+// priority. Puts without a location go to the first one. They are read from
+// STOCK_LOCATIONS as a comma separated list.
+var locations []string
+
+type dropStrategy string
+
+const (
+	// strategyPriority drains the locations in the order of their priority
+	strategyPriority dropStrategy = "priority"
+	// strategyMostStock drops from the location with the most stock first
+	strategyMostStock dropStrategy = "most_stock"
+)
+
+// defaultDropStrategy is used by drops and reservations which don't ask for
+// one, it is read from STOCK_DROP_STRATEGY
+var defaultDropStrategy = strategyPriority
+
+// loadLocations reads the locations and the default drop strategy from the
+// environment
+func loadLocations() error {
+	locations = nil
+	for _, name := range strings.Split(service.Env("STOCK_LOCATIONS", "main"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			locations = append(locations, name)
+		}
+	}
+	if len(locations) == 0 {
+		return errors.New("STOCK_LOCATIONS has no locations")
+	}
+
+	strategy, err := parseDropStrategy(service.Env("STOCK_DROP_STRATEGY", string(strategyPriority)))
+	if err != nil {
+		return err
+	}
+
+	defaultDropStrategy = strategy
+	return nil
+}
+
+func parseDropStrategy(name string) (dropStrategy, error) {
+	switch strategy := dropStrategy(name); strategy {
+	case "":
+		return defaultDropStrategy, nil
+	case strategyPriority, strategyMostStock:
+		return strategy, nil
+	}
+
+	return "", fmt.Errorf("unknown drop strategy '%s'", name)
+}
+
+func defaultLocation() string {
+	return locations[0]
+}
+
+func isLocation(name string) bool {
+	for _, location := range locations {
+		if location == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allocation is a quantity per location, depending on where it is used it is
+// the stock of a product, the change applied to it or what a reservation holds
+type allocation map[string]int64
+
+func (a allocation) total() int64 {
+	var total int64
+	for _, quantity := range a {
+		total += quantity
+	}
+
+	return total
+}
+
+// negate returns the allocation with the signs of the quantities flipped
+func (a allocation) negate() allocation {
+	negated := make(allocation, len(a))
+	for location, quantity := range a {
+		negated[location] = -quantity
+	}
+
+	return negated
+}
+
+// sortedLocations returns the locations of the allocation in a stable order
+func (a allocation) sortedLocations() []string {
+	names := make([]string, 0, len(a))
+	for location := range a {
+		names = append(names, location)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// RedisArg stores the allocation as JSON in a hash field
+func (a allocation) RedisArg() interface{} {
+	bytes, _ := json.Marshal(a)
+	return bytes
+}
+
+func (a *allocation) RedisScan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, a)
+	case string:
+		return json.Unmarshal([]byte(src), a)
+	}
+
+	return fmt.Errorf("can't scan %T into allocation", src)
+}
+
+// planDrop returns the change which drops amount from the stock using the
+// strategy. A drop is spread over several locations when none of them has
+// enough stock alone.
+func planDrop(stock allocation, amount int64, strategy dropStrategy) (allocation, error) {
+	if stock.total() < amount {
+		return nil, ErrInsufficientAmount
+	}
+
+	order := append([]string(nil), locations...)
+	if strategy == strategyMostStock {
+		sort.SliceStable(order, func(i, j int) bool {
+			return stock[order[i]] > stock[order[j]]
+		})
+	}
+
+	change := allocation{}
+	for _, location := range order {
+		if amount == 0 {
+			break
+		}
+
+		taken := stock[location]
+		if taken > amount {
+			taken = amount
+		}
+		if taken <= 0 {
+			continue
+		}
+
+		change[location] = -taken
+		amount -= taken
+	}
+
+	// the rest of the stock is in locations which were removed from the
+	// configuration
+	if amount > 0 {
+		return nil, ErrInsufficientAmount
+	}
+
+	return change, nil
+}
@@ -3,183 +3,695 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
 )
 
-var redisHost = "localhost:6379"
 var ErrInsufficientAmount = errors.New("insufficient amount")
+var ErrNotFound = errors.New("not found")
 
-type quantityOp struct {
-	product string
-	amount  int
-	cb      chan error
+// errorResponses is how the domain errors are reported to clients
+var errorResponses = service.ErrorMap{
+	ErrInsufficientAmount: {Status: http.StatusNotAcceptable, Code: service.CodeInsufficientStock, Message: "insufficient quantity"},
+	ErrNotFound:           {Status: http.StatusNotFound, Code: service.CodeNotFound, Message: "product has no stock"},
+	ErrUnknownLocation:    {Status: http.StatusBadRequest, Code: service.CodeInvalidRequest},
 }
 
-func main() {
-	if os.Getenv("REDIS_HOST") != "" {
-		redisHost = os.Getenv("REDIS_HOST")
+const defaultReservationTTL = 10 * time.Minute
+const reaperInterval = 5 * time.Second
+
+// reservation holds stock for its holder until it is committed or released,
+// Locations is how much of the quantity was taken from each location.
+// Reference is what the holder reserved the stock for, like an order id, it is
+// recorded with the changes made for the reservation.
+//
+// A backordered reservation hasn't taken any stock yet, it waits in the queue
+// of the product. Once committed it doesn't expire, and it takes the stock
+// when enough is put and becomes fulfilled.
+type reservation struct {
+	Id          string     `json:"id"`
+	ProductID   string     `json:"product_id"`
+	Holder      string     `json:"holder"`
+	Reference   string     `json:"reference,omitempty"`
+	Quantity    int64      `json:"quantity"`
+	Locations   allocation `json:"locations"`
+	ExpiresAt   int64      `json:"expires_at"`
+	Backordered bool       `json:"backordered"`
+	Committed   bool       `json:"committed"`
+	Fulfilled   bool       `json:"fulfilled"`
+}
+
+func newReservation(productID, holder string, quantity int64, ttl time.Duration) reservation {
+	now := time.Now()
+	return reservation{
+		Id:        strconv.FormatInt(now.UnixNano()+rand.Int63n(100), 10),
+		ProductID: productID,
+		Holder:    holder,
+		Quantity:  quantity,
+		ExpiresAt: now.Add(ttl).UnixNano(),
+	}
+}
+
+// taken returns the quantities the reservation took from the locations.
+// Reservations made before there were locations took everything from the
+// default location.
+func (r *reservation) taken() allocation {
+	if len(r.Locations) == 0 {
+		return allocation{defaultLocation(): r.Quantity}
+	}
+
+	return r.Locations
+}
+
+// movement returns the ledger entry of a change made for the reservation, it
+// refers to the reservation itself when the holder didn't give a reference
+func (r *reservation) movement(reason string) movement {
+	reference := r.Reference
+	if reference == "" {
+		reference = r.Id
+	}
+
+	return movement{Reason: reason, Source: r.Holder, Reference: reference}
+}
+
+// movement is an entry of the stock ledger, every change of a product's
+// quantity in a location is recorded as one. Quantity is the quantity of the
+// location after the change.
+type movement struct {
+	Id        string `json:"id" redis:"-"`
+	ProductID string `json:"product_id"`
+	Location  string `json:"location"`
+	Delta     int64  `json:"delta"`
+	Quantity  int64  `json:"quantity"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	Reference string `json:"reference"`
+	At        int64  `json:"at"`
+}
+
+// Reasons of the movements recorded by the service itself, callers of /put and
+// /drop may send their own
+const (
+	reasonPut      = "put"
+	reasonDrop     = "drop"
+	reasonReserve  = "reserve"
+	reasonRelease  = "release"
+	reasonExpire   = "expire"
+	reasonTransfer = "transfer"
+	reasonBatch    = "batch"
+	// the stock was taken by a backordered reservation
+	reasonBackorder = "backorder"
+	// a committed reservation was undone since others committed with it failed
+	reasonRevert = "reservation_reverted"
+)
+
+const historyPageSize = 20
+
+// quantityChange is the payload of /put, /drop and /transfer. Location is
+// where the stock is put or dropped, drops without one pick the locations
+// with the strategy. From and To are only used by transfers.
+type quantityChange struct {
+	Quantity  int64        `json:"quantity"`
+	Location  string       `json:"location"`
+	Strategy  dropStrategy `json:"strategy"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Reason    string       `json:"reason"`
+	Source    string       `json:"source"`
+	Reference string       `json:"reference"`
+}
+
+// movement returns the ledger entry of the change, reason is used if the
+// caller didn't send one
+func (c *quantityChange) movement(reason string) movement {
+	if c.Reason != "" {
+		reason = c.Reason
 	}
 
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisHost) },
+	return movement{Reason: reason, Source: c.Source, Reference: c.Reference}
+}
+
+func main() {
+	if err := loadLocations(); err != nil {
+		log.Fatalf("FATAL: %v\n", err)
 	}
 
-	conn := pool.Get()
-	_, err := conn.Do("PING")
+	writeWorkers, err := quantityWorkerCount()
 	if err != nil {
-		log.Fatalf("failed to ping redis: %v", err)
+		log.Fatalf("FATAL: %v\n", err)
+	}
+
+	var store StockStore
+	var idempotency service.IdempotencyStore
+	if service.MemoryStorage() {
+		store = newMemoryStore()
+		idempotency = service.NewMemoryIdempotencyStore()
+	} else {
+		pool := service.NewPool()
+		service.MustPing(pool)
+		store = newRedisStore(pool, writeWorkers)
+		idempotency = service.NewRedisIdempotencyStore(pool, "stock")
+	}
+
+	go reapReservations(store)
+	if webhooks := alertWebhooks(); len(webhooks) > 0 {
+		go notifyAlerts(store, webhooks)
 	}
-	conn.Close()
 
 	log.Println("start listening at http://localhost:8083")
 
-	http.HandleFunc("/drop", withLogging(withDB(pool, dropHandler)))
-	http.HandleFunc("/put", withLogging(withDB(pool, putHandler)))
-	http.HandleFunc("/", withLogging(withDB(pool, indexHandler)))
+	handle := func(pattern string, handler func(StockStore, http.ResponseWriter, *http.Request) error, middlewares ...service.Middleware) {
+		middlewares = append([]service.Middleware{service.WithRequestID, service.WithLogging}, middlewares...)
+		http.HandleFunc(pattern, service.Chain(service.WithStore(store, service.LogErrors(handler)), middlewares...))
+	}
+
+	handle("/drop", dropHandler, service.WithIdempotency(idempotency))
+	handle("/put", putHandler, service.WithIdempotency(idempotency))
+	handle("/transfer", transferHandler, service.WithIdempotency(idempotency))
+	handle("/batch", batchHandler, service.WithIdempotency(idempotency))
+	handle("/reserve", reserveHandler)
+	handle("/reserve/batch", reserveBatchHandler)
+	handle("/reservation", reservationHandler)
+	handle("/commit", commitHandler)
+	handle("/commit/batch", commitBatchHandler)
+	handle("/release", releaseHandler)
+	handle("/history", historyHandler)
+	handle("/threshold", thresholdHandler)
+	handle("/backorder", backorderHandler)
+	handle("/", indexHandler)
 	http.ListenAndServe(":8083", nil)
 }
 
-func withDB(pool *redis.Pool, handler func(redis.Conn, http.ResponseWriter, *http.Request) error) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		conn := pool.Get()
-		defer conn.Close()
-		if err := handler(conn, w, r); err != nil {
-			log.Printf("ERROR: %v\n", err)
+func dropHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
+	}
+
+	var payload quantityChange
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
+	}
+	if payload.Quantity <= 0 {
+		return service.WriteError(w, service.BadRequest("quantity has to be a positive number greater than zero"))
+	}
+
+	if payload.Location != "" {
+		if !isLocation(payload.Location) {
+			return service.WriteError(w, errorResponses.Resolve(ErrUnknownLocation))
+		}
+
+		err := store.IncrQuantity(productID, payload.Location, -payload.Quantity, payload.movement(reasonDrop))
+		if err != nil {
+			return service.WriteError(w, errorResponses.Resolve(err))
 		}
+
+		return writeLocations(w, allocation{payload.Location: payload.Quantity})
+	}
+
+	strategy, err := parseDropStrategy(string(payload.Strategy))
+	if err != nil {
+		return service.WriteError(w, service.BadRequest(err.Error()))
+	}
+
+	change, err := store.Drop(productID, payload.Quantity, strategy, payload.movement(reasonDrop))
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
+
+	return writeLocations(w, change.negate())
+}
+
+// writeLocations responds with the quantities a drop took from each location
+func writeLocations(w http.ResponseWriter, taken allocation) error {
+	return service.WriteJSON(w, http.StatusOK, struct {
+		Locations allocation `json:"locations"`
+	}{taken})
 }
 
-func dropHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) error {
+func putHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
 	productID := r.URL.Query().Get("product_id")
 	if productID == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return nil
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
 	}
 
-	var payload struct {
-		Quantity int64 `json:"quantity"`
-	}
+	var payload quantityChange
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("quantity has to be a positive number greater than zero"))
-		return nil
+		return service.WriteError(w, service.BadRequest("invalid payload"))
 	}
 	if payload.Quantity <= 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("quantity has to be a positive number greater than zero"))
-		return nil
+		return service.WriteError(w, service.BadRequest("quantity has to be a positive number greater than zero"))
 	}
 
-	if err := dbIncrQuantity(db, productID, -payload.Quantity); err != nil {
-		if err == ErrInsufficientAmount {
-			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte("insufficient quantity"))
-			return nil
-		}
+	location := payload.Location
+	if location == "" {
+		location = defaultLocation()
+	}
+	if !isLocation(location) {
+		return service.WriteError(w, errorResponses.Resolve(ErrUnknownLocation))
+	}
 
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+	if err := store.IncrQuantity(productID, location, payload.Quantity, payload.movement(reasonPut)); err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	// the put succeeded even if the backorders couldn't take their stock,
+	// the next put tries again
+	fulfilled, err := store.FulfillBackorders(productID)
+	if err != nil {
+		log.Printf("ERROR: failed to fulfill backorders of product '%s': %v\n", productID, err)
+	}
+	for _, res := range fulfilled {
+		log.Printf("fulfilled backorder '%s' of product '%s'\n", res.Id, productID)
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-func putHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) error {
+func transferHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
 	productID := r.URL.Query().Get("product_id")
 	if productID == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return nil
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
 	}
 
-	var payload struct {
-		Quantity int64 `json:"quantity"`
-	}
+	var payload quantityChange
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return service.WriteError(w, service.BadRequest("invalid payload"))
 	}
 	if payload.Quantity <= 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("quantity can't be equal or greater than zero"))
-		return nil
+		return service.WriteError(w, service.BadRequest("quantity has to be a positive number greater than zero"))
+	}
+	if !isLocation(payload.From) || !isLocation(payload.To) {
+		return service.WriteError(w, errorResponses.Resolve(ErrUnknownLocation))
+	}
+	if payload.From == payload.To {
+		return service.WriteError(w, service.BadRequest("can't transfer to the same location"))
 	}
 
-	if err := dbIncrQuantity(db, productID, payload.Quantity); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+	if err := store.Transfer(productID, payload.From, payload.To, payload.Quantity, payload.movement(reasonTransfer)); err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-func indexHandler(db redis.Conn, w http.ResponseWriter, r *http.Request) error {
+// batchHandler applies many puts and drops atomically, if any of the lines
+// can't be applied none of them are and the failing lines are listed in the
+// details of the error
+func batchHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return service.WriteError(w, service.NotFound("no such endpoint"))
+	}
+
+	var payload struct {
+		Lines     []batchLine  `json:"lines"`
+		Strategy  dropStrategy `json:"strategy"`
+		Reason    string       `json:"reason"`
+		Source    string       `json:"source"`
+		Reference string       `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
+	}
+	if len(payload.Lines) == 0 {
+		return service.WriteError(w, service.BadRequest("batch has no lines"))
+	}
+	if len(payload.Lines) > maxBatchLines {
+		return service.WriteError(w, service.BadRequest(fmt.Sprintf("batch can't have more than %d lines", maxBatchLines)))
+	}
+	if errs := validateBatch(payload.Lines); len(errs) > 0 {
+		return service.WriteError(w, service.BadRequest("batch has invalid lines").WithDetails(errs))
+	}
+
+	strategy, err := parseDropStrategy(string(payload.Strategy))
+	if err != nil {
+		return service.WriteError(w, service.BadRequest(err.Error()))
+	}
+
+	m := movement{Reason: payload.Reason, Source: payload.Source, Reference: payload.Reference}
+	if m.Reason == "" {
+		m.Reason = reasonBatch
+	}
+
+	changes, err := store.Batch(payload.Lines, strategy, m)
+	if err != nil {
+		var batchErr *batchError
+		if errors.As(err, &batchErr) {
+			respErr := service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "insufficient quantity for some lines")
+			return service.WriteError(w, respErr.WithDetails(batchErr.Lines))
+		}
+
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	type lineResult struct {
+		ProductID string     `json:"product_id"`
+		Locations allocation `json:"locations"`
+	}
+	results := make([]lineResult, len(payload.Lines))
+	for i, line := range payload.Lines {
+		results[i] = lineResult{line.ProductID, changes[i]}
+	}
+
+	return service.WriteJSON(w, http.StatusOK, struct {
+		Lines []lineResult `json:"lines"`
+	}{results})
+}
+
+func reserveHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
 	productID := r.URL.Query().Get("product_id")
 	if productID == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return nil
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
+	}
+
+	var payload struct {
+		Quantity  int64        `json:"quantity"`
+		Holder    string       `json:"holder"`
+		Reference string       `json:"reference"`
+		Strategy  dropStrategy `json:"strategy"`
+		TTL       int64        `json:"ttl"`
+		// Backorder lets the reservation wait for stock if the product takes
+		// backorders
+		Backorder bool `json:"backorder"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
+	}
+	if payload.Quantity <= 0 {
+		return service.WriteError(w, service.BadRequest("quantity has to be a positive number greater than zero"))
+	}
+	if payload.TTL < 0 {
+		return service.WriteError(w, service.BadRequest("ttl can't be negative"))
+	}
+
+	strategy, err := parseDropStrategy(string(payload.Strategy))
+	if err != nil {
+		return service.WriteError(w, service.BadRequest(err.Error()))
+	}
+
+	ttl := defaultReservationTTL
+	if payload.TTL > 0 {
+		ttl = time.Duration(payload.TTL) * time.Second
+	}
+
+	res := newReservation(productID, payload.Holder, payload.Quantity, ttl)
+	res.Reference = payload.Reference
+
+	reserved, err := store.Reserve(res, strategy, payload.Backorder)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	return service.WriteJSON(w, http.StatusCreated, reserved)
+}
+
+// reserveBatchHandler makes a reservation for every line, either all of them
+// are made or none. The reservations are returned in the order of the lines.
+func reserveBatchHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	var payload struct {
+		Lines     []reservationLine `json:"lines"`
+		Holder    string            `json:"holder"`
+		Reference string            `json:"reference"`
+		Strategy  dropStrategy      `json:"strategy"`
+		TTL       int64             `json:"ttl"`
+		Backorder bool              `json:"backorder"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
+	}
+	if len(payload.Lines) == 0 || len(payload.Lines) > maxBatchLines {
+		return service.WriteError(w, service.BadRequest(fmt.Sprintf("batch has to have between 1 and %d lines", maxBatchLines)))
+	}
+	if payload.TTL < 0 {
+		return service.WriteError(w, service.BadRequest("ttl can't be negative"))
+	}
+
+	var errs []lineError
+	for i, line := range payload.Lines {
+		if line.ProductID == "" {
+			errs = append(errs, lineError{Line: i, Message: "product_id is missing"})
+		} else if line.Quantity <= 0 {
+			errs = append(errs, lineError{Line: i, ProductID: line.ProductID, Message: "quantity has to be a positive number greater than zero"})
+		}
+	}
+	if len(errs) > 0 {
+		return service.WriteError(w, service.BadRequest("batch has invalid lines").WithDetails(errs))
+	}
+
+	strategy, err := parseDropStrategy(string(payload.Strategy))
+	if err != nil {
+		return service.WriteError(w, service.BadRequest(err.Error()))
 	}
 
-	quantity, err := dbGetProductStock(db, productID)
+	ttl := defaultReservationTTL
+	if payload.TTL > 0 {
+		ttl = time.Duration(payload.TTL) * time.Second
+	}
+
+	reservations := make([]reservation, len(payload.Lines))
+	for i, line := range payload.Lines {
+		reservations[i] = newReservation(line.ProductID, payload.Holder, line.Quantity, ttl)
+		reservations[i].Reference = payload.Reference
+	}
+
+	reserved, err := reserveAll(store, reservations, strategy, payload.Backorder)
 	if err != nil {
-		if err == redis.ErrNil {
-			w.WriteHeader(http.StatusNotFound)
-			return nil
+		var batchErr *batchError
+		if errors.As(err, &batchErr) {
+			respErr := service.NewError(http.StatusNotAcceptable, service.CodeInsufficientStock, "insufficient quantity for some lines")
+			return service.WriteError(w, respErr.WithDetails(batchErr.Lines))
 		}
 
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+		return service.WriteError(w, errorResponses.Resolve(err))
 	}
 
-	payload := struct {
-		ProductID string `json:"product_id"`
-		Quantity  int64  `json:"quantity"`
-	}{productID, quantity}
+	return service.WriteJSON(w, http.StatusCreated, map[string]interface{}{"reservations": reserved})
+}
 
-	respBody, err := json.Marshal(payload)
+// reservationHandler returns a reservation, it is how holders of backorders
+// find out whether they are fulfilled
+func reservationHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	reservationID := r.URL.Query().Get("reservation_id")
+	if reservationID == "" {
+		return service.WriteError(w, service.BadRequest("reservation_id parameter is missing"))
+	}
+
+	res, err := store.Reservation(reservationID)
+	if err == ErrNotFound {
+		return service.WriteError(w, service.NotFound("reservation expired or already settled"))
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	return service.WriteJSON(w, http.StatusOK, res)
+}
+
+func commitHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	reservationID := r.URL.Query().Get("reservation_id")
+	if reservationID == "" {
+		return service.WriteError(w, service.BadRequest("reservation_id parameter is missing"))
 	}
 
-	w.WriteHeader(200)
-	w.Write(respBody)
+	if err := store.CommitReservation(reservationID); err != nil {
+		if err == ErrNotFound {
+			return service.WriteError(w, service.NotFound("reservation expired or already settled"))
+		}
+
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-type loggingResponseWriter struct {
-	w          http.ResponseWriter
-	StatusCode int
-	Body       []byte
+// commitBatchHandler commits every reservation or none of them, see commitAll
+func commitBatchHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	var payload struct {
+		ReservationIDs []string `json:"reservation_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return service.WriteError(w, service.BadRequest("invalid payload"))
+	}
+	if len(payload.ReservationIDs) == 0 || len(payload.ReservationIDs) > maxBatchLines {
+		return service.WriteError(w, service.BadRequest(fmt.Sprintf("batch has to have between 1 and %d reservations", maxBatchLines)))
+	}
+
+	if err := commitAll(store, payload.ReservationIDs); err != nil {
+		if err == ErrNotFound {
+			return service.WriteError(w, service.NotFound("reservation expired or already settled"))
+		}
+
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func (l *loggingResponseWriter) Header() http.Header {
-	return l.w.Header()
+func releaseHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	reservationID := r.URL.Query().Get("reservation_id")
+	if reservationID == "" {
+		return service.WriteError(w, service.BadRequest("reservation_id parameter is missing"))
+	}
+
+	if err := store.ReleaseReservation(reservationID, reasonRelease); err != nil {
+		if err == ErrNotFound {
+			return service.WriteError(w, service.NotFound("reservation expired or already settled"))
+		}
+
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func (l *loggingResponseWriter) Write(bytes []byte) (int, error) {
-	l.Body = append(l.Body, bytes...)
-	return l.w.Write(bytes)
+// reapReservations periodically returns the stock held by expired reservations
+func reapReservations(store StockStore) {
+	for range time.Tick(reaperInterval) {
+		expired, err := store.ExpiredReservations(time.Now())
+		if err != nil {
+			log.Printf("ERROR: failed to list expired reservations: %v\n", err)
+		}
+
+		for _, reservationID := range expired {
+			err := store.ReleaseReservation(reservationID, reasonExpire)
+			if err != nil && err != ErrNotFound {
+				log.Printf("ERROR: failed to release expired reservation '%s': %v\n", reservationID, err)
+				continue
+			}
+			if err == nil {
+				log.Printf("released expired reservation '%s'\n", reservationID)
+			}
+		}
+	}
+}
+
+// historyHandler pages through the stock movements of a product, newest first
+func historyHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
+	}
+
+	movements, next, err := store.Movements(productID, r.URL.Query().Get("from"), historyPageSize)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	if movements == nil {
+		movements = []movement{}
+	}
+
+	return service.WriteJSON(w, http.StatusOK, struct {
+		Movements []movement `json:"movements"`
+		NextKey   string     `json:"next_key"`
+	}{movements, next})
+}
+
+// thresholdHandler returns the threshold of the product, or sets it when it is
+// POSTed. A product whose stock drops below its threshold gets an alert.
+func thresholdHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
+	}
+
+	if r.Method == http.MethodPost {
+		var payload struct {
+			Threshold int64 `json:"threshold"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return service.WriteError(w, service.BadRequest("invalid payload"))
+		}
+		if payload.Threshold < 0 {
+			return service.WriteError(w, service.BadRequest("threshold can't be negative"))
+		}
+
+		if err := store.SetThreshold(productID, payload.Threshold); err != nil {
+			return service.WriteError(w, errorResponses.Resolve(err))
+		}
+	}
+
+	threshold, err := store.Threshold(productID)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	return service.WriteJSON(w, http.StatusOK, struct {
+		ProductID string `json:"product_id"`
+		Threshold int64  `json:"threshold"`
+	}{productID, threshold})
 }
 
-func (l *loggingResponseWriter) WriteHeader(statusCode int) {
-	l.StatusCode = statusCode
-	l.w.WriteHeader(statusCode)
+// backorderHandler returns the backorder policy of the product, or sets it
+// when it is POSTed. An empty mode stops taking backorders, the ones waiting
+// are still fulfilled.
+func backorderHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
+	}
+
+	if r.Method == http.MethodPost {
+		var payload backorderPolicy
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return service.WriteError(w, service.BadRequest("invalid payload"))
+		}
+
+		mode, err := parseBackorderMode(string(payload.Mode))
+		if err != nil {
+			return service.WriteError(w, service.BadRequest(err.Error()))
+		}
+		if mode != "" && payload.Cap <= 0 {
+			return service.WriteError(w, service.BadRequest("cap has to be a positive number greater than zero"))
+		}
+
+		policy := backorderPolicy{Mode: mode, Cap: payload.Cap}
+		if err := store.SetBackorderPolicy(productID, policy); err != nil {
+			return service.WriteError(w, errorResponses.Resolve(err))
+		}
+	}
+
+	policy, err := store.BackorderPolicy(productID)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	return service.WriteJSON(w, http.StatusOK, struct {
+		ProductID string `json:"product_id"`
+		backorderPolicy
+	}{productID, policy})
 }
 
-func withLogging(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%s] %v\n", r.Method, r.URL)
-		writer := loggingResponseWriter{w, 0, nil}
-		handler(&writer, r)
-		log.Printf("-> %d -- %s", writer.StatusCode, string(writer.Body))
+func indexHandler(store StockStore, w http.ResponseWriter, r *http.Request) error {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		return service.WriteError(w, service.BadRequest("product_id parameter is missing"))
 	}
+
+	stock, err := store.ProductStock(productID)
+	if err != nil {
+		return service.WriteError(w, errorResponses.Resolve(err))
+	}
+
+	// quantity is the total like before there were locations, clients which
+	// don't know about locations keep reading it
+	payload := struct {
+		ProductID string     `json:"product_id"`
+		Quantity  int64      `json:"quantity"`
+		Available int64      `json:"available"`
+		Locations allocation `json:"locations"`
+	}{productID, stock.total(), stock.total(), stock}
+
+	return service.WriteJSON(w, http.StatusOK, payload)
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type handlerFunc func(StockStore, http.ResponseWriter, *http.Request) error
+
+func setupStock(t *testing.T) *memoryStore {
+	t.Helper()
+
+	t.Setenv("STOCK_LOCATIONS", "front,back")
+	if err := loadLocations(); err != nil {
+		t.Fatal(err)
+	}
+
+	return newMemoryStore()
+}
+
+func request(t *testing.T, store StockStore, handler handlerFunc, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if err := handler(store, w, r); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func put(t *testing.T, store StockStore, productID, location string, quantity int) {
+	t.Helper()
+
+	body := `{"quantity":` + strconv.Itoa(quantity) + `,"location":"` + location + `"}`
+	if w := request(t, store, putHandler, "/put?product_id="+productID, body); w.Code != http.StatusOK {
+		t.Fatalf("putting %d to %s: got status %d: %s", quantity, location, w.Code, w.Body)
+	}
+}
+
+func reserve(t *testing.T, store StockStore, productID string, quantity int, backorder bool) (*reservation, int) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]interface{}{"quantity": quantity, "holder": "h", "backorder": backorder})
+	w := request(t, store, reserveHandler, "/reserve?product_id="+productID, string(body))
+	if w.Code != http.StatusCreated {
+		return nil, w.Code
+	}
+
+	var res reservation
+	json.NewDecoder(w.Body).Decode(&res)
+	return &res, w.Code
+}
+
+func stockOf(t *testing.T, store StockStore, productID string) allocation {
+	t.Helper()
+
+	stock, err := store.ProductStock(productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stock
+}
+
+func TestDrop(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 5)
+	put(t, store, "p1", "back", 3)
+
+	// the locations are drained in their priority order
+	w := request(t, store, dropHandler, "/drop?product_id=p1", `{"quantity":6}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var res struct {
+		Locations allocation `json:"locations"`
+	}
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Locations["front"] != 5 || res.Locations["back"] != 1 {
+		t.Errorf("got locations %v, want 5 from front and 1 from back", res.Locations)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 2 {
+		t.Errorf("got stock %v, want 2 left", stock)
+	}
+
+	w = request(t, store, dropHandler, "/drop?product_id=p1", `{"quantity":3}`)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("dropping more than the stock: got status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+
+	w = request(t, store, dropHandler, "/drop?product_id=p1", `{"quantity":1,"location":"attic"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("dropping from an unknown location: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if stock := stockOf(t, store, "p1"); stock.total() != 2 {
+		t.Errorf("got stock %v after the failed drops, want 2 left", stock)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 5)
+	put(t, store, "p1", "back", 3)
+
+	w := request(t, store, indexHandler, "/?product_id=p1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var res struct {
+		Quantity  int64      `json:"quantity"`
+		Available int64      `json:"available"`
+		Locations allocation `json:"locations"`
+	}
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Quantity != 8 || res.Available != 8 || res.Locations["front"] != 5 || res.Locations["back"] != 3 {
+		t.Errorf("got %+v, want 8 in total with 5 in front and 3 in back", res)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 5)
+
+	first, status := reserve(t, store, "p1", 3, false)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	if first.Locations["front"] != 3 {
+		t.Errorf("got locations %v, want 3 from front", first.Locations)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 2 {
+		t.Errorf("got stock %v while reserved, want 2 left", stock)
+	}
+
+	if _, status := reserve(t, store, "p1", 3, false); status != http.StatusNotAcceptable {
+		t.Errorf("reserving more than the stock: got status %d, want %d", status, http.StatusNotAcceptable)
+	}
+
+	// releasing returns the stock, committing keeps it taken
+	if w := request(t, store, releaseHandler, "/release?reservation_id="+first.Id, ""); w.Code != http.StatusOK {
+		t.Fatalf("releasing: got status %d: %s", w.Code, w.Body)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 5 {
+		t.Errorf("got stock %v after the release, want 5", stock)
+	}
+
+	second, _ := reserve(t, store, "p1", 2, false)
+	if w := request(t, store, commitHandler, "/commit?reservation_id="+second.Id, ""); w.Code != http.StatusOK {
+		t.Fatalf("committing: got status %d: %s", w.Code, w.Body)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 3 {
+		t.Errorf("got stock %v after the commit, want 3", stock)
+	}
+
+	for _, handler := range []handlerFunc{commitHandler, releaseHandler} {
+		if w := request(t, store, handler, "/?reservation_id="+second.Id, ""); w.Code != http.StatusNotFound {
+			t.Errorf("settling a committed reservation: got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestBackorderQueue(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 1)
+
+	if _, status := reserve(t, store, "p1", 3, true); status != http.StatusNotAcceptable {
+		t.Fatalf("backordering without a policy: got status %d, want %d", status, http.StatusNotAcceptable)
+	}
+
+	w := request(t, store, backorderHandler, "/backorder?product_id=p1", `{"mode":"backorder","cap":5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("setting the policy: got status %d: %s", w.Code, w.Body)
+	}
+
+	first, _ := reserve(t, store, "p1", 3, true)
+	second, _ := reserve(t, store, "p1", 1, true)
+	if first == nil || !first.Backordered || second == nil || !second.Backordered {
+		t.Fatalf("got reservations %+v and %+v, want both backordered", first, second)
+	}
+	// the second waits behind the first even though there is stock for it
+	if stock := stockOf(t, store, "p1"); stock.total() != 1 {
+		t.Errorf("got stock %v, want it untouched by the backorders", stock)
+	}
+
+	if _, status := reserve(t, store, "p1", 2, true); status != http.StatusNotAcceptable {
+		t.Errorf("backordering over the cap: got status %d, want %d", status, http.StatusNotAcceptable)
+	}
+
+	for _, res := range []*reservation{first, second} {
+		if w := request(t, store, commitHandler, "/commit?reservation_id="+res.Id, ""); w.Code != http.StatusOK {
+			t.Fatalf("committing: got status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// backorders are fulfilled in the order they were made
+	put(t, store, "p1", "back", 2)
+	if res, _ := store.Reservation(first.Id); !res.Fulfilled || res.Locations.total() != 3 {
+		t.Errorf("got first backorder %+v, want it fulfilled with 3", res)
+	}
+	if res, _ := store.Reservation(second.Id); res.Fulfilled {
+		t.Errorf("got second backorder %+v, want it waiting", res)
+	}
+
+	put(t, store, "p1", "back", 1)
+	if res, _ := store.Reservation(second.Id); !res.Fulfilled {
+		t.Errorf("got second backorder %+v, want it fulfilled", res)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 0 {
+		t.Errorf("got stock %v, want it all taken by the backorders", stock)
+	}
+}
+
+func TestReserveBatch(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 5)
+	put(t, store, "p2", "front", 1)
+
+	// the short line fails the whole batch
+	w := request(t, store, reserveBatchHandler, "/reserve/batch", `{"lines":[{"product_id":"p1","quantity":2},{"product_id":"p2","quantity":2}],"holder":"h"}`)
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotAcceptable, w.Body)
+	}
+	var failed struct {
+		Details []lineError `json:"details"`
+	}
+	json.NewDecoder(w.Body).Decode(&failed)
+	if len(failed.Details) != 1 || failed.Details[0].Line != 1 {
+		t.Errorf("got line errors %+v, want the second line", failed.Details)
+	}
+	if stock := stockOf(t, store, "p1"); stock.total() != 5 {
+		t.Errorf("got stock %v of p1, want the first line released", stock)
+	}
+
+	w = request(t, store, reserveBatchHandler, "/reserve/batch", `{"lines":[{"product_id":"p1","quantity":2},{"product_id":"p2","quantity":1}],"holder":"h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var res struct {
+		Reservations []reservation `json:"reservations"`
+	}
+	json.NewDecoder(w.Body).Decode(&res)
+	if len(res.Reservations) != 2 || res.Reservations[0].ProductID != "p1" || res.Reservations[1].ProductID != "p2" {
+		t.Fatalf("got reservations %+v, want one per line in order", res.Reservations)
+	}
+
+	body, _ := json.Marshal(map[string][]string{"reservation_ids": {res.Reservations[0].Id, res.Reservations[1].Id}})
+	if w := request(t, store, commitBatchHandler, "/commit/batch", string(body)); w.Code != http.StatusOK {
+		t.Fatalf("committing: got status %d: %s", w.Code, w.Body)
+	}
+	if stockOf(t, store, "p1").total() != 3 || stockOf(t, store, "p2").total() != 0 {
+		t.Errorf("got stock %v of p1 and %v of p2, want 3 and 0", stockOf(t, store, "p1"), stockOf(t, store, "p2"))
+	}
+}
+
+func TestCommitBatchExpired(t *testing.T) {
+	store := setupStock(t)
+	put(t, store, "p1", "front", 5)
+	put(t, store, "p2", "front", 5)
+
+	first, _ := reserve(t, store, "p1", 2, false)
+	second, _ := reserve(t, store, "p2", 3, false)
+	third, _ := reserve(t, store, "p1", 1, false)
+	if err := store.ReleaseReservation(second.Id, reasonExpire); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string][]string{"reservation_ids": {first.Id, second.Id, third.Id}})
+	if w := request(t, store, commitBatchHandler, "/commit/batch", string(body)); w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+
+	// none of them hold or take stock anymore
+	if stockOf(t, store, "p1").total() != 5 || stockOf(t, store, "p2").total() != 5 {
+		t.Errorf("got stock %v of p1 and %v of p2, want all of it back", stockOf(t, store, "p1"), stockOf(t, store, "p2"))
+	}
+	for _, res := range []*reservation{first, third} {
+		if _, err := store.Reservation(res.Id); err != ErrNotFound {
+			t.Errorf("reservation '%s' is left: %v", res.Id, err)
+		}
+	}
+}
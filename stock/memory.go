@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memoryStore is a StockStore which keeps everything in memory, it is used for
+// tests and running the service without Redis
+type memoryStore struct {
+	mu           sync.Mutex
+	stock        map[string]allocation
+	reservations map[string]reservation
+	history      map[string][]movement
+	lastMovement int64
+	thresholds   map[string]int64
+	alertStates  map[string]string
+	alerts       []alert
+	lastAlert    int64
+	policies     map[string]backorderPolicy
+	// backorders are the queues of backordered reservation ids by product
+	backorders map[string][]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		stock:        make(map[string]allocation),
+		reservations: make(map[string]reservation),
+		history:      make(map[string][]movement),
+		thresholds:   make(map[string]int64),
+		alertStates:  make(map[string]string),
+		policies:     make(map[string]backorderPolicy),
+		backorders:   make(map[string][]string),
+	}
+}
+
+// changeStock applies the change planned from the current stock of the
+// product and records it in the ledger, the caller has to hold the lock
+func (s *memoryStore) changeStock(productID string, plan func(stock allocation) (allocation, error), m movement) (allocation, error) {
+	stock := s.stock[productID]
+	if stock == nil {
+		stock = allocation{}
+	}
+
+	change, err := plan(stock)
+	if err != nil {
+		return nil, err
+	}
+
+	before := stock.total()
+	now := time.Now().UnixNano()
+	for _, location := range change.sortedLocations() {
+		stock[location] += change[location]
+
+		// ids are increasing like the ids of a Redis stream
+		s.lastMovement++
+		entry := m
+		entry.Id = fmt.Sprintf("%d-0", s.lastMovement)
+		entry.ProductID = productID
+		entry.Location = location
+		entry.Delta = change[location]
+		entry.Quantity = stock[location]
+		entry.At = now
+		s.history[productID] = append(s.history[productID], entry)
+	}
+
+	s.stock[productID] = stock
+	s.checkAlert(productID, before, stock.total(), now)
+	return change, nil
+}
+
+// checkAlert updates the alert state of the product after its total changed
+// and emits an alert if it has to, the caller has to hold the lock
+func (s *memoryStore) checkAlert(productID string, before, after, now int64) {
+	threshold := s.thresholds[productID]
+	state, emit := nextAlertState(s.alertStates[productID], before, after, threshold)
+	if state == "" {
+		delete(s.alertStates, productID)
+	} else {
+		s.alertStates[productID] = state
+	}
+
+	if !emit {
+		return
+	}
+
+	s.lastAlert++
+	s.alerts = append(s.alerts, alert{
+		Id:        fmt.Sprintf("%d-0", s.lastAlert),
+		ProductID: productID,
+		Level:     state,
+		Quantity:  after,
+		Threshold: threshold,
+		At:        now,
+	})
+	if len(s.alerts) > maxAlerts {
+		s.alerts = s.alerts[len(s.alerts)-maxAlerts:]
+	}
+}
+
+func (s *memoryStore) IncrQuantity(productID, location string, amount int64, m movement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.changeStock(productID, func(stock allocation) (allocation, error) {
+		if stock[location]+amount < 0 {
+			return nil, ErrInsufficientAmount
+		}
+
+		return allocation{location: amount}, nil
+	}, m)
+	return err
+}
+
+func (s *memoryStore) Drop(productID string, amount int64, strategy dropStrategy, m movement) (allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drop(productID, amount, strategy, m)
+}
+
+// drop is Drop for callers which already hold the lock
+func (s *memoryStore) drop(productID string, amount int64, strategy dropStrategy, m movement) (allocation, error) {
+	return s.changeStock(productID, func(stock allocation) (allocation, error) {
+		return planDrop(stock, amount, strategy)
+	}, m)
+}
+
+func (s *memoryStore) Transfer(productID, from, to string, amount int64, m movement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.changeStock(productID, func(stock allocation) (allocation, error) {
+		if stock[from] < amount {
+			return nil, ErrInsufficientAmount
+		}
+
+		return allocation{from: -amount, to: amount}, nil
+	}, m)
+	return err
+}
+
+func (s *memoryStore) Batch(lines []batchLine, strategy dropStrategy, m movement) ([]allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stocks := make(map[string]allocation)
+	for _, productID := range batchProductIDs(lines) {
+		stocks[productID] = s.stock[productID]
+	}
+
+	changes, taken, err := planBatch(stocks, lines, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	for productID, change := range changes {
+		s.changeStock(productID, func(stock allocation) (allocation, error) {
+			return change, nil
+		}, m)
+	}
+
+	return taken, nil
+}
+
+func (s *memoryStore) ProductStock(productID string) (allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stock, ok := s.stock[productID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copy := make(allocation, len(stock))
+	for location, quantity := range stock {
+		copy[location] = quantity
+	}
+
+	return copy, nil
+}
+
+func (s *memoryStore) Reserve(res reservation, strategy dropStrategy, backorder bool) (*reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	productID, quantity := res.ProductID, res.Quantity
+
+	// a backorder waits behind the ones already waiting even if there is
+	// stock for it
+	if !backorder || len(s.backorders[productID]) == 0 {
+		change, err := s.drop(productID, quantity, strategy, res.movement(reasonReserve))
+		if err == nil {
+			res.Locations = change.negate()
+			s.reservations[res.Id] = res
+			return &res, nil
+		}
+		if err != ErrInsufficientAmount || !backorder {
+			return nil, err
+		}
+	}
+
+	policy := s.backorderPolicy(productID)
+	if !policy.accepts(quantity) {
+		return nil, ErrInsufficientAmount
+	}
+
+	res.Backordered = true
+	s.reservations[res.Id] = res
+	s.backorders[productID] = append(s.backorders[productID], res.Id)
+	return &res, nil
+}
+
+func (s *memoryStore) Reservation(reservationID string) (*reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, ok := s.reservations[reservationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &res, nil
+}
+
+func (s *memoryStore) CommitReservation(reservationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, ok := s.reservations[reservationID]
+	if !ok || res.Committed || res.Fulfilled {
+		return ErrNotFound
+	}
+
+	if res.Backordered {
+		res.Committed = true
+		s.reservations[reservationID] = res
+		return nil
+	}
+
+	delete(s.reservations, reservationID)
+	return nil
+}
+
+func (s *memoryStore) ReleaseReservation(reservationID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, ok := s.reservations[reservationID]
+	if !ok || res.Fulfilled || (res.Committed && reason == reasonExpire) {
+		return ErrNotFound
+	}
+
+	delete(s.reservations, reservationID)
+	if res.Backordered {
+		s.removeBackorder(res.ProductID, reservationID)
+		return nil
+	}
+
+	_, err := s.changeStock(res.ProductID, func(stock allocation) (allocation, error) {
+		return res.taken(), nil
+	}, res.movement(reason))
+	return err
+}
+
+// removeBackorder removes the reservation from the queue of the product, the
+// caller has to hold the lock
+func (s *memoryStore) removeBackorder(productID, reservationID string) {
+	queue := s.backorders[productID]
+	for i, id := range queue {
+		if id == reservationID {
+			s.backorders[productID] = append(queue[:i:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *memoryStore) FulfillBackorders(productID string) ([]reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fulfilled []reservation
+	for len(s.backorders[productID]) > 0 {
+		res := s.reservations[s.backorders[productID][0]]
+		if !res.Committed {
+			break
+		}
+
+		change, err := s.drop(productID, res.Quantity, defaultDropStrategy, res.movement(reasonBackorder))
+		if err == ErrInsufficientAmount {
+			break
+		}
+		if err != nil {
+			return fulfilled, err
+		}
+
+		// fulfilled backorders are kept so their holders can find out
+		res.Locations = change.negate()
+		res.Fulfilled = true
+		s.reservations[res.Id] = res
+		s.backorders[productID] = s.backorders[productID][1:]
+		fulfilled = append(fulfilled, res)
+	}
+
+	return fulfilled, nil
+}
+
+func (s *memoryStore) SetBackorderPolicy(productID string, policy backorderPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if policy.Mode == "" {
+		delete(s.policies, productID)
+	} else {
+		s.policies[productID] = policy
+	}
+
+	return nil
+}
+
+func (s *memoryStore) BackorderPolicy(productID string) (backorderPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backorderPolicy(productID), nil
+}
+
+// backorderPolicy returns the policy of the product with the quantity waiting
+// in its queue, the caller has to hold the lock
+func (s *memoryStore) backorderPolicy(productID string) backorderPolicy {
+	policy := s.policies[productID]
+	for _, reservationID := range s.backorders[productID] {
+		policy.Backordered += s.reservations[reservationID].Quantity
+	}
+
+	return policy
+}
+
+func (s *memoryStore) ExpiredReservations(until time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []string
+	for id, res := range s.reservations {
+		if res.Committed || res.Fulfilled {
+			continue
+		}
+		if res.ExpiresAt <= until.UnixNano() {
+			expired = append(expired, id)
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *memoryStore) Movements(productID, startAfter string, maxItems int) ([]movement, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.history[productID]
+	end := len(history)
+	if startAfter != "" {
+		for end > 0 && history[end-1].Id != startAfter {
+			end--
+		}
+		if end > 0 {
+			end--
+		}
+	}
+
+	var movements []movement
+	for i := end - 1; i >= 0 && len(movements) < maxItems; i-- {
+		movements = append(movements, history[i])
+	}
+
+	nextKey := ""
+	if len(movements) == maxItems {
+		nextKey = movements[len(movements)-1].Id
+	}
+
+	return movements, nextKey, nil
+}
+
+func (s *memoryStore) SetThreshold(productID string, threshold int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if threshold == 0 {
+		delete(s.thresholds, productID)
+	} else {
+		s.thresholds[productID] = threshold
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Threshold(productID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.thresholds[productID], nil
+}
+
+// PendingAlerts polls for alerts since nothing signals new ones
+func (s *memoryStore) PendingAlerts(maxItems int, block time.Duration) ([]alert, error) {
+	deadline := time.Now().Add(block)
+	for {
+		s.mu.Lock()
+		n := len(s.alerts)
+		if n > maxItems {
+			n = maxItems
+		}
+		alerts := append([]alert(nil), s.alerts[:n]...)
+		s.mu.Unlock()
+
+		if len(alerts) > 0 || time.Now().After(deadline) {
+			return alerts, nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *memoryStore) AckAlert(alertID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.alerts {
+		if a.Id == alertID {
+			s.alerts = append(s.alerts[:i], s.alerts[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
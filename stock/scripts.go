@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// stockScript applies a list of stock operations atomically in a single round
+// trip. Every product of the request has five keys in KEYS: its aggregate
+// quantity, its quantities per location, its ledger stream, its threshold and
+// its alert state. The alerts stream follows them, then the hash of the
+// reservation and the reservations sorted set when the request stores or
+// claims a reservation. ARGV[1] is the JSON encoded stockRequest and ARGV[2]
+// the time of the movements, the fields of a stored reservation follow them.
+//
+// Operations either add a delta to a location or drop an amount from the
+// locations picked by the strategy, the same way planDrop does. They are
+// applied in order, an operation which would take a quantity below zero is
+// reported with the quantity it could have used and nothing is written then,
+// unless the request is partial and the other operations are still applied.
+//
+// The changes of the operations are recorded in the ledger together per
+// product and location with the movement of the request. Operations carrying
+// their own movement are recorded on their own. Products whose total stock
+// drops below their threshold or runs out get an alert, see nextAlertState.
+//
+// A reservation is stored together with the changes, its locations are what
+// the operations took. A claimed reservation is removed together with the
+// changes, and only if it is still in the reservations sorted set, otherwise
+// the result is missing and nothing is applied. This way reservations and the
+// stock they hold can't get out of step.
+const stockScriptSource = `
+local req = cjson.decode(ARGV[1])
+local now = ARGV[2]
+
+local function key(i, n)
+	return KEYS[5 * (i - 1) + n]
+end
+
+local alertsKey = KEYS[5 * #req.products + 1]
+local reservationKey = KEYS[5 * #req.products + 2]
+local reservationsKey = KEYS[5 * #req.products + 3]
+
+if req.claim and not redis.call('ZSCORE', reservationsKey, req.claim) then
+	return cjson.encode({missing = true})
+end
+
+local function total(stock)
+	local sum = 0
+	for _, quantity in pairs(stock) do
+		sum = sum + quantity
+	end
+	return sum
+end
+
+local function sortedKeys(t)
+	local keys = {}
+	for key in pairs(t) do
+		keys[#keys + 1] = key
+	end
+	table.sort(keys)
+	return keys
+end
+
+local function nextAlertState(state, before, after, threshold)
+	local level = false
+	if after <= 0 then
+		level = 'out_of_stock'
+	elseif after < threshold then
+		level = 'low_stock'
+	end
+
+	if not level then
+		return false, false
+	end
+	if state == 'out_of_stock' and level == 'low_stock' then
+		return level, false
+	end
+	if level == state or after >= before then
+		return state, false
+	end
+
+	return level, true
+end
+
+local stocks, before = {}, {}
+for i = 1, #req.products do
+	local stock = {}
+	local values = redis.call('HGETALL', key(i, 2))
+	for j = 1, #values, 2 do
+		stock[values[j]] = tonumber(values[j + 1])
+	end
+
+	-- stock put before there were locations is in the default location
+	local legacy = tonumber(redis.call('GET', key(i, 1)) or '0')
+	if #values == 0 and legacy > 0 then
+		stock[req.default] = legacy
+	end
+
+	stocks[i] = stock
+	before[i] = total(stock)
+end
+
+local priority = {}
+for i, location in ipairs(req.locations) do
+	priority[location] = i
+end
+
+local changes, failed, applied, entries = {}, {}, {}, {}
+for n, op in ipairs(req.ops) do
+	local stock = stocks[op.p]
+	local change = {}
+	local available = 0
+
+	if op.drop then
+		available = total(stock)
+		local strategy = op.strategy or req.strategy
+
+		local order = {}
+		for i, location in ipairs(req.locations) do
+			order[i] = location
+		end
+		if strategy == 'most_stock' then
+			table.sort(order, function(a, b)
+				local qa, qb = stock[a] or 0, stock[b] or 0
+				if qa ~= qb then
+					return qa > qb
+				end
+				return priority[a] < priority[b]
+			end)
+		end
+
+		local amount = op.drop
+		for _, location in ipairs(order) do
+			if amount == 0 then
+				break
+			end
+
+			local taken = math.min(stock[location] or 0, amount)
+			if taken > 0 then
+				change[location] = -taken
+				amount = amount - taken
+			end
+		end
+
+		if amount > 0 then
+			change = nil
+		end
+	else
+		available = stock[op.loc] or 0
+		if available + op.delta < 0 then
+			change = nil
+		else
+			change[op.loc] = op.delta
+		end
+	end
+
+	if change then
+		applied[op.p] = applied[op.p] or {}
+		for _, location in ipairs(sortedKeys(change)) do
+			local delta = change[location]
+			stock[location] = (stock[location] or 0) + delta
+			if op.m then
+				entries[#entries + 1] = {p = op.p, location = location, delta = delta, quantity = stock[location], m = op.m}
+			else
+				applied[op.p][location] = (applied[op.p][location] or 0) + delta
+			end
+		end
+		changes[#changes + 1] = {op = n - 1, change = change}
+	else
+		failed[#failed + 1] = {op = n - 1, available = available}
+	end
+end
+
+if #failed > 0 and not req.partial then
+	return cjson.encode({errors = failed})
+end
+
+if req.claim then
+	redis.call('ZREM', reservationsKey, req.claim)
+	redis.call('DEL', reservationKey)
+end
+
+if req.store then
+	local taken = {}
+	for _, c in ipairs(changes) do
+		for location, delta in pairs(c.change) do
+			taken[location] = (taken[location] or 0) - delta
+		end
+	end
+
+	local fields, id, expiresAt = {}, nil, nil
+	for i = 3, #ARGV, 2 do
+		local name, value = ARGV[i], ARGV[i + 1]
+		if name == 'Locations' then
+			value = cjson.encode(taken)
+		elseif name == 'Id' then
+			id = value
+		elseif name == 'ExpiresAt' then
+			expiresAt = value
+		end
+		fields[#fields + 1] = name
+		fields[#fields + 1] = value
+	end
+	redis.call('HSET', reservationKey, unpack(fields))
+	redis.call('ZADD', reservationsKey, expiresAt, id)
+end
+
+for i, change in pairs(applied) do
+	for _, location in ipairs(sortedKeys(change)) do
+		entries[#entries + 1] = {p = i, location = location, delta = change[location], quantity = stocks[i][location], m = req.movement}
+	end
+end
+
+for _, entry in ipairs(entries) do
+	local m = entry.m
+	redis.call('XADD', key(entry.p, 3), '*',
+		'ProductID', req.products[entry.p], 'Location', entry.location,
+		'Delta', entry.delta, 'Quantity', entry.quantity,
+		'Reason', m.reason, 'Source', m.source, 'Reference', m.reference,
+		'At', now)
+end
+
+for i in pairs(applied) do
+	local stock = stocks[i]
+
+	local args = {}
+	for _, location in ipairs(sortedKeys(stock)) do
+		args[#args + 1] = location
+		args[#args + 1] = stock[location]
+	end
+	redis.call('HSET', key(i, 2), unpack(args))
+
+	local after = total(stock)
+	redis.call('SET', key(i, 1), after)
+
+	local threshold = tonumber(redis.call('GET', key(i, 4)) or '0')
+	local state = redis.call('GET', key(i, 5))
+	local nextState, emit = nextAlertState(state, before[i], after, threshold)
+	if nextState ~= state then
+		if nextState then
+			redis.call('SET', key(i, 5), nextState)
+		else
+			redis.call('DEL', key(i, 5))
+		end
+	end
+	if emit then
+		redis.call('XADD', alertsKey, 'MAXLEN', '~', req.max_alerts, '*',
+			'ProductID', req.products[i], 'Level', nextState,
+			'Quantity', after, 'Threshold', threshold, 'At', now)
+	end
+end
+
+-- empty tables can't be told apart from empty objects, so they are left out
+local res = {}
+if #changes > 0 then
+	res.changes = changes
+end
+if #failed > 0 then
+	res.errors = failed
+end
+if next(res) == nil then
+	return '{}'
+end
+return cjson.encode(res)
+`
+
+var stockScript = redis.NewScript(-1, stockScriptSource)
+
+// stockOp is an operation of stockScript on the product with the 1 based
+// index P, it either adds Delta to Location or drops Drop by the strategy.
+// Strategy and Movement override the ones of the request.
+type stockOp struct {
+	P        int          `json:"p"`
+	Location string       `json:"loc,omitempty"`
+	Delta    int64        `json:"delta"`
+	Drop     int64        `json:"drop,omitempty"`
+	Strategy dropStrategy `json:"strategy,omitempty"`
+	Movement *movement    `json:"m,omitempty"`
+}
+
+// stockRequest is the payload of stockScript. A partial request applies the
+// operations which can be applied even if others fail. Reservation is stored
+// with the locations the operations took, Claim is the id of a reservation
+// which is removed, see stockScript.
+type stockRequest struct {
+	Products    []string     `json:"products"`
+	Ops         []stockOp    `json:"ops"`
+	Strategy    dropStrategy `json:"strategy"`
+	Partial     bool         `json:"partial,omitempty"`
+	Locations   []string     `json:"locations"`
+	Default     string       `json:"default"`
+	Movement    movement     `json:"movement"`
+	MaxAlerts   int          `json:"max_alerts"`
+	Reservation *reservation `json:"-"`
+	Store       bool         `json:"store,omitempty"`
+	Claim       string       `json:"claim,omitempty"`
+}
+
+// stockOpError is an operation stockScript couldn't apply, Op is its index
+type stockOpError struct {
+	Op        int   `json:"op"`
+	Available int64 `json:"available"`
+}
+
+// stockResult is the result of stockScript, Changes has the change of every
+// operation and is nil when nothing was applied. Missing is set when the
+// claimed reservation was gone.
+type stockResult struct {
+	Changes []allocation
+	Errors  []stockOpError
+	Missing bool
+}
+
+// productIndex returns the 1 based index of the product in the request, adding
+// it if it isn't there yet
+func (r *stockRequest) productIndex(productID string) int {
+	for i, id := range r.Products {
+		if id == productID {
+			return i + 1
+		}
+	}
+
+	r.Products = append(r.Products, productID)
+	return len(r.Products)
+}
+
+func (r *stockRequest) add(productID, location string, delta int64) {
+	r.Ops = append(r.Ops, stockOp{P: r.productIndex(productID), Location: location, Delta: delta})
+}
+
+func (r *stockRequest) drop(productID string, amount int64) {
+	r.Ops = append(r.Ops, stockOp{P: r.productIndex(productID), Drop: amount})
+}
+
+// dbRunStockScript runs the operations of the request, the result has the
+// change of every operation and the operations which failed. When an operation
+// of a request which isn't partial fails there are no changes, otherwise the
+// failed operations have an empty change.
+func dbRunStockScript(db redis.Conn, req *stockRequest) (*stockResult, error) {
+	req.Locations = locations
+	req.Default = defaultLocation()
+	req.MaxAlerts = maxAlerts
+	if req.Strategy == "" {
+		req.Strategy = defaultDropStrategy
+	}
+	req.Store = req.Reservation != nil
+	// nil slices would be encoded as null, which the script can't iterate
+	if req.Products == nil {
+		req.Products = []string{}
+	}
+	if req.Ops == nil {
+		req.Ops = []stockOp{}
+	}
+
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := redis.Args{}
+	for _, productID := range req.Products {
+		keys = keys.Add("stock:"+productID, locationsKey(productID), historyKey(productID), thresholdKey(productID), alertStateKey(productID))
+	}
+	keys = keys.Add(alertsKey)
+
+	reservationID := req.Claim
+	if req.Reservation != nil {
+		reservationID = req.Reservation.Id
+	}
+	if reservationID != "" {
+		keys = keys.Add(reservationKey(reservationID), "reservations")
+	}
+
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(reqBytes, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if req.Reservation != nil {
+		args = args.AddFlat(req.Reservation)
+	}
+
+	resBytes, err := redis.Bytes(stockScript.Do(db, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Changes []struct {
+			Op     int        `json:"op"`
+			Change allocation `json:"change"`
+		} `json:"changes"`
+		Errors  []stockOpError `json:"errors"`
+		Missing bool           `json:"missing"`
+	}
+	if err := json.Unmarshal(resBytes, &payload); err != nil {
+		return nil, err
+	}
+
+	res := stockResult{Errors: payload.Errors, Missing: payload.Missing}
+	if len(payload.Changes) > 0 {
+		res.Changes = make([]allocation, len(req.Ops))
+		for _, change := range payload.Changes {
+			res.Changes[change.Op] = change.Change
+		}
+	}
+
+	return &res, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// scriptConn returns a connection to the Redis at REDIS_HOST and a product id
+// of its own, the test is skipped without Redis
+func scriptConn(t *testing.T) (redis.Conn, string) {
+	t.Helper()
+
+	t.Setenv("STOCK_LOCATIONS", "front,back")
+	if err := loadLocations(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := redisPool(t).Get()
+	t.Cleanup(func() { db.Close() })
+
+	return db, fmt.Sprintf("test-%d", time.Now().UnixNano())
+}
+
+func locationsOf(t *testing.T, db redis.Conn, productID string) allocation {
+	t.Helper()
+
+	stock, err := dbGetLocations(db, productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stock
+}
+
+func movementsOf(t *testing.T, db redis.Conn, productID string) []movement {
+	t.Helper()
+
+	movements, _, err := dbGetMovements(db, productID, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return movements
+}
+
+func seed(t *testing.T, db redis.Conn, productID string, stock allocation) {
+	t.Helper()
+
+	if err := dbReturn(db, productID, stock, movement{Reason: reasonPut}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStockScriptDrop(t *testing.T) {
+	db, productID := scriptConn(t)
+	seed(t, db, productID, allocation{"front": 2, "back": 3})
+
+	// the locations are drained in their priority order
+	taken, err := dbDrop(db, productID, 3, strategyPriority, movement{Reason: reasonDrop, Reference: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(taken) != fmt.Sprint(allocation{"front": -2, "back": -1}) {
+		t.Errorf("got change %v, want 2 from front and 1 from back", taken)
+	}
+	if stock := locationsOf(t, db, productID); stock["front"] != 0 || stock["back"] != 2 {
+		t.Errorf("got stock %v, want 2 left in back", stock)
+	}
+	if total, _ := redis.Int64(db.Do("GET", "stock:"+productID)); total != 2 {
+		t.Errorf("got aggregate quantity %d, want 2", total)
+	}
+
+	// every location of the drop is recorded with the movement
+	movements := movementsOf(t, db, productID)
+	if len(movements) != 4 {
+		t.Fatalf("got %d movements, want 2 puts and 2 drops", len(movements))
+	}
+	for _, m := range movements[:2] {
+		if m.Reason != reasonDrop || m.Reference != "r1" || m.Quantity != locationsOf(t, db, productID)[m.Location] {
+			t.Errorf("got movement %+v, want the drop with the quantity left", m)
+		}
+	}
+
+	seed(t, db, productID, allocation{"front": 1})
+	if taken, _ := dbDrop(db, productID, 2, strategyMostStock, movement{Reason: reasonDrop}); fmt.Sprint(taken) != fmt.Sprint(allocation{"back": -2}) {
+		t.Errorf("got change %v, want 2 from back which has the most", taken)
+	}
+}
+
+func TestStockScriptBelowZero(t *testing.T) {
+	db, productID := scriptConn(t)
+	otherID := productID + "-other"
+	seed(t, db, productID, allocation{"front": 2, "back": 1})
+	seed(t, db, otherID, allocation{"front": 5})
+
+	req := stockRequest{Movement: movement{Reason: reasonBatch}}
+	req.add(otherID, "front", -1)
+	req.drop(productID, 4)
+	req.add(productID, "back", -2)
+	res, err := dbRunStockScript(db, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []stockOpError{{Op: 1, Available: 3}, {Op: 2, Available: 1}}
+	if fmt.Sprint(res.Errors) != fmt.Sprint(want) || res.Changes != nil {
+		t.Errorf("got errors %v with changes %v, want %v without changes", res.Errors, res.Changes, want)
+	}
+
+	// the operation which could be applied isn't either
+	if stock := locationsOf(t, db, otherID); stock["front"] != 5 {
+		t.Errorf("got stock %v of the other product, want it untouched", stock)
+	}
+	if movements := movementsOf(t, db, otherID); len(movements) != 1 {
+		t.Errorf("got %d movements of the other product, want only its put", len(movements))
+	}
+
+	if _, err := dbApplyStock(db, &req); err != ErrInsufficientAmount {
+		t.Errorf("got %v, want %v", err, ErrInsufficientAmount)
+	}
+}
+
+func TestStockScriptLegacy(t *testing.T) {
+	db, productID := scriptConn(t)
+
+	// stock put before there were locations
+	db.Do("SET", "stock:"+productID, 4)
+
+	if _, err := dbDrop(db, productID, 1, strategyPriority, movement{Reason: reasonDrop}); err != nil {
+		t.Fatal(err)
+	}
+	if stock := locationsOf(t, db, productID); fmt.Sprint(stock) != fmt.Sprint(allocation{defaultLocation(): 3}) {
+		t.Errorf("got stock %v, want 3 left in the default location", stock)
+	}
+}
+
+func TestStockScriptReservation(t *testing.T) {
+	db, productID := scriptConn(t)
+	seed(t, db, productID, allocation{"front": 1, "back": 4})
+
+	res := newReservation(productID, "h", 3, time.Minute)
+	req := stockRequest{Movement: res.movement(reasonReserve), Reservation: &res}
+	req.drop(productID, res.Quantity)
+	if _, err := dbApplyStock(db, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reservation is stored with what the drop took
+	stored, err := dbGetReservation(db, res.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stored.Locations) != fmt.Sprint(allocation{"front": 1, "back": 2}) {
+		t.Errorf("got locations %v of the stored reservation, want 1 from front and 2 from back", stored.Locations)
+	}
+	if _, err := redis.Int64(db.Do("ZSCORE", "reservations", res.Id)); err != nil {
+		t.Errorf("reservation isn't scheduled to expire: %v", err)
+	}
+
+	// a reservation which can't take its stock isn't stored
+	short := newReservation(productID, "h", 9, time.Minute)
+	req = stockRequest{Movement: short.movement(reasonReserve), Reservation: &short}
+	req.drop(productID, short.Quantity)
+	if _, err := dbApplyStock(db, &req); err != ErrInsufficientAmount {
+		t.Fatalf("got %v, want %v", err, ErrInsufficientAmount)
+	}
+	if _, err := dbGetReservation(db, short.Id); err != redis.ErrNil {
+		t.Errorf("reservation without stock is stored: %v", err)
+	}
+
+	if err := dbClaimReservation(db, stored, stored.taken(), stored.movement(reasonRelease)); err != nil {
+		t.Fatal(err)
+	}
+	if stock := locationsOf(t, db, productID); stock.total() != 5 {
+		t.Errorf("got stock %v after the release, want all 5 back", stock)
+	}
+
+	// the stock of a missing reservation isn't returned again
+	if err := dbClaimReservation(db, stored, stored.taken(), stored.movement(reasonRelease)); err != redis.ErrNil {
+		t.Errorf("claiming a missing reservation: got %v, want %v", err, redis.ErrNil)
+	}
+	if stock := locationsOf(t, db, productID); stock.total() != 5 {
+		t.Errorf("got stock %v after claiming again, want 5", stock)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// StockStore keeps the stock quantities per location and the reservations.
+// Methods return ErrNotFound when the product stock or the reservation doesn't
+// exist, and ErrInsufficientAmount when a quantity would drop below zero.
+//
+// Every change of a quantity is recorded in the ledger of the product together
+// with the change itself, the reason, source and reference of m are recorded
+// with it. When a change takes the total quantity of a product below its
+// threshold or to zero an alert is emitted, see nextAlertState.
+type StockStore interface {
+	// IncrQuantity adds amount to the stock in the location
+	IncrQuantity(productID, location string, amount int64, m movement) error
+	// Drop takes amount from the locations picked by the strategy and returns
+	// how much was taken from each
+	Drop(productID string, amount int64, strategy dropStrategy, m movement) (allocation, error)
+	// Transfer moves amount from one location to the other atomically
+	Transfer(productID, from, to string, amount int64, m movement) error
+	// Batch applies every line or none of them, it returns the change each
+	// line made per location. Lines which can't be applied are listed in a
+	// *batchError.
+	Batch(lines []batchLine, strategy dropStrategy, m movement) ([]allocation, error)
+	// ProductStock returns the quantities of the product per location
+	ProductStock(productID string) (allocation, error)
+	// Reserve takes the quantity of the new reservation from the stock. If
+	// there isn't enough and backorder is set, the reservation is backordered
+	// when the policy of the product has room for it.
+	Reserve(res reservation, strategy dropStrategy, backorder bool) (*reservation, error)
+	// Reservation returns a pending or backordered reservation, fulfilled
+	// backorders are kept for a while
+	Reservation(reservationID string) (*reservation, error)
+	// CommitReservation settles the reservation, a backorder stays queued
+	// without expiring until its stock arrives
+	CommitReservation(reservationID string) error
+	// ReleaseReservation returns the reserved quantity to the stock, reason is
+	// recorded in the ledger. Backorders are removed from the queue.
+	ReleaseReservation(reservationID, reason string) error
+	// FulfillBackorders hands the stock of the product to its committed
+	// backorders in the order they were made and returns the fulfilled ones
+	FulfillBackorders(productID string) ([]reservation, error)
+	SetBackorderPolicy(productID string, policy backorderPolicy) error
+	BackorderPolicy(productID string) (backorderPolicy, error)
+	ExpiredReservations(until time.Time) ([]string, error)
+	// Movements returns the ledger of the product newest first, starting after
+	// the movement with the id startAfter
+	Movements(productID, startAfter string, maxItems int) ([]movement, string, error)
+	// SetThreshold sets the total quantity below which the product is low on
+	// stock, zero removes the threshold
+	SetThreshold(productID string, threshold int64) error
+	Threshold(productID string) (int64, error)
+	// PendingAlerts returns the alerts which weren't acknowledged yet, waiting
+	// up to block for new ones. It is called by a single goroutine.
+	PendingAlerts(maxItems int, block time.Duration) ([]alert, error)
+	AckAlert(alertID string) error
+}
+
+type redisStore struct {
+	pool    *redis.Pool
+	workers *quantityWorkers
+
+	// alerts are read as alertsConsumer of the alerts group, starting from
+	// alertsStart
+	alertsConsumer string
+	alertsStart    string
+}
+
+// newRedisStore loads stockScript so the first changes don't have to send it,
+// if that fails the script is sent with the first EVALSHA which misses it.
+// Puts and drops go through workers which coalesce them.
+func newRedisStore(pool *redis.Pool, workers int) *redisStore {
+	db := pool.Get()
+	defer db.Close()
+	if err := stockScript.Load(db); err != nil {
+		log.Printf("ERROR: failed to load the stock script: %v\n", err)
+	}
+
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = "stock"
+	}
+
+	s := &redisStore{pool: pool, alertsConsumer: consumer}
+	s.workers = startQuantityWorkers(workers, s.applyQuantityOps)
+	return s
+}
+
+func (s *redisStore) applyQuantityOps(ops []*quantityOp) []error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbApplyQuantityOps(db, ops)
+}
+
+func (s *redisStore) IncrQuantity(productID, location string, amount int64, m movement) error {
+	return s.workers.do(&quantityOp{product: productID, location: location, amount: amount, m: m})
+}
+
+func (s *redisStore) Drop(productID string, amount int64, strategy dropStrategy, m movement) (allocation, error) {
+	op := quantityOp{product: productID, amount: -amount, strategy: strategy, m: m}
+	if err := s.workers.do(&op); err != nil {
+		return nil, err
+	}
+
+	return op.taken, nil
+}
+
+func (s *redisStore) Transfer(productID, from, to string, amount int64, m movement) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbTransfer(db, productID, from, to, amount, m)
+}
+
+func (s *redisStore) Batch(lines []batchLine, strategy dropStrategy, m movement) ([]allocation, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbBatch(db, lines, strategy, m)
+}
+
+func (s *redisStore) ProductStock(productID string) (allocation, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	stock, err := dbGetLocations(db, productID)
+	return stock, notFound(err)
+}
+
+func (s *redisStore) Reserve(res reservation, strategy dropStrategy, backorder bool) (*reservation, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbReserve(db, res, strategy, backorder)
+}
+
+func (s *redisStore) Reservation(reservationID string) (*reservation, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	res, err := dbGetReservation(db, reservationID)
+	return res, notFound(err)
+}
+
+func (s *redisStore) CommitReservation(reservationID string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return notFound(dbCommitReservation(db, reservationID))
+}
+
+func (s *redisStore) ReleaseReservation(reservationID, reason string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return notFound(dbReleaseReservation(db, reservationID, reason))
+}
+
+func (s *redisStore) FulfillBackorders(productID string) ([]reservation, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbFulfillBackorders(db, productID)
+}
+
+func (s *redisStore) SetBackorderPolicy(productID string, policy backorderPolicy) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbSetBackorderPolicy(db, productID, policy)
+}
+
+func (s *redisStore) BackorderPolicy(productID string) (backorderPolicy, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetBackorderPolicy(db, productID)
+}
+
+func (s *redisStore) ExpiredReservations(until time.Time) ([]string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbExpiredReservations(db, until)
+}
+
+func (s *redisStore) Movements(productID, startAfter string, maxItems int) ([]movement, string, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetMovements(db, productID, startAfter, maxItems)
+}
+
+// notFound translates the missing key error of redigo to ErrNotFound
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (s *redisStore) SetThreshold(productID string, threshold int64) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbSetThreshold(db, productID, threshold)
+}
+
+func (s *redisStore) Threshold(productID string) (int64, error) {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbGetThreshold(db, productID)
+}
+
+func (s *redisStore) PendingAlerts(maxItems int, block time.Duration) ([]alert, error) {
+	db := s.pool.Get()
+	defer db.Close()
+
+	// alerts which were read but not acknowledged before a restart are
+	// delivered first
+	if s.alertsStart == "" {
+		if err := dbCreateAlertsGroup(db); err != nil {
+			return nil, err
+		}
+		s.alertsStart = "0"
+	}
+
+	alerts, err := dbReadAlerts(db, s.alertsConsumer, s.alertsStart, maxItems, block)
+	if err == nil && len(alerts) == 0 && s.alertsStart == "0" {
+		s.alertsStart = ">"
+	}
+
+	return alerts, err
+}
+
+func (s *redisStore) AckAlert(alertID string) error {
+	db := s.pool.Get()
+	defer db.Close()
+	return dbAckAlert(db, alertID)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// eachStore runs test against the memory store and the Redis at REDIS_HOST, the
+// Redis run is skipped without one. Products get ids of their own in every run
+// so runs don't see each other's stock.
+func eachStore(t *testing.T, test func(t *testing.T, store StockStore, productID string)) {
+	t.Setenv("STOCK_LOCATIONS", "front,back")
+	if err := loadLocations(); err != nil {
+		t.Fatal(err)
+	}
+
+	productID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(), productID)
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, newRedisStore(redisPool(t), 4), productID)
+	})
+}
+
+// redisPool returns a pool of the Redis at REDIS_HOST, the test is skipped
+// without one
+func redisPool(t *testing.T) *redis.Pool {
+	t.Helper()
+
+	pool := service.NewPool()
+	t.Cleanup(func() { pool.Close() })
+
+	db := pool.Get()
+	_, err := db.Do("PING")
+	db.Close()
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	return pool
+}
+
+func total(t *testing.T, store StockStore, productID string) int64 {
+	t.Helper()
+
+	stock, err := store.ProductStock(productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stock.total()
+}
+
+func TestStoreReservation(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		if err := store.IncrQuantity(productID, "front", 5, movement{Reason: reasonPut}); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := store.Reserve(newReservation(productID, "h", 3, time.Minute), strategyPriority, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Locations["front"] != 3 || total(t, store, productID) != 2 {
+			t.Errorf("got locations %v with %d left, want 3 from front and 2 left", res.Locations, total(t, store, productID))
+		}
+		if stored, err := store.Reservation(res.Id); err != nil || stored.Quantity != 3 || stored.Locations["front"] != 3 {
+			t.Errorf("got stored reservation %+v, %v", stored, err)
+		}
+
+		// nothing is taken when there isn't enough
+		if _, err := store.Reserve(newReservation(productID, "h", 3, time.Minute), strategyPriority, false); err != ErrInsufficientAmount {
+			t.Errorf("reserving more than the stock: got %v, want %v", err, ErrInsufficientAmount)
+		}
+		if left := total(t, store, productID); left != 2 {
+			t.Errorf("got %d left after the failed reservation, want 2", left)
+		}
+
+		if err := store.CommitReservation(res.Id); err != nil {
+			t.Fatal(err)
+		}
+		if left := total(t, store, productID); left != 2 {
+			t.Errorf("got %d left after the commit, want 2", left)
+		}
+
+		// a settled reservation is missing for everyone after it
+		if _, err := store.Reservation(res.Id); err != ErrNotFound {
+			t.Errorf("getting a committed reservation: got %v, want %v", err, ErrNotFound)
+		}
+		if err := store.CommitReservation(res.Id); err != ErrNotFound {
+			t.Errorf("committing again: got %v, want %v", err, ErrNotFound)
+		}
+		if err := store.ReleaseReservation(res.Id, reasonRelease); err != ErrNotFound {
+			t.Errorf("releasing a committed reservation: got %v, want %v", err, ErrNotFound)
+		}
+		if left := total(t, store, productID); left != 2 {
+			t.Errorf("got %d left after settling again, want 2", left)
+		}
+	})
+}
+
+func TestStoreExpiredReservations(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		store.IncrQuantity(productID, "front", 5, movement{Reason: reasonPut})
+
+		expired, _ := store.Reserve(newReservation(productID, "h", 2, -time.Second), strategyPriority, false)
+		pending, _ := store.Reserve(newReservation(productID, "h", 1, time.Minute), strategyPriority, false)
+
+		ids, err := store.ExpiredReservations(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, id := range ids {
+			found[id] = true
+		}
+		if !found[expired.Id] || found[pending.Id] {
+			t.Errorf("got expired reservations %v, want '%s' without '%s'", ids, expired.Id, pending.Id)
+		}
+
+		if err := store.ReleaseReservation(expired.Id, reasonExpire); err != nil {
+			t.Fatal(err)
+		}
+		if left := total(t, store, productID); left != 4 {
+			t.Errorf("got %d left after the expiry, want 4", left)
+		}
+	})
+}
+
+func TestStoreReleaseConcurrent(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		store.IncrQuantity(productID, "front", 5, movement{Reason: reasonPut})
+		res, err := store.Reserve(newReservation(productID, "h", 3, time.Minute), strategyPriority, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the reaper, a release and a commit racing for the reservation
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if i == 0 {
+					errs[i] = store.CommitReservation(res.Id)
+				} else {
+					errs[i] = store.ReleaseReservation(res.Id, reasonRelease)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		settled := 0
+		for _, err := range errs {
+			if err == nil {
+				settled++
+			} else if err != ErrNotFound {
+				t.Fatal(err)
+			}
+		}
+		if settled != 1 {
+			t.Fatalf("reservation was settled %d times, want once", settled)
+		}
+
+		want := int64(5)
+		if errs[0] == nil {
+			want = 2
+		}
+		if left := total(t, store, productID); left != want {
+			t.Errorf("got %d left, want %d", left, want)
+		}
+	})
+}
+
+func TestStoreBackorders(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		store.IncrQuantity(productID, "front", 1, movement{Reason: reasonPut})
+
+		if _, err := store.Reserve(newReservation(productID, "h", 3, time.Minute), strategyPriority, true); err != ErrInsufficientAmount {
+			t.Fatalf("backordering without a policy: got %v, want %v", err, ErrInsufficientAmount)
+		}
+
+		if err := store.SetBackorderPolicy(productID, backorderPolicy{Mode: backorderAllowed, Cap: 5}); err != nil {
+			t.Fatal(err)
+		}
+		first, err := store.Reserve(newReservation(productID, "h", 3, time.Minute), strategyPriority, true)
+		if err != nil || !first.Backordered {
+			t.Fatalf("got %+v, %v, want a backorder", first, err)
+		}
+		// the second waits behind the first even though there is stock for it
+		second, err := store.Reserve(newReservation(productID, "h", 1, time.Minute), strategyPriority, true)
+		if err != nil || !second.Backordered {
+			t.Fatalf("got %+v, %v, want a backorder", second, err)
+		}
+		if _, err := store.Reserve(newReservation(productID, "h", 2, time.Minute), strategyPriority, true); err != ErrInsufficientAmount {
+			t.Errorf("backordering over the cap: got %v, want %v", err, ErrInsufficientAmount)
+		}
+		if policy, _ := store.BackorderPolicy(productID); policy.Backordered != 4 {
+			t.Errorf("got policy %+v, want 4 backordered", policy)
+		}
+
+		if err := store.ReleaseReservation(second.Id, reasonRelease); err != nil {
+			t.Fatal(err)
+		}
+		if policy, _ := store.BackorderPolicy(productID); policy.Backordered != 3 {
+			t.Errorf("got policy %+v after the release, want 3 backordered", policy)
+		}
+
+		// committed backorders wait for their stock without expiring
+		if err := store.CommitReservation(first.Id); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.ReleaseReservation(first.Id, reasonExpire); err != ErrNotFound {
+			t.Errorf("expiring a committed backorder: got %v, want %v", err, ErrNotFound)
+		}
+
+		if fulfilled, err := store.FulfillBackorders(productID); err != nil || len(fulfilled) != 0 {
+			t.Fatalf("got fulfilled %+v, %v without the stock for them", fulfilled, err)
+		}
+		store.IncrQuantity(productID, "back", 2, movement{Reason: reasonPut})
+		fulfilled, err := store.FulfillBackorders(productID)
+		if err != nil || len(fulfilled) != 1 || fulfilled[0].Id != first.Id {
+			t.Fatalf("got fulfilled %+v, %v, want the first backorder", fulfilled, err)
+		}
+
+		if res, err := store.Reservation(first.Id); err != nil || !res.Fulfilled || fmt.Sprint(res.Locations) != fmt.Sprint(allocation{"front": 1, "back": 2}) {
+			t.Errorf("got backorder %+v, %v, want it fulfilled from both locations", res, err)
+		}
+		if left := total(t, store, productID); left != 0 {
+			t.Errorf("got %d left, want everything taken by the backorder", left)
+		}
+		if policy, _ := store.BackorderPolicy(productID); policy.Backordered != 0 {
+			t.Errorf("got policy %+v, want nothing backordered", policy)
+		}
+		if err := store.ReleaseReservation(first.Id, reasonRelease); err != ErrNotFound {
+			t.Errorf("releasing a fulfilled backorder: got %v, want %v", err, ErrNotFound)
+		}
+	})
+}
+
+func TestStoreBackorderCap(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		store.SetBackorderPolicy(productID, backorderPolicy{Mode: backorderPreorder, Cap: 5})
+
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = store.Reserve(newReservation(productID, "h", 1, time.Minute), strategyPriority, true)
+			}(i)
+		}
+		wg.Wait()
+
+		backordered := 0
+		for _, err := range errs {
+			if err == nil {
+				backordered++
+			} else if err != ErrInsufficientAmount {
+				t.Fatal(err)
+			}
+		}
+
+		// concurrent backorders can't exceed the cap together
+		if policy, _ := store.BackorderPolicy(productID); backordered != 5 || policy.Backordered != 5 {
+			t.Errorf("got %d backorders with %d backordered, want 5", backordered, policy.Backordered)
+		}
+	})
+}
+
+func TestStoreBatch(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		otherID := productID + "-other"
+		store.IncrQuantity(productID, "front", 1, movement{Reason: reasonPut})
+		store.IncrQuantity(otherID, "front", 2, movement{Reason: reasonPut})
+
+		// a line sees the stock the lines before it left, and a failing line
+		// fails all of them
+		lines := []batchLine{
+			{ProductID: productID, Op: batchPut, Quantity: 2, Location: "back"},
+			{ProductID: productID, Op: batchDrop, Quantity: 3},
+			{ProductID: otherID, Op: batchDrop, Quantity: 5},
+		}
+		_, err := store.Batch(lines, strategyPriority, movement{Reason: reasonBatch})
+		var batchErr *batchError
+		if !errors.As(err, &batchErr) || len(batchErr.Lines) != 1 {
+			t.Fatalf("got %v, want the third line to fail", err)
+		}
+		if line := batchErr.Lines[0]; line.Line != 2 || line.Available == nil || *line.Available != 2 {
+			t.Errorf("got line error %+v, want the third line with 2 available", line)
+		}
+		if total(t, store, productID) != 1 || total(t, store, otherID) != 2 {
+			t.Errorf("got %d and %d left after the failed batch, want 1 and 2", total(t, store, productID), total(t, store, otherID))
+		}
+
+		lines[2].Quantity = 2
+		changes, err := store.Batch(lines, strategyPriority, movement{Reason: reasonBatch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(changes[1]) != fmt.Sprint(allocation{"front": -1, "back": -2}) {
+			t.Errorf("got change %v of the drop, want 1 from front and 2 from back", changes[1])
+		}
+		if total(t, store, productID) != 0 || total(t, store, otherID) != 0 {
+			t.Errorf("got %d and %d left after the batch, want nothing", total(t, store, productID), total(t, store, otherID))
+		}
+	})
+}
+
+func TestStoreTransfer(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		store.IncrQuantity(productID, "front", 3, movement{Reason: reasonPut})
+
+		if err := store.Transfer(productID, "front", "back", 2, movement{Reason: reasonTransfer}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Transfer(productID, "front", "back", 2, movement{Reason: reasonTransfer}); err != ErrInsufficientAmount {
+			t.Errorf("transferring more than the location has: got %v, want %v", err, ErrInsufficientAmount)
+		}
+
+		stock, _ := store.ProductStock(productID)
+		if fmt.Sprint(stock) != fmt.Sprint(allocation{"front": 1, "back": 2}) {
+			t.Errorf("got stock %v, want 1 in front and 2 in back", stock)
+		}
+	})
+}
+
+func TestStoreMovements(t *testing.T) {
+	eachStore(t, func(t *testing.T, store StockStore, productID string) {
+		for i := 0; i < 5; i++ {
+			store.IncrQuantity(productID, "front", 1, movement{Reason: reasonPut, Reference: fmt.Sprintf("r%d", i)})
+		}
+
+		// the ledger is paged from the newest movement backwards
+		var pages []string
+		startAfter := ""
+		for {
+			movements, nextKey, err := store.Movements(productID, startAfter, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			page := ""
+			for _, m := range movements {
+				page += fmt.Sprintf("%s:%d ", m.Reference, m.Quantity)
+			}
+			pages = append(pages, page)
+
+			if nextKey == "" {
+				break
+			}
+			startAfter = nextKey
+		}
+
+		want := []string{"r4:5 r3:4 ", "r2:3 r1:2 ", "r0:1 "}
+		if fmt.Sprint(pages) != fmt.Sprint(want) {
+			t.Errorf("got pages %q, want %q", pages, want)
+		}
+	})
+}
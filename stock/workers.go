@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/umurgdk/markeet/internal/service"
+)
+
+// Maximum number of ops a worker writes at once
+const maxCoalescedOps = 64
+
+// quantityOp is a put or drop waiting for a worker. Amount is negative for
+// drops, drops without a location take from the locations picked by the
+// strategy. The worker sets taken to what the op changed per location before
+// it replies on cb.
+type quantityOp struct {
+	product  string
+	location string
+	amount   int64
+	strategy dropStrategy
+	m        movement
+	taken    allocation
+	cb       chan error
+}
+
+// quantityWorkers serializes the puts and drops of a product. Products are
+// spread over the shards by their id, each shard has a single goroutine which
+// takes the ops queued while it was writing and applies them with one write,
+// so concurrent changes of a hot product don't contend with each other.
+type quantityWorkers struct {
+	shards []chan *quantityOp
+	apply  func(ops []*quantityOp) []error
+}
+
+// startQuantityWorkers starts count workers, apply writes the ops and returns
+// the error of each
+func startQuantityWorkers(count int, apply func(ops []*quantityOp) []error) *quantityWorkers {
+	w := &quantityWorkers{shards: make([]chan *quantityOp, count), apply: apply}
+	for i := range w.shards {
+		w.shards[i] = make(chan *quantityOp, maxCoalescedOps)
+		go w.run(w.shards[i])
+	}
+
+	return w
+}
+
+// quantityWorkerCount reads the number of workers from STOCK_WRITE_WORKERS
+func quantityWorkerCount() (int, error) {
+	count, err := strconv.Atoi(service.Env("STOCK_WRITE_WORKERS", "16"))
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("STOCK_WRITE_WORKERS has to be a positive number")
+	}
+
+	return count, nil
+}
+
+// do queues the op and waits until it is written
+func (w *quantityWorkers) do(op *quantityOp) error {
+	hash := fnv.New32a()
+	hash.Write([]byte(op.product))
+
+	op.cb = make(chan error, 1)
+	w.shards[hash.Sum32()%uint32(len(w.shards))] <- op
+	return <-op.cb
+}
+
+func (w *quantityWorkers) run(queue chan *quantityOp) {
+	for op := range queue {
+		ops := []*quantityOp{op}
+	coalesce:
+		for len(ops) < maxCoalescedOps {
+			select {
+			case op := <-queue:
+				ops = append(ops, op)
+			default:
+				break coalesce
+			}
+		}
+
+		errs := w.apply(ops)
+		for i, op := range ops {
+			op.cb <- errs[i]
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuantityWorkersCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	var writes [][]*quantityOp
+	started := make(chan struct{})
+	blocked := make(chan struct{})
+
+	workers := startQuantityWorkers(1, func(ops []*quantityOp) []error {
+		mu.Lock()
+		writes = append(writes, ops)
+		first := len(writes) == 1
+		mu.Unlock()
+
+		// ops queue up while the first write is in flight
+		if first {
+			close(started)
+			<-blocked
+		}
+
+		errs := make([]error, len(ops))
+		for i, op := range ops {
+			if op.amount < 0 {
+				errs[i] = ErrInsufficientAmount
+			}
+		}
+		return errs
+	})
+
+	errs := make([]error, 6)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = workers.do(&quantityOp{product: "p1", location: "front", amount: 1})
+	}()
+	<-started
+
+	for i := 1; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			amount := int64(1)
+			if i%2 == 0 {
+				amount = -1
+			}
+			errs[i] = workers.do(&quantityOp{product: "p1", location: "front", amount: amount})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(blocked)
+	wg.Wait()
+
+	if len(writes) != 2 || len(writes[1]) != 5 {
+		t.Fatalf("got %d writes, want the 5 ops queued behind the first written together", len(writes))
+	}
+
+	// every op gets its own error back
+	for i, err := range errs {
+		if (i%2 == 0 && i > 0) != (err == ErrInsufficientAmount) {
+			t.Errorf("got %v for op %d", err, i)
+		}
+	}
+}
+
+func TestApplyQuantityOps(t *testing.T) {
+	db, productID := scriptConn(t)
+	seed(t, db, productID, allocation{"front": 2, "back": 1})
+
+	ops := []*quantityOp{
+		{product: productID, location: "back", amount: 2, m: movement{Reason: reasonPut, Reference: "op0"}},
+		{product: productID, amount: -9, strategy: strategyPriority, m: movement{Reason: reasonDrop, Reference: "op1"}},
+		{product: productID, amount: -4, strategy: strategyMostStock, m: movement{Reason: reasonDrop, Reference: "op2"}},
+		{product: productID, location: "front", amount: -2, m: movement{Reason: reasonDrop, Reference: "op3"}},
+	}
+	errs := dbApplyQuantityOps(db, ops)
+
+	// the ops which can be applied are, the others fail on their own
+	want := []error{nil, ErrInsufficientAmount, nil, ErrInsufficientAmount}
+	if fmt.Sprint(errs) != fmt.Sprint(want) {
+		t.Fatalf("got errors %v, want %v", errs, want)
+	}
+	if fmt.Sprint(ops[2].taken) != fmt.Sprint(allocation{"back": -3, "front": -1}) {
+		t.Errorf("got change %v of the drop, want 3 from back and 1 from front", ops[2].taken)
+	}
+	if ops[1].taken != nil || ops[3].taken != nil {
+		t.Errorf("failed ops have changes %v and %v", ops[1].taken, ops[3].taken)
+	}
+	if stock := locationsOf(t, db, productID); stock["front"] != 1 || stock["back"] != 0 {
+		t.Errorf("got stock %v, want 1 left in front", stock)
+	}
+
+	// every applied op is recorded with its own movement
+	references := []string{}
+	for _, m := range movementsOf(t, db, productID) {
+		references = append(references, m.Reference)
+	}
+	if fmt.Sprint(references[:3]) != "[op2 op2 op0]" {
+		t.Errorf("got movements of %v, want the drop and the put on top", references)
+	}
+}